@@ -1,102 +1,683 @@
+// Package config reads the configuration of the proxy from an
+// optional TOML file and the environment. Environment variables
+// override settings from the file.
+
 package config
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/dkim"
+	"github.com/jorgenschaefer/smtpproxy/dmarc"
+	"github.com/jorgenschaefer/smtpproxy/dnsbl"
+	"github.com/jorgenschaefer/smtpproxy/idna"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+	"github.com/jorgenschaefer/smtpproxy/srs"
+	"github.com/jorgenschaefer/smtpproxy/tlscert"
 )
 
-var validRecipients *regexp.Regexp
+type Config struct {
+	// Which address to relay mails to, including the port.
+	RelayHost string `toml:"relay_host"`
+	// A regular expression matching all recipients to accept.
+	ValidRecipients string `toml:"valid_recipients"`
+	// If set, replaces all recipients given by a client.
+	OverrideRecipient string `toml:"override_recipient"`
+	// The maximum size of a message in bytes.
+	MaxMessageSize int64 `toml:"max_message_size"`
+	// Lower MaxMessageSize to the SIZE limit of the relay host,
+	// which is queried at startup.
+	LearnRelaySize bool `toml:"learn_relay_size"`
+	// What to do with line ends other than CRLF in message data.
+	BareLineEnds LineEnds `toml:"bare_line_ends"`
+	// How many seconds to wait before greeting clients. Clients
+	// that speak during that time are tarpitted.
+	GreetingDelay int `toml:"greeting_delay"`
+	// How long to wait for sessions to finish when shutting down.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	// X.509 certificate and key for TLS.
+	ServerCert string `toml:"server_cert"`
+	ServerKey  string `toml:"server_key"`
+	// Addresses to listen on, each optionally followed by a slash
+	// and a role. Ignored with systemd socket activation.
+	Listen []string `toml:"listen"`
+	// DNSBL zones to query, each optionally followed by the
+	// return codes that count and their weights, see
+	// dnsbl.ParseZone.
+	DNSBL []string `toml:"dnsbl_domains"`
+	// Clients are rejected once the weights of the zones listing
+	// them add up to this.
+	DNSBLThreshold float64 `toml:"dnsbl_threshold"`
+	// Domain-based (RHSBL) zones, with return codes like DNSBL
+	// zones, to query for the HELO name and the sender domain, and
+	// the domains of links in the body if RHSBLBody is set.
+	RHSBL     []string `toml:"rhsbl_domains"`
+	RHSBLBody bool     `toml:"rhsbl_body"`
+	// Allowlist (DNSWL) zones, with return codes like DNSBL zones,
+	// and networks of trusted clients. Trusted clients skip the
+	// greeting delay, the DNSBL checks and greylisting.
+	DNSWL     []string `toml:"dnswl_domains"`
+	Allowlist []string `toml:"allowlist"`
+	// How long to wait for each DNSBL lookup. The lookups start
+	// when the client connects.
+	DNSBLTimeout time.Duration `toml:"dnsbl_timeout"`
+	// When to reject listed clients.
+	DNSBLReject Stage `toml:"dnsbl_reject"`
+	// What to do with each SPF result. SPF is only checked if
+	// this is set, results without an action are logged.
+	SPF map[string]Action `toml:"spf"`
+	// What to do with mail that fails DMARC, by the policy of the
+	// author domain. DMARC is only checked if this is set, policies
+	// without an action are logged.
+	DMARC map[string]Action `toml:"dmarc"`
+	// The public suffix list for relaxed DMARC alignment. Without
+	// it, alignment requires the exact domain.
+	PublicSuffixList string `toml:"public_suffix_list"`
+	// Greylist unknown clients, keeping the state in this file.
+	// Changing the file requires a restart.
+	GreylistFile string `toml:"greylist_file"`
+	// How long clients have to wait before retrying.
+	GreylistDelay time.Duration `toml:"greylist_delay"`
+	// Rewrite senders to this domain with SRS, using the secret
+	// to sign the addresses.
+	SRSDomain string `toml:"srs_domain"`
+	SRSSecret string `toml:"srs_secret"`
+	// Verify DKIM signatures and add an Authentication-Results
+	// header for this authentication service, which defaults to
+	// the host name.
+	VerifyDKIM bool   `toml:"verify_dkim"`
+	AuthservID string `toml:"authserv_id"`
+	// Seal messages with ARC sets, signed with the private key in
+	// the PEM file ARCKey, published at
+	// ARCSelector._domainkey.ARCDomain.
+	ARCDomain   string `toml:"arc_domain"`
+	ARCSelector string `toml:"arc_selector"`
+	ARCKey      string `toml:"arc_key"`
+
+	validRecipients *regexp.Regexp
+	tls             *tls.Config
+	certs           *tlscert.Manager
+	srs             *srs.SRS
+	dnsbl           []dnsbl.Zone
+	rhsbl           []dnsbl.Zone
+	allowlist       []*net.IPNet
+	arc             *dkim.Sealer
+	suffixes        *dmarc.SuffixList
+	listeners       []Listener
+}
+
+// 150MB is the current gmail maximum
+const DefaultMaxMessageSize int64 = 150 * 1024 * 1024
+
+const DefaultGreetingDelay = 5
+
+const DefaultShutdownTimeout = time.Minute
+
+const DefaultDNSBLTimeout = 5 * time.Second
+
+// Where Debian's publicsuffix package installs the list.
+const DefaultPublicSuffixList = "/usr/share/publicsuffix/public_suffix_list.dat"
+
+// RFC 6647 recommends at most five minutes
+const DefaultGreylistDelay = 5 * time.Minute
+
+// Action says what to do with a message that fails a check.
+type Action string
+
+const (
+	// Reject the command.
+	ActionReject Action = "reject"
+	// Add a header to the message.
+	ActionTag Action = "tag"
+	// Only log the result.
+	ActionLog Action = "log"
+)
+
+// Stage is a point in the SMTP session.
+type Stage string
+
+const (
+	// Before the greeting, which then waits for the results.
+	StageConnect Stage = "connect"
+	// At each RCPT command.
+	StageRcpt Stage = "rcpt"
+	// At the DATA command.
+	StageData Stage = "data"
+)
+
+// LineEnds says what to do with a bare CR or LF in message data.
+type LineEnds string
+
+const (
+	// Treat them as line ends, but never as the end of data.
+	LineEndsNormalize LineEnds = "normalize"
+	// Close the connection.
+	LineEndsReject LineEnds = "reject"
+)
+
+// Errors collects all problems found in a configuration.
+type Errors []error
+
+func (e *Errors) Add(err error) {
+	*e = append(*e, err)
+}
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// New returns a configuration with default values, for use without
+// Load(). Note that it accepts mail for all recipients.
+func New() *Config {
+	return &Config{
+		MaxMessageSize:   DefaultMaxMessageSize,
+		BareLineEnds:     LineEndsNormalize,
+		GreetingDelay:    DefaultGreetingDelay,
+		ShutdownTimeout:  DefaultShutdownTimeout,
+		GreylistDelay:    DefaultGreylistDelay,
+		DNSBLThreshold:   1,
+		DNSBLTimeout:     DefaultDNSBLTimeout,
+		DNSBLReject:      StageData,
+		PublicSuffixList: DefaultPublicSuffixList,
+		validRecipients:  regexp.MustCompile(""),
+	}
+}
+
+// Load reads the configuration file at path, if path is not empty,
+// applies the environment and validates the result. The returned
+// error is of type Errors and lists all problems found.
+func Load(path string) (*Config, error) {
+	cfg := New()
+	var errs Errors
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, Errors{err}
+		}
+		table, err := parseTOML(string(data))
+		if err != nil {
+			return nil, Errors{fmt.Errorf("%s: %v", path, err)}
+		}
+		decode("", table, reflect.ValueOf(cfg).Elem(), &errs)
+	}
+	cfg.applyEnv(&errs)
+	cfg.validate(&errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides settings with environment variables. These were
+// the only way to configure the proxy before there was a file.
+func (cfg *Config) applyEnv(errs *Errors) {
+	envString := func(name string, dst *string) {
+		if value := os.Getenv(name); value != "" {
+			*dst = value
+		}
+	}
+	envString("RELAY_HOST", &cfg.RelayHost)
+	envString("VALID_RECIPIENTS", &cfg.ValidRecipients)
+	envString("OVERRIDE_RECIPIENT", &cfg.OverrideRecipient)
+	envString("SERVER_CERT", &cfg.ServerCert)
+	envString("SERVER_KEY", &cfg.ServerKey)
+	envString("SRS_DOMAIN", &cfg.SRSDomain)
+	envString("SRS_SECRET", &cfg.SRSSecret)
+	envString("AUTHSERV_ID", &cfg.AuthservID)
+	envString("ARC_DOMAIN", &cfg.ARCDomain)
+	envString("ARC_SELECTOR", &cfg.ARCSelector)
+	envString("ARC_KEY", &cfg.ARCKey)
+	if value := os.Getenv("MAX_MESSAGE_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs.Add(fmt.Errorf("MAX_MESSAGE_SIZE is not an integer: %s", value))
+		}
+		cfg.MaxMessageSize = size
+	}
+	if value := os.Getenv("LEARN_RELAY_SIZE"); value != "" {
+		learn, err := strconv.ParseBool(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("LEARN_RELAY_SIZE is not a boolean: %s", value))
+		}
+		cfg.LearnRelaySize = learn
+	}
+	if value := os.Getenv("BARE_LINE_ENDS"); value != "" {
+		cfg.BareLineEnds = LineEnds(value)
+	}
+	if value := os.Getenv("GREETING_DELAY"); value != "" {
+		delay, err := strconv.Atoi(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("GREETING_DELAY is not an integer: %s", value))
+		}
+		cfg.GreetingDelay = delay
+	}
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("SHUTDOWN_TIMEOUT is not a duration: %s", value))
+		}
+		cfg.ShutdownTimeout = timeout
+	}
+	if value := os.Getenv("VERIFY_DKIM"); value != "" {
+		verify, err := strconv.ParseBool(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("VERIFY_DKIM is not a boolean: %s", value))
+		}
+		cfg.VerifyDKIM = verify
+	}
+	envString("PUBLIC_SUFFIX_LIST", &cfg.PublicSuffixList)
+	envString("GREYLIST_FILE", &cfg.GreylistFile)
+	if value := os.Getenv("GREYLIST_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("GREYLIST_DELAY is not a duration: %s", value))
+		}
+		cfg.GreylistDelay = delay
+	}
+	if value := os.Getenv("LISTEN_ADDRESS"); value != "" {
+		cfg.Listen = strings.Split(value, ",")
+	}
+	if value := os.Getenv("TLS_LISTEN_ADDRESS"); value != "" {
+		cfg.Listen = append(cfg.Listen, value+"/"+string(RoleSMTPS))
+	}
+	if value := os.Getenv("DNSBL_DOMAINS"); value != "" {
+		cfg.DNSBL = strings.Fields(value)
+	}
+	if value := os.Getenv("RHSBL_DOMAINS"); value != "" {
+		cfg.RHSBL = strings.Fields(value)
+	}
+	if value := os.Getenv("RHSBL_BODY"); value != "" {
+		body, err := strconv.ParseBool(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("RHSBL_BODY is not a boolean: %s", value))
+		}
+		cfg.RHSBLBody = body
+	}
+	if value := os.Getenv("DNSWL_DOMAINS"); value != "" {
+		cfg.DNSWL = strings.Fields(value)
+	}
+	if value := os.Getenv("ALLOWLIST"); value != "" {
+		cfg.Allowlist = strings.Fields(value)
+	}
+	if value := os.Getenv("DNSBL_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs.Add(fmt.Errorf("DNSBL_THRESHOLD is not a number: %s", value))
+		}
+		cfg.DNSBLThreshold = threshold
+	}
+	if value := os.Getenv("DNSBL_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("DNSBL_TIMEOUT is not a duration: %s", value))
+		}
+		cfg.DNSBLTimeout = timeout
+	}
+	if value := os.Getenv("DNSBL_REJECT"); value != "" {
+		cfg.DNSBLReject = Stage(value)
+	}
+	if value := os.Getenv("SPF_ACTIONS"); value != "" {
+		actions, err := parseActions(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("Invalid SPF_ACTIONS: %v", err))
+		}
+		cfg.SPF = actions
+	}
+	if value := os.Getenv("DMARC_ACTIONS"); value != "" {
+		actions, err := parseActions(value)
+		if err != nil {
+			errs.Add(fmt.Errorf("Invalid DMARC_ACTIONS: %v", err))
+		}
+		cfg.DMARC = actions
+	}
+}
+
+// parseActions parses a space-separated list of result=action pairs.
+func parseActions(value string) (map[string]Action, error) {
+	actions := map[string]Action{}
+	for _, field := range strings.Fields(value) {
+		result, action, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected result=action, got %s", field)
+		}
+		actions[result] = Action(action)
+	}
+	return actions, nil
+}
 
-func Check() {
-	if RelayHost() == "" {
-		fmt.Fprintf(os.Stderr, "No RELAY_HOST given\n")
-		os.Exit(1)
+func (cfg *Config) validate(errs *Errors) {
+	if cfg.RelayHost == "" {
+		errs.Add(errors.New("No RELAY_HOST given"))
 	}
 
-	rx, err := regexp.Compile(os.Getenv("VALID_RECIPIENTS"))
+	rx, err := regexp.Compile(cfg.ValidRecipients)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid regular expression VALID_RECIPIENTS: %v\n",
-			err)
-		os.Exit(1)
+		errs.Add(fmt.Errorf("Invalid regular expression VALID_RECIPIENTS: %v", err))
 	}
-	validRecipients = rx
-	// Listening stuff
-	listenpid := os.Getenv("LISTEN_PID")
-	if listenpid != "" {
-		wantedpid, err := strconv.Atoi(listenpid)
+	cfg.validRecipients = rx
+
+	if cfg.MaxMessageSize <= 0 {
+		errs.Add(fmt.Errorf("MAX_MESSAGE_SIZE is not positive: %d", cfg.MaxMessageSize))
+	}
+	switch cfg.BareLineEnds {
+	case LineEndsNormalize, LineEndsReject:
+	default:
+		errs.Add(fmt.Errorf("Unknown BARE_LINE_ENDS policy %s", cfg.BareLineEnds))
+	}
+	if cfg.GreetingDelay < 0 {
+		errs.Add(fmt.Errorf("GREETING_DELAY is negative: %d", cfg.GreetingDelay))
+	}
+	if cfg.ShutdownTimeout < 0 {
+		errs.Add(fmt.Errorf("SHUTDOWN_TIMEOUT is negative: %s", cfg.ShutdownTimeout))
+	}
+	cfg.dnsbl = nil
+	for _, spec := range cfg.DNSBL {
+		zone, err := dnsbl.ParseZone(spec)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "LISTEN_PID is not an integer: %v\n", err)
-			os.Exit(1)
+			errs.Add(fmt.Errorf("Invalid DNSBL_DOMAINS: %v", err))
+			continue
 		}
-		actualpid := os.Getpid()
-		if wantedpid != actualpid {
-			fmt.Fprintf(os.Stderr, "LISTEN_PID is for process %d, we are %d\n",
-				wantedpid, actualpid)
-			os.Exit(1)
+		cfg.dnsbl = append(cfg.dnsbl, zone)
+	}
+	for _, spec := range cfg.DNSWL {
+		zone, err := dnsbl.ParseZone(spec)
+		if err != nil {
+			errs.Add(fmt.Errorf("Invalid DNSWL_DOMAINS: %v", err))
+			continue
 		}
-		listenfds := os.Getenv("LISTEN_FDS")
-		fdcount, err := strconv.Atoi(listenfds)
+		zone.Allow = true
+		cfg.dnsbl = append(cfg.dnsbl, zone)
+	}
+	cfg.rhsbl = nil
+	for _, spec := range cfg.RHSBL {
+		zone, err := dnsbl.ParseZone(spec)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "LISTEN_FDS is not an integer: %v\n", err)
-			os.Exit(1)
+			errs.Add(fmt.Errorf("Invalid RHSBL_DOMAINS: %v", err))
+			continue
 		}
-		if fdcount != 1 {
-			fmt.Fprintf(os.Stderr, "Got %d listening sockets, expected one\n",
-				fdcount)
-			os.Exit(1)
+		cfg.rhsbl = append(cfg.rhsbl, zone)
+	}
+	cfg.allowlist = nil
+	for _, network := range cfg.Allowlist {
+		ipnet, err := dnsbl.ParseNetwork(network)
+		if err != nil {
+			errs.Add(fmt.Errorf("Invalid ALLOWLIST: %v", err))
+			continue
+		}
+		cfg.allowlist = append(cfg.allowlist, ipnet)
+	}
+	if !(cfg.DNSBLThreshold > 0) {
+		errs.Add(fmt.Errorf("DNSBL_THRESHOLD is not positive: %g", cfg.DNSBLThreshold))
+	}
+	if cfg.DNSBLTimeout <= 0 {
+		errs.Add(fmt.Errorf("DNSBL_TIMEOUT is not positive: %s", cfg.DNSBLTimeout))
+	}
+	switch cfg.DNSBLReject {
+	case StageConnect, StageRcpt, StageData:
+	default:
+		errs.Add(fmt.Errorf("Unknown DNSBL_REJECT stage %s", cfg.DNSBLReject))
+	}
+	if cfg.GreylistDelay < 0 {
+		errs.Add(fmt.Errorf("GREYLIST_DELAY is negative: %s", cfg.GreylistDelay))
+	}
+
+	if cfg.ServerCert != "" || cfg.ServerKey != "" {
+		tlsConfig, certs, err := loadTLS(cfg.ServerCert, cfg.ServerKey)
+		if err != nil {
+			errs.Add(fmt.Errorf("Invalid SERVER_CERT/SERVER_KEY: %v", err))
+		}
+		cfg.tls = tlsConfig
+		cfg.certs = certs
+	}
+
+	for result, action := range cfg.SPF {
+		if !validSPFResult(result) {
+			errs.Add(fmt.Errorf("Unknown SPF result %s", result))
+		}
+		switch action {
+		case ActionReject:
+			if result == string(spf.Pass) {
+				errs.Add(errors.New("SPF result pass can not be rejected"))
+			}
+		case ActionTag, ActionLog:
+		default:
+			errs.Add(fmt.Errorf("Unknown action %s for SPF result %s", action, result))
+		}
+	}
+
+	for policy, action := range cfg.DMARC {
+		if !validDMARCPolicy(policy) {
+			errs.Add(fmt.Errorf("Unknown DMARC policy %s", policy))
+		}
+		switch action {
+		case ActionReject, ActionTag, ActionLog:
+		default:
+			errs.Add(fmt.Errorf("Unknown action %s for DMARC policy %s", action, policy))
+		}
+	}
+	if len(cfg.DMARC) > 0 && cfg.PublicSuffixList != "" {
+		suffixes, err := dmarc.LoadSuffixList(cfg.PublicSuffixList)
+		// The default list is optional.
+		if err != nil && !(os.IsNotExist(err) && cfg.PublicSuffixList == DefaultPublicSuffixList) {
+			errs.Add(fmt.Errorf("Invalid PUBLIC_SUFFIX_LIST: %v", err))
+		}
+		cfg.suffixes = suffixes
+	}
+
+	if cfg.SRSDomain != "" || cfg.SRSSecret != "" {
+		if cfg.SRSDomain == "" || cfg.SRSSecret == "" {
+			errs.Add(errors.New("Both SRS_DOMAIN and SRS_SECRET have to be set"))
+		}
+		cfg.srs = srs.New(cfg.SRSDomain, []byte(cfg.SRSSecret))
+	}
+
+	if cfg.ARCDomain != "" || cfg.ARCSelector != "" || cfg.ARCKey != "" {
+		if cfg.ARCDomain == "" || cfg.ARCSelector == "" || cfg.ARCKey == "" {
+			errs.Add(errors.New("ARC_DOMAIN, ARC_SELECTOR and ARC_KEY have to be set together"))
+		} else {
+			sealer, err := loadSealer(cfg.ARCDomain, cfg.ARCSelector, cfg.ARCKey)
+			if err != nil {
+				errs.Add(fmt.Errorf("Invalid ARC_KEY: %v", err))
+			}
+			cfg.arc = sealer
+		}
+	}
+
+	// Listening stuff
+	if ListenMode() == "address" {
+		listeners, err := parseListenAddresses(cfg.Listen)
+		if err != nil {
+			errs.Add(fmt.Errorf("Invalid LISTEN_ADDRESS: %v", err))
+		}
+		cfg.listeners = listeners
+	} else {
+		listeners, err := systemdListeners()
+		if err != nil {
+			errs.Add(err)
+		}
+		cfg.listeners = listeners
+	}
+	for _, l := range cfg.listeners {
+		if l.Role != RoleSMTP && cfg.tls == nil {
+			errs.Add(fmt.Errorf("Listener %s with role %s requires SERVER_CERT and SERVER_KEY",
+				l, l.Role))
 		}
 	}
 }
 
-func DNSBL() []string {
-	return strings.Split(os.Getenv("DNSBL_DOMAINS"), " ")
+// ValidRecipient returns true if mail to recipient is accepted. An
+// internationalized domain matches in its Unicode as well as its
+// ASCII form, so VALID_RECIPIENTS can use either.
+func (cfg *Config) ValidRecipient(recipient string) bool {
+	if cfg.validRecipients.MatchString(recipient) {
+		return true
+	}
+	at := strings.LastIndexByte(recipient, '@')
+	if at < 0 {
+		return false
+	}
+	local, domain := recipient[:at+1], recipient[at+1:]
+	for _, convert := range []func(string) (string, error){idna.ToUnicode, idna.ToASCII} {
+		other, err := convert(domain)
+		if err == nil && other != domain && cfg.validRecipients.MatchString(local+other) {
+			return true
+		}
+	}
+	return false
 }
 
-func ValidRecipient() *regexp.Regexp {
-	return validRecipients
+func (cfg *Config) Override() (string, bool) {
+	return cfg.OverrideRecipient, cfg.OverrideRecipient != ""
 }
 
-func OverrideRecipient() (string, bool) {
-	override := os.Getenv("OVERRIDE_RECIPIENT")
-	if override != "" {
-		return override, true
-	} else {
-		return "", false
+// SPFAction returns what to do with an SPF result.
+func (cfg *Config) SPFAction(result spf.Result) Action {
+	if action, ok := cfg.SPF[string(result)]; ok {
+		return action
 	}
+	return ActionLog
 }
 
-func RelayHost() string {
-	return os.Getenv("RELAY_HOST")
+func validSPFResult(result string) bool {
+	for _, r := range spf.Results {
+		if string(r) == result {
+			return true
+		}
+	}
+	return false
 }
 
-func ListenMode() string {
-	if os.Getenv("LISTEN_PID") == "" {
-		return "address"
-	} else {
-		return "systemd"
+// DMARCAction returns what to do with mail that fails DMARC for a
+// policy.
+func (cfg *Config) DMARCAction(policy dmarc.Policy) Action {
+	if action, ok := cfg.DMARC[string(policy)]; ok {
+		return action
 	}
+	return ActionLog
 }
 
-func ListenAddress() string {
-	address := os.Getenv("LISTEN_ADDRESS")
+func validDMARCPolicy(policy string) bool {
+	for _, p := range dmarc.Policies {
+		if string(p) == policy {
+			return true
+		}
+	}
+	return false
+}
 
-	if address == "" {
-		return ":25"
-	} else {
-		return address
+// DNSBLZones returns the parsed DNSBL and DNSWL zones.
+func (cfg *Config) DNSBLZones() []dnsbl.Zone {
+	return cfg.dnsbl
+}
+
+// RHSBLZones returns the parsed RHSBL zones.
+func (cfg *Config) RHSBLZones() []dnsbl.Zone {
+	return cfg.rhsbl
+}
+
+// AllowedNetworks returns the parsed networks of trusted clients.
+func (cfg *Config) AllowedNetworks() []*net.IPNet {
+	return cfg.allowlist
+}
+
+// SRS returns the sender rewriting, if configured.
+func (cfg *Config) SRS() (*srs.SRS, bool) {
+	return cfg.srs, cfg.srs != nil
+}
+
+func loadSealer(domain, selector, path string) (*dkim.Sealer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := dkim.ParseKey(data)
+	if err != nil {
+		return nil, err
 	}
+	return dkim.NewSealer(domain, selector, key)
 }
 
-const SD_LISTEN_FDS_START uintptr = 3
+// ARC returns the sealer for ARC sets, if configured.
+func (cfg *Config) ARC() (*dkim.Sealer, bool) {
+	return cfg.arc, cfg.arc != nil
+}
+
+// SetARC sets the sealer instead of loading ARCKey.
+func (cfg *Config) SetARC(sealer *dkim.Sealer) {
+	cfg.arc = sealer
+}
+
+// PublicSuffixes returns the public suffix list, or nil if there is
+// none.
+func (cfg *Config) PublicSuffixes() *dmarc.SuffixList {
+	return cfg.suffixes
+}
+
+func (cfg *Config) TLS() (*tls.Config, bool) {
+	return cfg.tls, cfg.tls != nil
+}
+
+// SetTLS sets the TLS configuration instead of loading ServerCert and
+// ServerKey.
+func (cfg *Config) SetTLS(tlsConfig *tls.Config) {
+	cfg.tls = tlsConfig
+	cfg.certs = nil
+}
+
+// Certificates returns the manager of the certificate loaded from
+// ServerCert and ServerKey, if there is one.
+func (cfg *Config) Certificates() (*tlscert.Manager, bool) {
+	return cfg.certs, cfg.certs != nil
+}
 
-func ListenFD() uintptr {
-	return SD_LISTEN_FDS_START
+// Listeners returns all configured listeners.
+func (cfg *Config) Listeners() []Listener {
+	return cfg.listeners
 }
 
-func TLS() (*tls.Config, bool) {
-	return nil, false
+func ListenMode() string {
+	if os.Getenv("LISTEN_PID") == "" {
+		return "address"
+	} else {
+		return "systemd"
+	}
+}
+
+func loadTLS(certFile, keyFile string) (*tls.Config, *tlscert.Manager, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("both SERVER_CERT and SERVER_KEY have to be set")
+	}
+	manager, err := tlscert.New(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{
+		// The certificate manager picks up renewed certificates
+		// without a restart.
+		GetCertificate: manager.GetCertificate,
+		// TLS 1.3 suites are not configurable and all fine. For
+		// TLS 1.2, only allow forward secret AEAD suites.
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}, manager, nil
 }
@@ -0,0 +1,330 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/dmarc"
+	"github.com/jorgenschaefer/smtpproxy/internal/testcert"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+)
+
+func TestLoadTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _, err := testcert.WriteFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, certs, err := loadTLS(certFile, keyFile)
+	if err != nil || certs == nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || cert == nil || cert.Leaf == nil {
+		t.Errorf("Expected a parsed certificate, got %#v, %#v", cert, err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected minimum version TLS 1.2, got %#v", cfg.MinVersion)
+	}
+
+	if _, _, err := loadTLS(certFile, ""); err == nil {
+		t.Error("Expected an error for a missing key")
+	}
+	if _, _, err := loadTLS(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("Expected an error for a missing certificate file")
+	}
+}
+
+func TestParseListenAddresses(t *testing.T) {
+	listeners, err := parseListenAddresses(nil)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	expectListeners(t, listeners, []Listener{{Role: RoleSMTP, Address: ":25"}})
+
+	listeners, err = parseListenAddresses([]string{
+		"0.0.0.0:25", " [::]:25", ":465/smtps", "[::1]:587/submission"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	expectListeners(t, listeners, []Listener{
+		{Role: RoleSMTP, Address: "0.0.0.0:25"},
+		{Role: RoleSMTP, Address: "[::]:25"},
+		{Role: RoleSMTPS, Address: ":465"},
+		{Role: RoleSubmission, Address: "[::1]:587"},
+	})
+
+	for _, bad := range []string{":25/imap", "/smtps", ""} {
+		if _, err := parseListenAddresses([]string{bad}); err == nil {
+			t.Errorf("Expected an error for %#v", bad)
+		}
+	}
+}
+
+func TestParseListenFDs(t *testing.T) {
+	listeners, err := parseListenFDs(1, "")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	expectListeners(t, listeners, []Listener{{Role: RoleSMTP, FD: 3}})
+
+	listeners, err = parseListenFDs(4, "smtpproxy.socket:smtps:smtps:submission")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	expectListeners(t, listeners, []Listener{
+		{Role: RoleSMTP, FD: 3},
+		{Role: RoleSMTPS, FD: 4},
+		{Role: RoleSMTPS, FD: 5},
+		{Role: RoleSubmission, FD: 6},
+	})
+
+	if _, err := parseListenFDs(0, ""); err == nil {
+		t.Error("Expected an error for no sockets")
+	}
+	if _, err := parseListenFDs(2, "smtp"); err == nil {
+		t.Error("Expected an error for a wrong number of names")
+	}
+	if _, err := parseListenFDs(2, "smtp:smtsp"); err == nil {
+		t.Error("Expected an error for an unknown role")
+	}
+}
+
+func expectListeners(t *testing.T, actual, expected []Listener) {
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected listener %d to be %#v, got %#v",
+				i, expected[i], actual[i])
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _, err := testcert.WriteFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, arcKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arcDER, err := x509.MarshalPKCS8PrivateKey(arcKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arcFile := filepath.Join(dir, "arc.pem")
+	writeFile(t, arcFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: arcDER})))
+	path := filepath.Join(dir, "smtpproxy.toml")
+	writeFile(t, path, `relay_host = "mail.tld:25"
+valid_recipients = "^test@test\\.tld$"
+max_message_size = 1024
+bare_line_ends = "reject"
+learn_relay_size = true
+server_cert = "`+certFile+`"
+server_key = "`+keyFile+`"
+listen = [":25", ":465/smtps"]
+dnsbl_domains = ["zen.spamhaus.org=127.0.0.2/31:2,127.0.0.10/31:0.5", "bl.spamcop.net"]
+dnsbl_threshold = 2
+dnswl_domains = ["list.dnswl.org"]
+rhsbl_domains = ["dbl.spamhaus.org=127.0.1.0/24"]
+rhsbl_body = true
+allowlist = ["192.0.2.0/24", "2001:db8::1"]
+dnsbl_timeout = "2s"
+dnsbl_reject = "rcpt"
+srs_domain = "fwd.tld"
+srs_secret = "secret"
+verify_dkim = true
+greylist_file = "/var/lib/smtpproxy/greylist"
+greylist_delay = "10m"
+arc_domain = "test.tld"
+arc_selector = "arc"
+arc_key = "`+arcFile+`"
+
+[spf]
+fail = "reject"
+
+[dmarc]
+reject = "reject"
+quarantine = "tag"
+`)
+	t.Setenv("RELAY_HOST", "")
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("OVERRIDE_RECIPIENT", "other@test.tld")
+	t.Setenv("MAX_MESSAGE_SIZE", "2048")
+	t.Setenv("AUTHSERV_ID", "mx.test.tld")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	expectStringEqual(t, cfg.RelayHost, "mail.tld:25")
+	if !cfg.ValidRecipient("test@test.tld") || cfg.ValidRecipient("test@testxtld") {
+		t.Error("Expected VALID_RECIPIENTS to be used")
+	}
+	if override, ok := cfg.Override(); !ok || override != "other@test.tld" {
+		t.Errorf("Expected the environment to set the override, got %#v", override)
+	}
+	if cfg.MaxMessageSize != 2048 {
+		t.Errorf("Expected the environment to override the file, got %d",
+			cfg.MaxMessageSize)
+	}
+	if cfg.BareLineEnds != LineEndsReject || !cfg.LearnRelaySize {
+		t.Errorf("Unexpected message settings %s, %v", cfg.BareLineEnds, cfg.LearnRelaySize)
+	}
+	if cfg.GreetingDelay != DefaultGreetingDelay {
+		t.Errorf("Expected the default greeting delay, got %d", cfg.GreetingDelay)
+	}
+	if _, ok := cfg.TLS(); !ok {
+		t.Error("Expected TLS to be configured")
+	}
+	expectListeners(t, cfg.Listeners(), []Listener{
+		{Role: RoleSMTP, Address: ":25"},
+		{Role: RoleSMTPS, Address: ":465"},
+	})
+	if _, ok := cfg.SRS(); !ok {
+		t.Error("Expected SRS to be configured")
+	}
+	if cfg.SPFAction(spf.Fail) != ActionReject || cfg.SPFAction(spf.SoftFail) != ActionLog {
+		t.Errorf("Unexpected SPF actions %#v", cfg.SPF)
+	}
+	if cfg.DMARCAction(dmarc.PolicyQuarantine) != ActionTag || cfg.DMARCAction(dmarc.PolicyNone) != ActionLog {
+		t.Errorf("Unexpected DMARC actions %#v", cfg.DMARC)
+	}
+	if cfg.GreylistFile != "/var/lib/smtpproxy/greylist" || cfg.GreylistDelay != 10*time.Minute {
+		t.Errorf("Unexpected greylisting %#v, %s", cfg.GreylistFile, cfg.GreylistDelay)
+	}
+	if zones := cfg.DNSBLZones(); len(zones) != 3 || len(zones[0].Codes) != 2 || !zones[2].Allow || cfg.DNSBLThreshold != 2 {
+		t.Errorf("Unexpected DNSBL zones %#v, threshold %g", zones, cfg.DNSBLThreshold)
+	}
+	if zones := cfg.RHSBLZones(); len(zones) != 1 || len(zones[0].Codes) != 1 || !cfg.RHSBLBody {
+		t.Errorf("Unexpected RHSBL zones %#v, body %v", zones, cfg.RHSBLBody)
+	}
+	if networks := cfg.AllowedNetworks(); len(networks) != 2 || networks[1].String() != "2001:db8::1/128" {
+		t.Errorf("Unexpected allowlist %v", networks)
+	}
+	if cfg.DNSBLTimeout != 2*time.Second || cfg.DNSBLReject != StageRcpt {
+		t.Errorf("Unexpected DNSBL settings %s, %s", cfg.DNSBLTimeout, cfg.DNSBLReject)
+	}
+	if _, ok := cfg.ARC(); !ok {
+		t.Error("Expected ARC sealing to be configured")
+	}
+	if !cfg.VerifyDKIM || cfg.AuthservID != "mx.test.tld" {
+		t.Errorf("Expected DKIM verification for mx.test.tld, got %v, %#v", cfg.VerifyDKIM, cfg.AuthservID)
+	}
+}
+
+func TestValidRecipient(t *testing.T) {
+	cfg := New()
+	cfg.validRecipients = regexp.MustCompile(`@(bücher|xn--mnchen-3ya)\.tld$`)
+	for _, recipient := range []string{"me@bücher.tld", "me@xn--bcher-kva.tld", "jürgen@XN--BCHER-KVA.tld",
+		"me@münchen.tld", "me@München.tld", "me@xn--mnchen-3ya.tld"} {
+		if !cfg.ValidRecipient(recipient) {
+			t.Errorf("Expected %#v to be valid", recipient)
+		}
+	}
+	for _, recipient := range []string{"me@bucher.tld", "me@xn--bcher-kva.tld.other", "bücher.tld"} {
+		if cfg.ValidRecipient(recipient) {
+			t.Errorf("Expected %#v to be invalid", recipient)
+		}
+	}
+}
+
+func TestLoadPublicSuffixList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "public_suffix_list.dat")
+	if err := os.WriteFile(path, []byte("// Test\nio\ngithub.io\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELAY_HOST", "mail.tld:25")
+	t.Setenv("DMARC_ACTIONS", "reject=reject")
+	t.Setenv("PUBLIC_SUFFIX_LIST", path)
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org, ok := cfg.PublicSuffixes().OrganizationalDomain("a.test.github.io"); !ok || org != "test.github.io" {
+		t.Errorf("Expected the list to be loaded, got %s, %v", org, ok)
+	}
+	t.Setenv("PUBLIC_SUFFIX_LIST", path+".missing")
+	if _, err := Load(""); err == nil {
+		t.Error("Expected an error for a missing list")
+	}
+}
+
+func TestParseActions(t *testing.T) {
+	actions, err := parseActions("fail=reject  softfail=tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 2 || actions["fail"] != ActionReject || actions["softfail"] != ActionTag {
+		t.Errorf("Unexpected actions %#v", actions)
+	}
+	if _, err := parseActions("fail"); err == nil {
+		t.Error("Expected an error for a missing action")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtpproxy.toml")
+	writeFile(t, path, `valid_recipients = "("
+max_message_size = 0
+bare_line_ends = "ignore"
+listen = [":465/smtps"]
+unknown = true
+srs_domain = "fwd.tld"
+arc_domain = "test.tld"
+dnsbl_reject = "helo"
+dnsbl_domains = ["zen.spamhaus.org=127.0.0.2:x"]
+allowlist = ["192.0.2.0/33"]
+
+[spf]
+pass = "reject"
+bogus = "tag"
+
+[dmarc]
+reject = "drop"
+`)
+	t.Setenv("RELAY_HOST", "")
+	t.Setenv("LISTEN_PID", "")
+	_, err := Load(path)
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Expected Errors, got %#v", err)
+	}
+	// unknown setting, no relay host, regular expression, size,
+	// listener without TLS, rejecting SPF pass, unknown SPF result,
+	// SRS without secret, ARC without key, unknown DMARC action,
+	// unknown DNSBL stage, invalid DNSBL weight, invalid allowlist,
+	// unknown line end policy
+	if len(errs) != 14 {
+		t.Errorf("Expected all 14 errors to be reported, got:\n%v", errs)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectStringEqual(t *testing.T, actual, expected string) {
+	if actual != expected {
+		t.Errorf("Expected %#v to be %#v", actual, expected)
+	}
+}
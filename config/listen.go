@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Role describes how connections on a listener are handled.
+type Role string
+
+const (
+	// Plain SMTP on port 25, with optional STARTTLS.
+	RoleSMTP Role = "smtp"
+	// Implicit TLS as described in RFC 8314, usually port 465.
+	RoleSMTPS Role = "smtps"
+	// Message submission, usually port 587. Clients have to use
+	// STARTTLS before sending mail.
+	RoleSubmission Role = "submission"
+)
+
+// Listener is a single address or systemd socket to accept
+// connections on.
+type Listener struct {
+	Role Role
+	// Address is set in address mode, FD when using systemd
+	// socket activation.
+	Address string
+	FD      uintptr
+}
+
+func (l Listener) String() string {
+	if l.Address != "" {
+		return l.Address
+	}
+	return fmt.Sprintf("fd:%d", l.FD)
+}
+
+const SD_LISTEN_FDS_START uintptr = 3
+
+func parseRole(name string) (Role, bool) {
+	switch role := Role(name); role {
+	case RoleSMTP, RoleSMTPS, RoleSubmission:
+		return role, true
+	}
+	return "", false
+}
+
+// parseListenAddresses parses a list of addresses, each optionally
+// followed by a slash and a role, for example ":465/smtps".
+func parseListenAddresses(addresses []string) ([]Listener, error) {
+	if len(addresses) == 0 {
+		addresses = []string{":25"}
+	}
+	result := []Listener{}
+	for _, entry := range addresses {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		l := Listener{Role: RoleSMTP, Address: entry}
+		if i := strings.LastIndex(entry, "/"); i >= 0 {
+			role, ok := parseRole(entry[i+1:])
+			if !ok {
+				return nil, fmt.Errorf("unknown role %q for %s", entry[i+1:], entry[:i])
+			}
+			l.Role = role
+			l.Address = entry[:i]
+		}
+		if l.Address == "" {
+			return nil, fmt.Errorf("empty address in %q", entry)
+		}
+		result = append(result, l)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no address given")
+	}
+	return result, nil
+}
+
+// systemdListeners checks the environment passed by systemd for
+// socket activation and returns the sockets.
+func systemdListeners() ([]Listener, error) {
+	listenpid := os.Getenv("LISTEN_PID")
+	wantedpid, err := strconv.Atoi(listenpid)
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_PID is not an integer: %v", err)
+	}
+	actualpid := os.Getpid()
+	if wantedpid != actualpid {
+		return nil, fmt.Errorf("LISTEN_PID is for process %d, we are %d",
+			wantedpid, actualpid)
+	}
+	listenfds := os.Getenv("LISTEN_FDS")
+	fdcount, err := strconv.Atoi(listenfds)
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS is not an integer: %v", err)
+	}
+	listeners, err := parseListenFDs(fdcount, os.Getenv("LISTEN_FDNAMES"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid systemd sockets: %v", err)
+	}
+	return listeners, nil
+}
+
+// parseListenFDs returns the listeners passed by systemd. The role is
+// taken from the socket's FileDescriptorName, which is passed in
+// LISTEN_FDNAMES. Sockets without a FileDescriptorName get the name
+// of their unit, and are plain SMTP. Other names are an error, so a
+// typo does not turn an SMTPS socket into a plaintext one.
+func parseListenFDs(count int, names string) ([]Listener, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("got %d listening sockets, expected at least one", count)
+	}
+	var fdnames []string
+	if names != "" {
+		fdnames = strings.Split(names, ":")
+		if len(fdnames) != count {
+			return nil, fmt.Errorf("got %d names for %d listening sockets",
+				len(fdnames), count)
+		}
+	}
+	result := make([]Listener, count)
+	for i := range result {
+		result[i] = Listener{Role: RoleSMTP, FD: SD_LISTEN_FDS_START + uintptr(i)}
+		if fdnames == nil || strings.HasSuffix(fdnames[i], ".socket") {
+			continue
+		}
+		role, ok := parseRole(fdnames[i])
+		if !ok {
+			return nil, fmt.Errorf("unknown role %s for socket %d", fdnames[i], i)
+		}
+		result[i].Role = role
+	}
+	return result, nil
+}
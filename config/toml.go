@@ -0,0 +1,468 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// This file implements the subset of TOML (https://toml.io/) the
+// configuration file uses: tables, arrays of tables, strings,
+// integers, floats, booleans and arrays. Inline tables, dates and
+// multi-line strings are not supported.
+
+type tomlParser struct {
+	data string
+	pos  int
+	line int
+}
+
+func parseTOML(data string) (map[string]interface{}, error) {
+	p := &tomlParser{data: data, line: 1}
+	root := map[string]interface{}{}
+	current := root
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return root, nil
+		}
+		var err error
+		if p.peek() == '[' {
+			current, err = p.parseTableHeader(root)
+		} else {
+			err = p.parseKeyValue(current)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.data[p.pos]
+}
+
+// skipSpace skips whitespace and comments, and newlines if asked to.
+func (p *tomlParser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) expectEndOfLine() error {
+	p.skipSpace(false)
+	if p.eof() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return p.errorf("unexpected %q after value", p.peek())
+	}
+	return nil
+}
+
+func (p *tomlParser) parseTableHeader(root map[string]interface{}) (map[string]interface{}, error) {
+	p.pos++
+	array := !p.eof() && p.peek() == '['
+	if array {
+		p.pos++
+	}
+	path, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	if !strings.HasPrefix(p.data[p.pos:], closing) {
+		return nil, p.errorf("expected %s after table name", closing)
+	}
+	p.pos += len(closing)
+	if err := p.expectEndOfLine(); err != nil {
+		return nil, err
+	}
+
+	table := root
+	for i, key := range path {
+		last := i == len(path)-1
+		switch existing := table[key].(type) {
+		case nil:
+			if last && array {
+				next := map[string]interface{}{}
+				table[key] = []interface{}{next}
+				return next, nil
+			}
+			next := map[string]interface{}{}
+			table[key] = next
+			table = next
+		case map[string]interface{}:
+			if last && array {
+				return nil, p.errorf("%s is a table, not an array of tables",
+					strings.Join(path, "."))
+			}
+			table = existing
+		case []interface{}:
+			tables, ok := existing[len(existing)-1].(map[string]interface{})
+			if !ok {
+				return nil, p.errorf("%s is not a table", strings.Join(path[:i+1], "."))
+			}
+			if last && array {
+				next := map[string]interface{}{}
+				table[key] = append(existing, next)
+				return next, nil
+			}
+			table = tables
+		default:
+			return nil, p.errorf("%s is not a table", strings.Join(path[:i+1], "."))
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) parseKeyValue(table map[string]interface{}) error {
+	path, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	if p.eof() || p.peek() != '=' {
+		return p.errorf("expected = after key %s", strings.Join(path, "."))
+	}
+	p.pos++
+	p.skipSpace(false)
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	if err := p.expectEndOfLine(); err != nil {
+		return err
+	}
+	for _, key := range path[:len(path)-1] {
+		next, ok := table[key].(map[string]interface{})
+		if !ok {
+			if table[key] != nil {
+				return p.errorf("%s is not a table", key)
+			}
+			next = map[string]interface{}{}
+			table[key] = next
+		}
+		table = next
+	}
+	key := path[len(path)-1]
+	if _, ok := table[key]; ok {
+		return p.errorf("duplicate key %s", strings.Join(path, "."))
+	}
+	table[key] = value
+	return nil
+}
+
+// parseKey parses a possibly dotted key and the whitespace after it.
+func (p *tomlParser) parseKey() ([]string, error) {
+	path := []string{}
+	for {
+		p.skipSpace(false)
+		if p.eof() {
+			return nil, p.errorf("expected a key")
+		}
+		var key string
+		var err error
+		switch p.peek() {
+		case '"':
+			key, err = p.parseBasicString()
+		case '\'':
+			key, err = p.parseLiteralString()
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("unexpected %q, expected a key", p.peek())
+			}
+			key = p.data[start:p.pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, key)
+		p.skipSpace(false)
+		if p.eof() || p.peek() != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	if p.eof() {
+		return nil, p.errorf("expected a value")
+	}
+	switch c := p.peek(); {
+	case c == '"':
+		return p.parseBasicString()
+	case c == '\'':
+		return p.parseLiteralString()
+	case c == '[':
+		return p.parseArray()
+	case strings.HasPrefix(p.data[p.pos:], "true"):
+		p.pos += 4
+		return true, nil
+	case strings.HasPrefix(p.data[p.pos:], "false"):
+		p.pos += 5
+		return false, nil
+	default:
+		return p.parseNumber()
+	}
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			esc := p.peek()
+			p.pos++
+			switch esc {
+			case 'b':
+				sb.WriteByte('\b')
+			case 't':
+				sb.WriteByte('\t')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'r':
+				sb.WriteByte('\r')
+			case '"', '\\':
+				sb.WriteByte(esc)
+			case 'u', 'U':
+				size := 4
+				if esc == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.data) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.data[p.pos:p.pos+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				p.pos += size
+				sb.WriteRune(rune(code))
+			default:
+				return "", p.errorf("invalid escape sequence \\%c", esc)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos++
+	start := p.pos
+	for !p.eof() && p.peek() != '\'' {
+		if p.peek() == '\n' {
+			break
+		}
+		p.pos++
+	}
+	if p.eof() || p.peek() != '\'' {
+		return "", p.errorf("unterminated string")
+	}
+	p.pos++
+	return p.data[start : p.pos-1], nil
+}
+
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.pos++
+	result := []interface{}{}
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return result, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+		p.skipSpace(true)
+		if p.eof() {
+			return nil, p.errorf("unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseNumber() (interface{}, error) {
+	start := p.pos
+	for !p.eof() && strings.IndexByte("0123456789+-_.eE", p.peek()) >= 0 {
+		p.pos++
+	}
+	text := strings.Replace(p.data[start:p.pos], "_", "", -1)
+	if text == "" {
+		return nil, p.errorf("unexpected %q, expected a value", p.peek())
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("invalid number %q", text)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decode stores the parsed TOML value src in dst, using the toml
+// struct tags to find fields. All errors are collected in errs.
+func decode(path string, src interface{}, dst reflect.Value, errs *Errors) {
+	typeError := func(expected string) {
+		errs.Add(fmt.Errorf("%s: expected %s, got %#v", path, expected, src))
+	}
+	if dst.Type() == durationType {
+		text, ok := src.(string)
+		if !ok {
+			typeError("a duration like \"5s\"")
+			return
+		}
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			errs.Add(fmt.Errorf("%s: %v", path, err))
+			return
+		}
+		dst.SetInt(int64(d))
+		return
+	}
+	switch dst.Kind() {
+	case reflect.String:
+		if text, ok := src.(string); ok {
+			dst.SetString(text)
+		} else {
+			typeError("a string")
+		}
+	case reflect.Bool:
+		if b, ok := src.(bool); ok {
+			dst.SetBool(b)
+		} else {
+			typeError("a boolean")
+		}
+	case reflect.Int, reflect.Int64:
+		if i, ok := src.(int64); ok {
+			dst.SetInt(i)
+		} else {
+			typeError("an integer")
+		}
+	case reflect.Float64:
+		switch n := src.(type) {
+		case float64:
+			dst.SetFloat(n)
+		case int64:
+			dst.SetFloat(float64(n))
+		default:
+			typeError("a number")
+		}
+	case reflect.Slice:
+		items, ok := src.([]interface{})
+		if !ok {
+			typeError("an array")
+			return
+		}
+		slice := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			decode(fmt.Sprintf("%s[%d]", path, i), item, slice.Index(i), errs)
+		}
+		dst.Set(slice)
+	case reflect.Map:
+		table, ok := src.(map[string]interface{})
+		if !ok {
+			typeError("a table")
+			return
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), len(table))
+		for key, item := range table {
+			value := reflect.New(dst.Type().Elem()).Elem()
+			decode(joinPath(path, key), item, value, errs)
+			m.SetMapIndex(reflect.ValueOf(key), value)
+		}
+		dst.Set(m)
+	case reflect.Struct:
+		table, ok := src.(map[string]interface{})
+		if !ok {
+			typeError("a table")
+			return
+		}
+		fields := map[string]reflect.Value{}
+		for i := 0; i < dst.NumField(); i++ {
+			if tag := dst.Type().Field(i).Tag.Get("toml"); tag != "" {
+				fields[tag] = dst.Field(i)
+			}
+		}
+		for key, item := range table {
+			field, ok := fields[key]
+			if !ok {
+				errs.Add(fmt.Errorf("%s: unknown setting", joinPath(path, key)))
+				continue
+			}
+			decode(joinPath(path, key), item, field, errs)
+		}
+	default:
+		panic("config: can not decode into " + dst.Type().String())
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	data := `# A comment
+name = "value" # trailing comment
+literal = 'C:\path'
+escaped = "a\tb\"c\u00e4"
+number = 1_000
+negative = -5
+float = 0.5
+yes = true
+no = false
+list = [
+  "one", # first
+  "two",
+]
+empty = []
+
+[table]
+key = "in table"
+"quoted key" = 1
+dotted.key = 2
+
+[table.sub]
+key = "in subtable"
+
+[[items]]
+name = "first"
+
+[[items]]
+name = "second"
+`
+	table, err := parseTOML(data)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	expected := map[string]interface{}{
+		"name":     "value",
+		"literal":  `C:\path`,
+		"escaped":  "a\tb\"c\u00e4",
+		"number":   int64(1000),
+		"negative": int64(-5),
+		"float":    0.5,
+		"yes":      true,
+		"no":       false,
+		"list":     []interface{}{"one", "two"},
+		"empty":    []interface{}{},
+		"table": map[string]interface{}{
+			"key":        "in table",
+			"quoted key": int64(1),
+			"dotted": map[string]interface{}{
+				"key": int64(2),
+			},
+			"sub": map[string]interface{}{
+				"key": "in subtable",
+			},
+		},
+		"items": []interface{}{
+			map[string]interface{}{"name": "first"},
+			map[string]interface{}{"name": "second"},
+		},
+	}
+	if !reflect.DeepEqual(table, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, table)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	bad := []string{
+		`key`,
+		`key = `,
+		`key = "unterminated`,
+		`key = "bad \q escape"`,
+		`key = [1, 2`,
+		`key = 1 2`,
+		`key = 1` + "\n" + `key = 2`,
+		`[table`,
+		`key = 1` + "\n" + `[key]`,
+		`[table]` + "\n" + `[[table]]`,
+	}
+	for _, data := range bad {
+		if _, err := parseTOML(data); err == nil {
+			t.Errorf("Expected an error for %#v", data)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	type item struct {
+		Name   string  `toml:"name"`
+		Weight float64 `toml:"weight"`
+	}
+	type target struct {
+		Text     string          `toml:"text"`
+		Flag     bool            `toml:"flag"`
+		Count    int             `toml:"count"`
+		Size     int64           `toml:"size"`
+		Delay    time.Duration   `toml:"delay"`
+		List     []string        `toml:"list"`
+		Items    []item          `toml:"items"`
+		Named    map[string]item `toml:"named"`
+		Untagged string
+	}
+	table, err := parseTOML(`text = "hello"
+flag = true
+count = 3
+size = 1024
+delay = "1m30s"
+list = ["a", "b"]
+[[items]]
+name = "first"
+weight = 2
+[named.x]
+name = "x"
+weight = 0.5
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual target
+	var errs Errors
+	decode("", table, reflect.ValueOf(&actual).Elem(), &errs)
+	if len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	expected := target{
+		Text:  "hello",
+		Flag:  true,
+		Count: 3,
+		Size:  1024,
+		Delay: 90 * time.Second,
+		List:  []string{"a", "b"},
+		Items: []item{{Name: "first", Weight: 2}},
+		Named: map[string]item{"x": {Name: "x", Weight: 0.5}},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, actual)
+	}
+
+	table, err = parseTOML(`text = 1
+flag = "yes"
+delay = "soon"
+unknown = 1
+[named.x]
+nmae = "typo"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs = nil
+	decode("", table, reflect.ValueOf(&actual).Elem(), &errs)
+	if len(errs) != 5 {
+		t.Errorf("Expected 5 errors, got %v", errs)
+	}
+}
@@ -0,0 +1,363 @@
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/message"
+)
+
+// Authenticated Received Chain, RFC 8617
+
+// maxInstance is the highest allowed ARC set instance.
+const maxInstance = 50
+
+// The header fields signed by our ARC-Message-Signature, if present.
+var arcSignedFields = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+// Chain is the result of validating the ARC chain of a message.
+type Chain struct {
+	// None, Pass or Fail.
+	Result Result
+	// Reason explains a failed chain.
+	Reason string
+	// The instance of the most recent ARC set, 0 if there is none.
+	Instance int
+	// closed is set if no more ARC sets may be added.
+	closed bool
+}
+
+func (c Chain) fail(format string, args ...interface{}) Chain {
+	c.Result = Fail
+	c.Reason = fmt.Sprintf(format, args...)
+	return c
+}
+
+type arcSet struct {
+	results   *message.Field
+	signature *message.Field
+	seal      *message.Field
+}
+
+// VerifyChain validates the ARC chain of a message (RFC 8617,
+// section 5.2). It returns an error only if the message can not be
+// read.
+func (v *Verifier) VerifyChain(r io.Reader) (Chain, error) {
+	br := bufio.NewReader(r)
+	header, err := message.ReadHeader(br)
+	if err != nil {
+		return Chain{}, err
+	}
+	sets, n, err := arcSets(header)
+	chain := Chain{Result: None, Instance: n, closed: n >= maxInstance}
+	if err != nil {
+		return chain.fail("%v", err), nil
+	}
+	if n == 0 {
+		return chain, nil
+	}
+
+	seals := make([]*signature, n)
+	for i := n - 1; i >= 0; i-- {
+		seal, cv, err := parseSeal(*sets[i].seal)
+		if err != nil {
+			return chain.fail("seal %d: %v", i+1, err), nil
+		}
+		if i == n-1 && cv == Fail {
+			chain.closed = true
+			return chain.fail("chain failed at instance %d", n), nil
+		}
+		expected := Pass
+		if i == 0 {
+			expected = None
+		}
+		if cv != expected {
+			return chain.fail("seal %d has cv=%s", i+1, cv), nil
+		}
+		seals[i] = seal
+	}
+
+	ams, err := parseMessageSignature(*sets[n-1].signature, v.now())
+	if err != nil {
+		return chain.fail("message signature %d: %v", n, err), nil
+	}
+	b := newBody(ams)
+	if _, err := io.Copy(b.canonical, br); err != nil {
+		return Chain{}, err
+	}
+	if err := v.verify(header, ams, b); err != nil {
+		return chain.fail("message signature %d: %v", n, err), nil
+	}
+	for i := n - 1; i >= 0; i-- {
+		key, err := v.key(seals[i])
+		if err == nil {
+			err = verifyHash(key, seals[i], sealHash(sets[:i+1], seals[i].hash))
+		}
+		if err != nil {
+			return chain.fail("seal %d: %v", i+1, err), nil
+		}
+	}
+	chain.Result = Pass
+	return chain, nil
+}
+
+// arcSets returns the complete ARC sets of a message, ordered by
+// instance, and the highest instance found.
+func arcSets(header message.Header) ([]*arcSet, int, error) {
+	byInstance := map[int]*arcSet{}
+	highest := 0
+	for i := range header {
+		field := &header[i]
+		name := strings.ToLower(field.Name)
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		instance, err := arcInstance(*field)
+		if err != nil {
+			return nil, highest, fmt.Errorf("%s: %v", field.Name, err)
+		}
+		if instance > highest {
+			highest = instance
+		}
+		set, ok := byInstance[instance]
+		if !ok {
+			set = &arcSet{}
+			byInstance[instance] = set
+		}
+		slot := &set.results
+		if name == "arc-message-signature" {
+			slot = &set.signature
+		} else if name == "arc-seal" {
+			slot = &set.seal
+		}
+		if *slot != nil {
+			return nil, highest, fmt.Errorf("duplicate %s for instance %d", field.Name, instance)
+		}
+		*slot = field
+	}
+	sets := make([]*arcSet, highest)
+	for i := range sets {
+		set := byInstance[i+1]
+		if set == nil || set.results == nil || set.signature == nil || set.seal == nil {
+			return nil, highest, fmt.Errorf("incomplete ARC set %d", i+1)
+		}
+		sets[i] = set
+	}
+	return sets, highest, nil
+}
+
+// arcInstance returns the instance (i=) of an ARC header field. It is
+// the first tag of ARC-Authentication-Results, which is otherwise not
+// a tag list.
+func arcInstance(field message.Field) (int, error) {
+	value := field.Value()
+	if strings.EqualFold(field.Name, "ARC-Authentication-Results") {
+		value, _, _ = strings.Cut(value, ";")
+	}
+	tags, err := parseTags(value)
+	if err != nil {
+		return 0, err
+	}
+	instance, err := strconv.Atoi(tags["i"])
+	if err != nil || instance < 1 || instance > maxInstance {
+		return 0, fmt.Errorf("invalid instance %#v", tags["i"])
+	}
+	return instance, nil
+}
+
+func parseMessageSignature(field message.Field, now time.Time) (*signature, error) {
+	sig, tags, err := newSignature(field, "i", "a", "b", "bh", "d", "h", "s")
+	if err != nil {
+		return sig, err
+	}
+	return sig, sig.parse(tags, now)
+}
+
+// parseSeal parses an ARC-Seal field and returns it with its chain
+// validation status (cv=).
+func parseSeal(field message.Field) (*signature, Result, error) {
+	sig, tags, err := newSignature(field, "i", "a", "b", "cv", "d", "s")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := tags["h"]; ok {
+		return nil, "", errors.New("h= is not allowed")
+	}
+	if err := sig.parseAlgorithm(tags["a"]); err != nil {
+		return nil, "", err
+	}
+	sig.headerRelaxed = true
+	cv := Result(strings.ToLower(tags["cv"]))
+	if cv != None && cv != Pass && cv != Fail {
+		return nil, "", fmt.Errorf("invalid cv=%s", tags["cv"])
+	}
+	return sig, cv, sig.parseData()
+}
+
+// sealHash hashes the ARC sets covered by the seal of the last set
+// (RFC 8617, section 5.1.1).
+func sealHash(sets []*arcSet, hash crypto.Hash) []byte {
+	h := hash.New()
+	for i, set := range sets {
+		io.WriteString(h, canonicalHeader(*set.results, true))
+		io.WriteString(h, canonicalHeader(*set.signature, true))
+		if i < len(sets)-1 {
+			io.WriteString(h, canonicalHeader(*set.seal, true))
+		}
+	}
+	last := sets[len(sets)-1].seal
+	stripped := message.Field{Name: last.Name, Raw: stripSignature(last.Raw)}
+	io.WriteString(h, strings.TrimSuffix(canonicalHeader(stripped, true), "\r\n"))
+	return h.Sum(nil)
+}
+
+// Sealer adds ARC sets to messages.
+type Sealer struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+	now       func() time.Time
+}
+
+// NewSealer returns a sealer that signs with an RSA or Ed25519 key,
+// published at selector._domainkey.domain.
+func NewSealer(domain, selector string, key crypto.Signer) (*Sealer, error) {
+	s := &Sealer{domain: domain, selector: selector, key: key, now: time.Now}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		s.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.algorithm = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+// ParseKey parses a PEM encoded PKCS #8 or PKCS #1 private key.
+func ParseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+}
+
+// Seal returns the header fields of a new ARC set for a message,
+// without line ends, to be prepended in order. The chain is the
+// result of VerifyChain for the message, the results are recorded in
+// the ARC-Authentication-Results field. If the chain can not be
+// extended, no fields are returned.
+func (s *Sealer) Seal(r io.Reader, chain Chain, authservID string, results []string) ([]string, error) {
+	if chain.closed {
+		return nil, nil
+	}
+	br := bufio.NewReader(r)
+	header, err := message.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	bodyHash := sha256.New()
+	c := newBodyCanonicalizer(bodyHash, true)
+	if _, err := io.Copy(c, br); err != nil {
+		return nil, err
+	}
+	c.Close()
+
+	instance := chain.Instance + 1
+	now := s.now().Unix()
+	if len(results) == 0 {
+		results = []string{"none"}
+	}
+	aar := newField("ARC-Authentication-Results", fmt.Sprintf("i=%d; %s;\r\n\t%s",
+		instance, authservID, strings.Join(results, ";\r\n\t")))
+
+	names := []string{}
+	for _, field := range header {
+		for _, name := range arcSignedFields {
+			if strings.EqualFold(field.Name, name) {
+				names = append(names, strings.ToLower(name))
+			}
+		}
+	}
+	ams := newField("ARC-Message-Signature", fmt.Sprintf(
+		"i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s; b=",
+		instance, s.algorithm, s.domain, s.selector, now, strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash.Sum(nil))))
+	sig := &signature{field: ams, hash: crypto.SHA256, headerRelaxed: true, headers: names}
+	if err := s.sign(&ams, headerHash(header, sig)); err != nil {
+		return nil, err
+	}
+
+	seal := newField("ARC-Seal", fmt.Sprintf("i=%d; a=%s; cv=%s; d=%s; s=%s;\r\n\tt=%d; b=",
+		instance, s.algorithm, chain.Result, s.domain, s.selector, now))
+	set := &arcSet{results: &aar, signature: &ams, seal: &seal}
+	// A failed chain can not be signed, so the seal only covers
+	// its own set.
+	sets := []*arcSet{set}
+	if chain.Result != Fail {
+		previous, _, err := arcSets(header)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(previous, set)
+	}
+	if err := s.sign(&seal, sealHash(sets, crypto.SHA256)); err != nil {
+		return nil, err
+	}
+	return []string{
+		strings.TrimSuffix(seal.Raw, "\r\n"),
+		strings.TrimSuffix(ams.Raw, "\r\n"),
+		strings.TrimSuffix(aar.Raw, "\r\n"),
+	}, nil
+}
+
+// sign appends the signature data to a field ending in b=.
+func (s *Sealer) sign(field *message.Field, hashed []byte) error {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	data, err := s.key.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return err
+	}
+	field.Raw = strings.TrimSuffix(field.Raw, "\r\n") + base64.StdEncoding.EncodeToString(data) + "\r\n"
+	return nil
+}
+
+func newField(name, value string) message.Field {
+	return message.Field{Name: name, Raw: name + ": " + value + "\r\n"}
+}
@@ -0,0 +1,132 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func seal(t *testing.T, sealer *Sealer, verifier *Verifier, msg string) (string, Chain) {
+	t.Helper()
+	chain, err := verifier.VerifyChain(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := sealer.Seal(strings.NewReader(msg), chain, "mx.test.tld",
+		[]string{"arc=" + string(chain.Result), "spf=pass smtp.mailfrom=joe@test.tld"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) == 0 {
+		return msg, chain
+	}
+	return strings.Join(fields, "\r\n") + "\r\n" + msg, chain
+}
+
+func TestARC(t *testing.T) {
+	rsaKey, edKey, zone := testKeys(t)
+	verifier := New(zone.lookup)
+	first, err := NewSealer("test.tld", "rsa", rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewSealer("test.tld", "ed", edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, chain := seal(t, first, verifier, testMessage)
+	if chain.Result != None || chain.Instance != 0 {
+		t.Errorf("Expected no chain for a new message, got %#v", chain)
+	}
+	if !strings.HasPrefix(msg, "ARC-Seal: i=1; a=rsa-sha256; cv=none; d=test.tld; s=rsa;") ||
+		!strings.Contains(msg, "\r\nARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed;") ||
+		!strings.Contains(msg, "\r\nARC-Authentication-Results: i=1; mx.test.tld;\r\n\tarc=none;\r\n\tspf=pass") {
+		t.Errorf("Unexpected ARC set:\n%s", msg)
+	}
+
+	// Forwarding adds unsigned fields.
+	msg = "Received: from mx.test.tld\r\n" + msg
+	msg, chain = seal(t, second, verifier, msg)
+	if chain.Result != Pass || chain.Instance != 1 {
+		t.Errorf("Expected the first set to pass, got %#v", chain)
+	}
+	if !strings.HasPrefix(msg, "ARC-Seal: i=2; a=ed25519-sha256; cv=pass;") {
+		t.Errorf("Unexpected ARC set:\n%s", msg)
+	}
+	chain, err = verifier.VerifyChain(strings.NewReader(msg))
+	if err != nil || chain.Result != Pass || chain.Instance != 2 {
+		t.Errorf("Expected the chain to pass, got %#v, %v", chain, err)
+	}
+
+	tampered := []func(string) string{
+		// The body
+		func(msg string) string {
+			return strings.Replace(msg, "lost", "won", 1)
+		},
+		// An older set
+		func(msg string) string {
+			return strings.Replace(msg, "i=1; mx.test.tld;", "i=1; mx.other.tld;", 1)
+		},
+		// A missing set
+		func(msg string) string {
+			return strings.Replace(msg, "ARC-Message-Signature: i=1;", "X-Removed: i=1;", 1)
+		},
+	}
+	for _, tamper := range tampered {
+		chain, err = verifier.VerifyChain(strings.NewReader(tamper(msg)))
+		if err != nil || chain.Result != Fail {
+			t.Errorf("Expected the chain to fail, got %#v, %v", chain, err)
+		}
+	}
+
+	// A failed chain is sealed once with cv=fail, and then not
+	// extended anymore.
+	msg, chain = seal(t, first, verifier, tampered[0](msg))
+	if chain.Result != Fail || !strings.HasPrefix(msg, "ARC-Seal: i=3; a=rsa-sha256; cv=fail;") {
+		t.Errorf("Expected a failed seal, got %#v:\n%s", chain, msg)
+	}
+	sealed, chain := seal(t, first, verifier, msg)
+	if chain.Result != Fail || sealed != msg {
+		t.Errorf("Expected the failed chain to stay closed, got %#v:\n%s", chain, sealed)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		block *pem.Block
+		key   crypto.Signer
+	}{
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, edKey},
+		{&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, rsaKey},
+	}
+	for _, test := range tests {
+		key, err := ParseKey(pem.EncodeToMemory(test.block))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+			t.Errorf("Expected the %s to be parsed", test.block.Type)
+		}
+	}
+	if _, err := ParseKey([]byte("no key")); err == nil {
+		t.Error("Expected an error for invalid data")
+	}
+}
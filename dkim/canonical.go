@@ -0,0 +1,159 @@
+package dkim
+
+import (
+	"io"
+	"strings"
+
+	"github.com/jorgenschaefer/smtpproxy/message"
+)
+
+// RFC 6376, section 3.4
+
+// canonicalHeader returns a header field in simple or relaxed
+// canonical form.
+func canonicalHeader(field message.Field, relaxed bool) string {
+	if !relaxed {
+		return field.Raw
+	}
+	name, value := field.Name, field.Raw
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		value = value[i+1:]
+	}
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" +
+		strings.Join(strings.FieldsFunc(value, isWSP), " ") + "\r\n"
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// bodyCanonicalizer writes a message body in canonical form to w. It
+// accepts CRLF as well as bare LF line ends. Trailing empty lines are
+// only written once more lines follow.
+type bodyCanonicalizer struct {
+	w       io.Writer
+	relaxed bool
+	// The canonical form of the current Write, which is passed on
+	// to w at once.
+	buf []byte
+	// Bytes written so far.
+	written int64
+	// Whether nothing of the current line was written yet.
+	lineStart bool
+	// The last byte was a CR that might start a line end.
+	cr bool
+	// Relaxed: whitespace that is only written if more follows.
+	wsp bool
+	// Empty lines that are only written if more lines follow.
+	emptyLines int
+	err        error
+}
+
+func newBodyCanonicalizer(w io.Writer, relaxed bool) *bodyCanonicalizer {
+	return &bodyCanonicalizer{w: w, relaxed: relaxed, lineStart: true}
+}
+
+func (c *bodyCanonicalizer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if c.cr {
+			c.cr = false
+			if b == '\n' {
+				c.endLine()
+				continue
+			}
+			c.content('\r')
+		}
+		switch {
+		case b == '\r':
+			c.cr = true
+		case b == '\n':
+			c.endLine()
+		case c.relaxed && (b == ' ' || b == '\t'):
+			c.wsp = true
+		default:
+			c.content(b)
+		}
+	}
+	c.flush()
+	return len(p), c.err
+}
+
+func (c *bodyCanonicalizer) content(b byte) {
+	if c.lineStart {
+		for ; c.emptyLines > 0; c.emptyLines-- {
+			c.write("\r\n")
+		}
+		c.lineStart = false
+	}
+	if c.wsp {
+		c.write(" ")
+		c.wsp = false
+	}
+	c.buf = append(c.buf, b)
+}
+
+func (c *bodyCanonicalizer) endLine() {
+	// Relaxed canonicalization drops whitespace at the end of
+	// lines.
+	c.wsp = false
+	if c.lineStart {
+		c.emptyLines++
+	} else {
+		c.write("\r\n")
+		c.lineStart = true
+	}
+}
+
+func (c *bodyCanonicalizer) write(s string) {
+	c.buf = append(c.buf, s...)
+}
+
+func (c *bodyCanonicalizer) flush() {
+	if c.err == nil && len(c.buf) > 0 {
+		n, err := c.w.Write(c.buf)
+		c.written += int64(n)
+		c.err = err
+	}
+	c.buf = c.buf[:0]
+}
+
+// Close finishes the last line. An empty body is a single CRLF in
+// simple canonicalization.
+func (c *bodyCanonicalizer) Close() error {
+	if c.cr {
+		c.cr = false
+		c.content('\r')
+	}
+	if !c.lineStart {
+		c.endLine()
+	}
+	if !c.relaxed && c.written == 0 && len(c.buf) == 0 {
+		c.write("\r\n")
+	}
+	c.flush()
+	return c.err
+}
+
+// limitWriter writes only the first n bytes to w, and counts all.
+type limitWriter struct {
+	w     io.Writer
+	n     int64
+	total int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	l.total += int64(len(p))
+	if l.n <= 0 {
+		return len(p), nil
+	}
+	q := p
+	if int64(len(q)) > l.n {
+		q = q[:l.n]
+	}
+	l.n -= int64(len(q))
+	if _, err := l.w.Write(q); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,472 @@
+// Package dkim verifies DomainKeys Identified Mail signatures, as
+// described in RFC 6376, and adds Authenticated Received Chain sets
+// (RFC 8617) to messages.
+
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/message"
+)
+
+// LookupFunction returns the TXT records for a name. Names not found
+// should be reported as a *net.DNSError with IsNotFound set, every
+// other error is a temporary error.
+type LookupFunction func(name string) ([]string, error)
+
+// Result is the result of verifying a signature, as used in the
+// Authentication-Results header (RFC 8601).
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// maxSignatures limits the work done for a single message.
+const maxSignatures = 10
+
+// RFC 8301 requires at least 1024 bits.
+const minRSABits = 1024
+
+// Verification is the result of verifying one signature.
+type Verification struct {
+	// The signing domain (d=) and selector (s=).
+	Domain   string
+	Selector string
+	// The agent or user identifier (i=).
+	Identifier string
+	// The signature (b=) in base64.
+	Signature string
+	Result    Result
+	// Reason explains a result other than pass.
+	Reason string
+}
+
+type Verifier struct {
+	lookup LookupFunction
+	now    func() time.Time
+}
+
+func New(lookup LookupFunction) *Verifier {
+	return &Verifier{lookup: lookup, now: time.Now}
+}
+
+// Verify reads a message and verifies all its DKIM signatures. The
+// message is read in one pass, only the header is kept in memory. It
+// returns an error only if the message can not be read.
+func (v *Verifier) Verify(r io.Reader) ([]Verification, error) {
+	br := bufio.NewReader(r)
+	header, err := message.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	fields := header.Get("DKIM-Signature")
+	if len(fields) > maxSignatures {
+		fields = fields[:maxSignatures]
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	verifications := make([]Verification, len(fields))
+	signatures := make([]*signature, len(fields))
+	bodies := make([]*body, len(fields))
+	writers := []io.Writer{}
+	for i, field := range fields {
+		sig, err := parseSignature(field, v.now())
+		verifications[i] = sig.verification()
+		if err != nil {
+			verifications[i].Result = PermError
+			verifications[i].Reason = err.Error()
+			continue
+		}
+		signatures[i] = sig
+		bodies[i] = newBody(sig)
+		writers = append(writers, bodies[i].canonical)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), br); err != nil {
+		return nil, err
+	}
+
+	for i, sig := range signatures {
+		if sig == nil {
+			continue
+		}
+		if err := v.verify(header, sig, bodies[i]); err != nil {
+			f := err.(*failure)
+			verifications[i].Result = f.result
+			verifications[i].Reason = f.reason
+		} else {
+			verifications[i].Result = Pass
+		}
+	}
+	return verifications, nil
+}
+
+func (v *Verifier) verify(header message.Header, sig *signature, b *body) error {
+	sum, err := b.sum()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, sig.bodyHash) {
+		return &failure{Fail, "body hash did not verify"}
+	}
+	key, err := v.key(sig)
+	if err != nil {
+		return err
+	}
+	return verifyHash(key, sig, headerHash(header, sig))
+}
+
+func verifyHash(key crypto.PublicKey, sig *signature, hashed []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, sig.hash, hashed, sig.data) != nil {
+			return &failure{Fail, "signature did not verify"}
+		}
+	case ed25519.PublicKey:
+		// RFC 8463 signs the hash, not the data itself.
+		if !ed25519.Verify(key, hashed, sig.data) {
+			return &failure{Fail, "signature did not verify"}
+		}
+	}
+	return nil
+}
+
+// failure ends the verification of a signature with a result.
+type failure struct {
+	result Result
+	reason string
+}
+
+func (f *failure) Error() string {
+	return f.reason
+}
+
+func permError(format string, args ...interface{}) error {
+	return &failure{PermError, fmt.Sprintf(format, args...)}
+}
+
+type signature struct {
+	field         message.Field
+	keyType       string
+	hash          crypto.Hash
+	headerRelaxed bool
+	bodyRelaxed   bool
+	domain        string
+	selector      string
+	identifier    string
+	headers       []string
+	// Body length to hash, -1 for all.
+	length   int64
+	bodyHash []byte
+	data     []byte
+	b64      string
+}
+
+// parseSignature parses a DKIM-Signature field. On errors, the
+// signature is returned with what was parsed so far.
+func parseSignature(field message.Field, now time.Time) (*signature, error) {
+	sig, tags, err := newSignature(field, "v", "a", "b", "bh", "d", "h", "s")
+	if err != nil {
+		return sig, err
+	}
+	if tags["v"] != "1" {
+		return sig, fmt.Errorf("unsupported version %s", tags["v"])
+	}
+	if i, ok := tags["i"]; ok {
+		sig.identifier = i
+		at := strings.LastIndexByte(i, '@')
+		domain := strings.ToLower(i[at+1:])
+		if at < 0 || domain != sig.domain && !strings.HasSuffix(domain, "."+sig.domain) {
+			return sig, fmt.Errorf("identity %s is not in domain %s", i, sig.domain)
+		}
+	}
+	return sig, sig.parse(tags, now)
+}
+
+// newSignature parses the tags of a signature field and checks that
+// the required ones are present.
+func newSignature(field message.Field, required ...string) (*signature, map[string]string, error) {
+	sig := &signature{field: field, length: -1}
+	tags, err := parseTags(field.Value())
+	if err != nil {
+		return sig, nil, err
+	}
+	sig.domain = strings.ToLower(tags["d"])
+	sig.selector = tags["s"]
+	sig.identifier = "@" + sig.domain
+	sig.b64 = removeWhitespace(tags["b"])
+	for _, name := range required {
+		if _, ok := tags[name]; !ok {
+			return sig, nil, fmt.Errorf("missing tag %s", name)
+		}
+	}
+	return sig, tags, nil
+}
+
+// parse parses the tags that DKIM-Signature and ARC-Message-Signature
+// fields have in common.
+func (sig *signature) parse(tags map[string]string, now time.Time) error {
+	if err := sig.parseAlgorithm(tags["a"]); err != nil {
+		return err
+	}
+
+	var err error
+	if c, ok := tags["c"]; ok {
+		headerCanon, bodyCanon, _ := strings.Cut(strings.ToLower(c), "/")
+		if sig.headerRelaxed, err = parseCanonicalization(headerCanon); err != nil {
+			return err
+		}
+		if bodyCanon != "" {
+			if sig.bodyRelaxed, err = parseCanonicalization(bodyCanon); err != nil {
+				return err
+			}
+		}
+	}
+
+	if q, ok := tags["q"]; ok {
+		found := false
+		for _, method := range strings.Split(q, ":") {
+			if strings.ToLower(strings.TrimSpace(method)) == "dns/txt" {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unsupported query method %s", q)
+		}
+	}
+
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		sig.headers = append(sig.headers, name)
+		if strings.EqualFold(name, "From") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return errors.New("From is not signed")
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.length, err = strconv.ParseInt(l, 10, 64); err != nil || sig.length < 0 {
+			return fmt.Errorf("invalid body length %s", l)
+		}
+	}
+
+	var signed, expires int64 = 0, math.MaxInt64
+	if t, ok := tags["t"]; ok {
+		if signed, err = strconv.ParseInt(t, 10, 64); err != nil {
+			return fmt.Errorf("invalid timestamp %s", t)
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		if expires, err = strconv.ParseInt(x, 10, 64); err != nil || expires < signed {
+			return fmt.Errorf("invalid expiration %s", x)
+		}
+		if expires < now.Unix() {
+			return errors.New("signature expired")
+		}
+	}
+
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(removeWhitespace(tags["bh"])); err != nil {
+		return errors.New("invalid body hash")
+	}
+	return sig.parseData()
+}
+
+func (sig *signature) parseData() error {
+	var err error
+	if sig.data, err = base64.StdEncoding.DecodeString(sig.b64); err != nil {
+		return errors.New("invalid signature data")
+	}
+	return nil
+}
+
+func (sig *signature) parseAlgorithm(algorithm string) error {
+	switch strings.ToLower(algorithm) {
+	case "rsa-sha256":
+		sig.keyType, sig.hash = "rsa", crypto.SHA256
+	case "ed25519-sha256":
+		sig.keyType, sig.hash = "ed25519", crypto.SHA256
+	case "rsa-sha1":
+		// RFC 8301
+		return errors.New("rsa-sha1 is not accepted")
+	default:
+		return fmt.Errorf("unknown algorithm %s", algorithm)
+	}
+	return nil
+}
+
+func parseCanonicalization(name string) (bool, error) {
+	switch name {
+	case "simple":
+		return false, nil
+	case "relaxed":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown canonicalization %s", name)
+}
+
+func (sig *signature) verification() Verification {
+	return Verification{
+		Domain:     sig.domain,
+		Selector:   sig.selector,
+		Identifier: sig.identifier,
+		Signature:  sig.b64,
+	}
+}
+
+// body computes the body hash of a signature.
+type body struct {
+	sig       *signature
+	hasher    io.Writer
+	sumFunc   func([]byte) []byte
+	limit     *limitWriter
+	canonical *bodyCanonicalizer
+}
+
+func newBody(sig *signature) *body {
+	h := sig.hash.New()
+	length := sig.length
+	if length < 0 {
+		length = math.MaxInt64
+	}
+	limit := &limitWriter{w: h, n: length}
+	return &body{
+		sig:       sig,
+		hasher:    h,
+		sumFunc:   h.Sum,
+		limit:     limit,
+		canonical: newBodyCanonicalizer(limit, sig.bodyRelaxed),
+	}
+}
+
+func (b *body) sum() ([]byte, error) {
+	b.canonical.Close()
+	if b.sig.length > b.limit.total {
+		return nil, &failure{Fail, "body is shorter than the signed length"}
+	}
+	return b.sumFunc(nil), nil
+}
+
+// headerHash hashes the signed header fields and the signature
+// field itself without the signature data (RFC 6376, section 3.7).
+func headerHash(header message.Header, sig *signature) []byte {
+	h := sig.hash.New()
+	used := map[int]bool{}
+	for _, name := range sig.headers {
+		// Fields with the same name are signed from the bottom
+		// up. Missing fields are signed as empty.
+		for i := len(header) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(header[i].Name, name) {
+				used[i] = true
+				io.WriteString(h, canonicalHeader(header[i], sig.headerRelaxed))
+				break
+			}
+		}
+	}
+	stripped := message.Field{Name: sig.field.Name, Raw: stripSignature(sig.field.Raw)}
+	io.WriteString(h, strings.TrimSuffix(canonicalHeader(stripped, sig.headerRelaxed), "\r\n"))
+	return h.Sum(nil)
+}
+
+// key looks up the public key for a signature (RFC 6376, section
+// 3.6.2).
+func (v *Verifier) key(sig *signature) (crypto.PublicKey, error) {
+	name := sig.selector + "._domainkey." + sig.domain
+	txts, err := v.lookup(name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, permError("no key for %s", name)
+	} else if err != nil {
+		return nil, &failure{TempError, fmt.Sprintf("%s: %v", name, err)}
+	}
+	if len(txts) == 0 {
+		return nil, permError("no key for %s", name)
+	}
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, permError("%s: %v", name, err)
+	}
+	if version, ok := tags["v"]; ok && version != "DKIM1" {
+		return nil, permError("%s: unsupported version %s", name, version)
+	}
+	if hashes, ok := tags["h"]; ok && !containsTag(hashes, "sha256") {
+		return nil, permError("%s: key does not allow sha256", name)
+	}
+	if services, ok := tags["s"]; ok && !containsTag(services, "*") && !containsTag(services, "email") {
+		return nil, permError("%s: key is not for email", name)
+	}
+	if flags, ok := tags["t"]; ok && containsTag(flags, "s") {
+		domain := sig.identifier[strings.LastIndexByte(sig.identifier, '@')+1:]
+		if !strings.EqualFold(domain, sig.domain) {
+			return nil, permError("%s: key does not allow subdomain identities", name)
+		}
+	}
+	keyType := "rsa"
+	if k, ok := tags["k"]; ok {
+		keyType = strings.ToLower(k)
+	}
+	if keyType != sig.keyType {
+		return nil, permError("%s: %s key for %s signature", name, keyType, sig.keyType)
+	}
+	data := removeWhitespace(tags["p"])
+	if data == "" {
+		return nil, permError("%s: key revoked", name)
+	}
+	der, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, permError("%s: invalid key data", name)
+	}
+	if keyType == "ed25519" {
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permError("%s: invalid ed25519 key", name)
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	var key *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(der); err == nil {
+		key, _ = parsed.(*rsa.PublicKey)
+	} else {
+		key, _ = x509.ParsePKCS1PublicKey(der)
+	}
+	if key == nil {
+		return nil, permError("%s: invalid rsa key", name)
+	}
+	if key.N.BitLen() < minRSABits {
+		return nil, permError("%s: rsa key is shorter than %d bits", name, minRSABits)
+	}
+	return key, nil
+}
+
+// containsTag returns true if a colon-separated list contains value.
+func containsTag(list, value string) bool {
+	for _, item := range strings.Split(list, ":") {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return true
+		}
+	}
+	return false
+}
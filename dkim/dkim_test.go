@@ -0,0 +1,246 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/message"
+)
+
+const testMessage = "From: Joe <joe@test.tld>\r\n" +
+	"To: jane@example.tld\r\n" +
+	"Subject:  Is dinner\r\n\tready?\r\n" +
+	"\r\n" +
+	"Hi.  \r\n" +
+	"\r\n" +
+	"We lost the game.\r\n" +
+	"\r\n" +
+	"\r\n"
+
+// sign adds a DKIM-Signature field for tags to the message.
+func sign(t *testing.T, key crypto.Signer, msg, tags string) string {
+	t.Helper()
+	sig := "DKIM-Signature: " + tags + "; bh=; b="
+	parsed, _ := parseTags(sig[len("DKIM-Signature:"):])
+	relaxed := strings.HasPrefix(parsed["c"], "relaxed")
+	bodyRelaxed := strings.HasSuffix(parsed["c"], "/relaxed")
+
+	br := bufio.NewReader(strings.NewReader(msg))
+	header, err := message.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh := sha256.New()
+	length := int64(math.MaxInt64)
+	if l, ok := parsed["l"]; ok {
+		length, _ = strconv.ParseInt(l, 10, 64)
+	}
+	c := newBodyCanonicalizer(&limitWriter{w: bh, n: length}, bodyRelaxed)
+	br.WriteTo(c)
+	c.Close()
+	sig = strings.Replace(sig, "bh=;", "bh="+base64.StdEncoding.EncodeToString(bh.Sum(nil))+";", 1)
+
+	s := &signature{
+		field:         message.Field{Name: "DKIM-Signature", Raw: sig + "\r\n"},
+		hash:          crypto.SHA256,
+		headerRelaxed: relaxed,
+		headers:       strings.Split(parsed["h"], ":"),
+	}
+	hashed := headerHash(header, s)
+	var data []byte
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		data, err = key.Sign(rand.Reader, hashed, crypto.Hash(0))
+	} else {
+		data, err = key.Sign(rand.Reader, hashed, crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig + base64.StdEncoding.EncodeToString(data) + "\r\n" + msg
+}
+
+type keys map[string]string
+
+func (k keys) lookup(name string) ([]string, error) {
+	if record, ok := k[name]; ok {
+		if record == "timeout" {
+			return nil, errors.New("timeout")
+		}
+		return []string{record}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func testKeys(t *testing.T) (*rsa.PrivateKey, ed25519.PrivateKey, keys) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallKey, _ := rsa.GenerateKey(rand.Reader, 512)
+	smallDER, _ := x509.MarshalPKIXPublicKey(&smallKey.PublicKey)
+	return rsaKey, edKey, keys{
+		"rsa._domainkey.test.tld":     "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der),
+		"pkcs1._domainkey.test.tld":   "p=" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)),
+		"ed._domainkey.test.tld":      "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub),
+		"strict._domainkey.test.tld":  "v=DKIM1; t=s; p=" + base64.StdEncoding.EncodeToString(der),
+		"revoked._domainkey.test.tld": "v=DKIM1; p=",
+		"small._domainkey.test.tld":   "p=" + base64.StdEncoding.EncodeToString(smallDER),
+		"sha1._domainkey.test.tld":    "h=sha1; p=" + base64.StdEncoding.EncodeToString(der),
+		"slow._domainkey.test.tld":    "timeout",
+	}
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, edKey, zone := testKeys(t)
+	expired := fmt.Sprintf("x=%d", time.Now().Add(-time.Hour).Unix())
+	tests := []struct {
+		key    crypto.Signer
+		tags   string
+		modify func(string) string
+		result Result
+	}{
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From:To:Subject", nil, Pass},
+		{rsaKey, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=test.tld; s=rsa; h=from:subject", nil, Pass},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=pkcs1; h=From", nil, Pass},
+		{edKey, "v=1; a=ed25519-sha256; c=relaxed/simple; d=test.tld; s=ed; h=From:To", nil, Pass},
+		// Unsigned additions after the l= length are allowed.
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From; l=10", func(msg string) string {
+			return msg + "Buy now!\r\n"
+		}, Pass},
+		// Relaxed canonicalization allows whitespace changes.
+		{rsaKey, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=test.tld; s=rsa; h=From:Subject", func(msg string) string {
+			return strings.Replace(strings.Replace(msg, "Is dinner", "Is   dinner", 1), "Hi.", "Hi. ", 1)
+		}, Pass},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From:Subject", func(msg string) string {
+			return strings.Replace(msg, "Is dinner", "Is   dinner", 1)
+		}, Fail},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From", func(msg string) string {
+			return strings.Replace(msg, "lost", "won", 1)
+		}, Fail},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From; l=1000", nil, Fail},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=ed; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=missing; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=revoked; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=small; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=sha1; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=slow; h=From", nil, TempError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=strict; i=joe@sub.test.tld; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=strict; i=joe@test.tld; h=From", nil, Pass},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; i=joe@other.tld; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=To", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha1; d=test.tld; s=rsa; h=From", nil, PermError},
+		{rsaKey, "v=2; a=rsa-sha256; d=test.tld; s=rsa; h=From", nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From; " + expired, nil, PermError},
+		{rsaKey, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From; q=http", nil, PermError},
+	}
+	verifier := New(zone.lookup)
+	for _, test := range tests {
+		msg := sign(t, test.key, testMessage, test.tags)
+		if test.modify != nil {
+			msg = test.modify(msg)
+		}
+		verifications, err := verifier.Verify(strings.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verifications) != 1 {
+			t.Fatalf("Expected one verification for %s, got %#v", test.tags, verifications)
+		}
+		v := verifications[0]
+		if v.Result != test.result {
+			t.Errorf("Expected %s for %s, got %s (%s)", test.result, test.tags, v.Result, v.Reason)
+		}
+		if v.Domain != "test.tld" {
+			t.Errorf("Expected domain test.tld for %s, got %#v", test.tags, v.Domain)
+		}
+	}
+}
+
+func TestVerifySeveral(t *testing.T) {
+	rsaKey, edKey, zone := testKeys(t)
+	// A bare LF message, as read from the SMTP connection.
+	msg := strings.ReplaceAll(testMessage, "\r\n", "\n")
+	msg = sign(t, rsaKey, msg, "v=1; a=rsa-sha256; d=test.tld; s=rsa; h=From")
+	msg = sign(t, edKey, msg, "v=1; a=ed25519-sha256; d=test.tld; s=rsa; h=From")
+	verifications, err := New(zone.lookup).Verify(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 2 {
+		t.Fatalf("Expected two verifications, got %#v", verifications)
+	}
+	if verifications[0].Result != PermError || verifications[1].Result != Pass {
+		t.Errorf("Expected permerror and pass, got %#v", verifications)
+	}
+	if verifications[1].Identifier != "@test.tld" || verifications[1].Selector != "rsa" {
+		t.Errorf("Unexpected verification %#v", verifications[1])
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	verifications, err := New(keys{}.lookup).Verify(strings.NewReader(testMessage))
+	if err != nil || len(verifications) != 0 {
+		t.Errorf("Expected no verifications, got %#v, %v", verifications, err)
+	}
+}
+
+func TestBodyCanonicalization(t *testing.T) {
+	tests := []struct {
+		body    string
+		relaxed bool
+		result  string
+	}{
+		{"", false, "\r\n"},
+		{"", true, ""},
+		{"\r\n\r\n", false, "\r\n"},
+		{"\r\n\r\n", true, ""},
+		{"a \t b  \r\n\r\n\r\n", false, "a \t b  \r\n"},
+		{"a \t b  \r\n\r\n\r\n", true, "a b\r\n"},
+		{"a\n\nb", false, "a\r\n\r\nb\r\n"},
+		{"a\rb\r", false, "a\rb\r\r\n"},
+		{"Grüße\n", true, "Grüße\r\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		c := newBodyCanonicalizer(&buf, test.relaxed)
+		c.Write([]byte(test.body))
+		c.Close()
+		if buf.String() != test.result {
+			t.Errorf("Expected %#v for %#v (relaxed %v), got %#v", test.result, test.body, test.relaxed, buf.String())
+		}
+	}
+}
+
+func TestCanonicalHeader(t *testing.T) {
+	field := message.Field{Name: "Subject ", Raw: "Subject :  A  long\r\n\tsubject \r\n"}
+	if c := canonicalHeader(field, true); c != "subject:A long subject\r\n" {
+		t.Errorf("Unexpected relaxed header %#v", c)
+	}
+	if c := canonicalHeader(field, false); c != field.Raw {
+		t.Errorf("Unexpected simple header %#v", c)
+	}
+}
@@ -0,0 +1,55 @@
+package dkim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseTags parses a tag list (RFC 6376, section 3.2), as used in
+// signatures and key records.
+func parseTags(text string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(text, ";") {
+		if strings.TrimSpace(spec) == "" {
+			// A trailing semicolon is allowed.
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %#v", strings.TrimSpace(spec))
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty tag name in %#v", strings.TrimSpace(spec))
+		}
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %s", name)
+		}
+		tags[name] = strings.TrimSpace(strings.ReplaceAll(value, "\r\n", ""))
+	}
+	return tags, nil
+}
+
+// removeWhitespace removes folding whitespace from base64 values.
+func removeWhitespace(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// stripSignature removes the value of the b= tag from a raw
+// DKIM-Signature field, keeping everything else as it is.
+func stripSignature(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	specs := strings.Split(raw[colon+1:], ";")
+	for i, spec := range specs {
+		name, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(name) == "b" {
+			specs[i] = spec[:len(name)+1]
+		}
+	}
+	return raw[:colon+1] + strings.Join(specs, ";")
+}
@@ -0,0 +1,295 @@
+// Package dmarc evaluates the DMARC policy of the author domain of a
+// message, as described in RFC 7489.
+
+package dmarc
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/jorgenschaefer/smtpproxy/message"
+)
+
+// LookupFunction returns the TXT records for a name. Names not found
+// should be reported as a *net.DNSError with IsNotFound set.
+type LookupFunction func(name string) ([]string, error)
+
+// Result is the result of the evaluation, as used in the
+// Authentication-Results header (RFC 8601).
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Policy is what the domain owner asks receivers to do with mail
+// that fails.
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+var Policies = []Policy{PolicyNone, PolicyQuarantine, PolicyReject}
+
+// Evaluation is the result of checking a message.
+type Evaluation struct {
+	// The domain of the From header field.
+	Domain string
+	Result Result
+	// The policy published for the domain.
+	Published Policy
+	// The policy to apply, which can be less strict than the
+	// published one because of the pct= tag. It is PolicyNone
+	// unless the result is Fail.
+	Policy Policy
+	// Reason explains a result other than pass.
+	Reason string
+}
+
+type Checker struct {
+	lookup LookupFunction
+	// Without a public suffix list, relaxed alignment requires
+	// the exact domain.
+	suffixes *SuffixList
+	// random returns a number in [0, 100) to sample pct=.
+	random func() int
+}
+
+func New(lookup LookupFunction) *Checker {
+	return &Checker{
+		lookup: lookup,
+		random: func() int { return rand.Intn(100) },
+	}
+}
+
+// WithSuffixList returns a copy of the checker that uses the public
+// suffix list l for relaxed alignment.
+func (c *Checker) WithSuffixList(l *SuffixList) *Checker {
+	checker := *c
+	checker.suffixes = l
+	return &checker
+}
+
+type record struct {
+	policy          Policy
+	subdomainPolicy Policy
+	strictDKIM      bool
+	strictSPF       bool
+	percent         int
+}
+
+// Check evaluates the policy for a message with the given header.
+// spfDomain is the domain SPF checked, which passed if spfPass is
+// set, dkimDomains are the domains of all valid DKIM signatures.
+func (c *Checker) Check(header message.Header, spfDomain string, spfPass bool, dkimDomains []string) Evaluation {
+	from, err := fromDomain(header)
+	if err != nil {
+		return Evaluation{Result: PermError, Policy: PolicyNone, Reason: err.Error()}
+	}
+	e := Evaluation{Domain: from, Result: None, Policy: PolicyNone}
+	rec, err := c.record(from)
+	subdomain := false
+	if org := c.policyDomain(from); err == nil && rec == nil && org != from {
+		rec, err = c.record(org)
+		subdomain = true
+	}
+	if err != nil {
+		e.Result = TempError
+		e.Reason = err.Error()
+		return e
+	}
+	if rec == nil {
+		e.Reason = "no DMARC record"
+		return e
+	}
+	e.Published = rec.policy
+	if subdomain {
+		e.Published = rec.subdomainPolicy
+	}
+
+	if spfPass && c.aligned(spfDomain, from, rec.strictSPF) {
+		e.Result = Pass
+		return e
+	}
+	for _, domain := range dkimDomains {
+		if c.aligned(domain, from, rec.strictDKIM) {
+			e.Result = Pass
+			return e
+		}
+	}
+	e.Result = Fail
+	e.Reason = "no aligned SPF or DKIM result"
+	e.Policy = e.Published
+	// Mail not sampled by pct= gets the next less strict policy
+	// (RFC 7489, section 6.6.4).
+	if rec.percent < 100 && c.random() >= rec.percent {
+		switch e.Policy {
+		case PolicyReject:
+			e.Policy = PolicyQuarantine
+		case PolicyQuarantine:
+			e.Policy = PolicyNone
+		}
+	}
+	return e
+}
+
+// fromDomain returns the domain of the single author of a message.
+func fromDomain(header message.Header) (string, error) {
+	fields := header.Get("From")
+	if len(fields) != 1 {
+		return "", fmt.Errorf("expected one From field, got %d", len(fields))
+	}
+	addresses, err := mail.ParseAddressList(fields[0].Value())
+	if err != nil {
+		return "", fmt.Errorf("invalid From field: %v", err)
+	}
+	if len(addresses) != 1 {
+		return "", errors.New("more than one author")
+	}
+	at := strings.LastIndexByte(addresses[0].Address, '@')
+	if at < 0 {
+		return "", errors.New("From address without domain")
+	}
+	return strings.ToLower(strings.TrimSuffix(addresses[0].Address[at+1:], ".")), nil
+}
+
+// record returns the DMARC record of domain, or nil if it has none.
+func (c *Checker) record(domain string) (*record, error) {
+	txts, err := c.lookup("_dmarc." + domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var found *record
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=DMARC1") {
+			continue
+		}
+		if found != nil {
+			// More than one record means none.
+			return nil, nil
+		}
+		// Invalid records are ignored.
+		found, _ = parseRecord(txt)
+	}
+	return found, nil
+}
+
+func parseRecord(txt string) (*record, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(txt, ";") {
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			if strings.TrimSpace(spec) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("invalid tag %#v", spec)
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if tags["v"] != "DMARC1" {
+		return nil, errors.New("not a DMARC record")
+	}
+	rec := &record{percent: 100}
+	var ok bool
+	if rec.policy, ok = parsePolicy(tags["p"]); !ok {
+		return nil, fmt.Errorf("invalid policy %#v", tags["p"])
+	}
+	rec.subdomainPolicy = rec.policy
+	if sp, present := tags["sp"]; present {
+		if rec.subdomainPolicy, ok = parsePolicy(sp); !ok {
+			return nil, fmt.Errorf("invalid subdomain policy %#v", sp)
+		}
+	}
+	rec.strictDKIM = strings.ToLower(tags["adkim"]) == "s"
+	rec.strictSPF = strings.ToLower(tags["aspf"]) == "s"
+	if pct, present := tags["pct"]; present {
+		percent, err := strconv.Atoi(pct)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percentage %#v", pct)
+		}
+		rec.percent = percent
+	}
+	return rec, nil
+}
+
+func parsePolicy(value string) (Policy, bool) {
+	for _, p := range Policies {
+		if strings.EqualFold(value, string(p)) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// aligned returns true if an authenticated domain matches the author
+// domain, either exactly or, in relaxed mode, by organizational
+// domain (RFC 7489, section 3.1). Without a public suffix list, the
+// organizational domain is unknown, as a guess would align hosts
+// below shared suffixes like github.io.
+func (c *Checker) aligned(domain, from string, strict bool) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if domain == from {
+		return true
+	}
+	if strict || c.suffixes == nil {
+		return false
+	}
+	org, ok := c.suffixes.OrganizationalDomain(domain)
+	if !ok {
+		return false
+	}
+	fromOrg, ok := c.suffixes.OrganizationalDomain(from)
+	return ok && org == fromOrg
+}
+
+// policyDomain returns the organizational domain, whose record
+// applies if the author domain has none. Without a public suffix
+// list, it is guessed, which at worst applies the policy of a
+// public suffix.
+func (c *Checker) policyDomain(domain string) string {
+	if c.suffixes != nil {
+		org, _ := c.suffixes.OrganizationalDomain(domain)
+		return org
+	}
+	return guessOrganizationalDomain(domain)
+}
+
+// Second-level labels that registries commonly use below country
+// code top-level domains, as in "co.uk".
+var registryLabels = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "gov": true,
+	"ne": true, "net": true, "or": true, "org": true,
+}
+
+// guessOrganizationalDomain approximates the public suffix list: the
+// organizational domain is the last two labels, or three below a
+// registry label like in "example.co.uk".
+func guessOrganizationalDomain(domain string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && registryLabels[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
@@ -0,0 +1,152 @@
+package dmarc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jorgenschaefer/smtpproxy/message"
+)
+
+type zone map[string][]string
+
+func (z zone) lookup(name string) ([]string, error) {
+	if records, ok := z[name]; ok {
+		if len(records) == 1 && records[0] == "timeout" {
+			return nil, errors.New("timeout")
+		}
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func from(value string) message.Header {
+	return message.Header{{Name: "From", Raw: "From: " + value + "\r\n"}}
+}
+
+// A part of the public suffix list.
+var testSuffixes, _ = ParseSuffixList(strings.NewReader(`// Comment
+tld
+co.uk
+uk
+github.io
+io
+*.ck
+!www.ck
+рф
+`))
+
+func TestCheck(t *testing.T) {
+	z := zone{
+		"_dmarc.test.tld":         {"v=DMARC1; p=reject; sp=quarantine; aspf=s"},
+		"_dmarc.sub.test.tld":     {"v=DMARC1; p=none"},
+		"_dmarc.pct.tld":          {"v=DMARC1; p=reject; pct=50"},
+		"_dmarc.twice.tld":        {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.invalid.tld":      {"v=DMARC1; p=bogus"},
+		"_dmarc.other.tld":        {"some other record"},
+		"_dmarc.slow.tld":         {"timeout"},
+		"_dmarc.test.co.uk":       {"v=DMARC1; p=reject; adkim=s"},
+		"_dmarc.victim.github.io": {"v=DMARC1; p=reject"},
+	}
+	tests := []struct {
+		from      string
+		spfDomain string
+		spfPass   bool
+		dkim      []string
+		result    Result
+		policy    Policy
+	}{
+		{"Joe <joe@test.tld>", "test.tld", true, nil, Pass, PolicyNone},
+		{"joe@test.tld", "test.tld", false, nil, Fail, PolicyReject},
+		// SPF alignment is strict for test.tld, DKIM is relaxed.
+		{"joe@test.tld", "mail.test.tld", true, nil, Fail, PolicyReject},
+		{"joe@test.tld", "", false, []string{"other.tld", "mail.test.tld"}, Pass, PolicyNone},
+		{"joe@test.tld", "", false, []string{"other.tld"}, Fail, PolicyReject},
+		// Subdomains use sp= of the organizational domain,
+		// unless they have their own record.
+		{"joe@mail.test.tld", "", false, nil, Fail, PolicyQuarantine},
+		{"joe@sub.test.tld", "", false, nil, Fail, PolicyNone},
+		{"joe@pct.tld", "", false, nil, Fail, PolicyQuarantine},
+		{"joe@twice.tld", "", false, nil, None, PolicyNone},
+		{"joe@invalid.tld", "", false, nil, None, PolicyNone},
+		{"joe@other.tld", "", false, nil, None, PolicyNone},
+		{"joe@slow.tld", "", false, nil, TempError, PolicyNone},
+		{"joe@test.co.uk", "", false, []string{"co.uk"}, Fail, PolicyReject},
+		{"joe@test.co.uk", "", false, []string{"mail.test.co.uk"}, Fail, PolicyReject},
+		{"joe@test.co.uk", "", false, []string{"TEST.co.uk."}, Pass, PolicyNone},
+		{"joe@test.tld, jane@test.tld", "test.tld", true, nil, PermError, PolicyNone},
+		{"joe", "test.tld", true, nil, PermError, PolicyNone},
+		// Hosts below a shared public suffix are not aligned.
+		{"joe@victim.github.io", "", false, []string{"evil.github.io"}, Fail, PolicyReject},
+		{"joe@victim.github.io", "", false, []string{"mail.victim.github.io"}, Pass, PolicyNone},
+	}
+	checker := New(z.lookup).WithSuffixList(testSuffixes)
+	// Sampled out by pct=50
+	checker.random = func() int { return 50 }
+	for _, test := range tests {
+		e := checker.Check(from(test.from), test.spfDomain, test.spfPass, test.dkim)
+		if e.Result != test.result || e.Policy != test.policy {
+			t.Errorf("Expected %s/%s for %s, got %#v", test.result, test.policy, test.from, e)
+		}
+	}
+
+	if e := checker.Check(message.Header{}, "test.tld", true, nil); e.Result != PermError {
+		t.Errorf("Expected a permerror without From field, got %#v", e)
+	}
+	e := checker.Check(from("joe@mail.test.tld"), "", false, nil)
+	if e.Domain != "mail.test.tld" || e.Published != PolicyQuarantine {
+		t.Errorf("Unexpected evaluation %#v", e)
+	}
+}
+
+func TestCheckWithoutSuffixList(t *testing.T) {
+	checker := New(zone{"_dmarc.test.tld": {"v=DMARC1; p=reject; sp=quarantine"}}.lookup)
+	// Relaxed alignment needs the exact domain.
+	if e := checker.Check(from("joe@test.tld"), "", false, []string{"mail.test.tld"}); e.Result != Fail {
+		t.Errorf("Expected a fail without suffix list, got %#v", e)
+	}
+	// The policy of the organizational domain is still found.
+	if e := checker.Check(from("joe@mail.test.tld"), "", false, nil); e.Policy != PolicyQuarantine {
+		t.Errorf("Expected the subdomain policy, got %#v", e)
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := map[string]string{
+		"test.tld":          "test.tld",
+		"a.b.test.tld.":     "test.tld",
+		"Mail.Test.Co.UK":   "test.co.uk",
+		"a.test.github.io":  "test.github.io",
+		"a.b.c.ck":          "b.c.ck",
+		"a.www.ck":          "www.ck",
+		"mail.test.unknown": "test.unknown",
+		"почта.тест.рф":     "xn--e1aybc.xn--p1ai",
+	}
+	for domain, expected := range tests {
+		if org, ok := testSuffixes.OrganizationalDomain(domain); !ok || org != expected {
+			t.Errorf("Expected %s for %s, got %s, %v", expected, domain, org, ok)
+		}
+	}
+	for _, suffix := range []string{"co.uk", "github.io", "c.ck", "tld", "unknown"} {
+		if org, ok := testSuffixes.OrganizationalDomain(suffix); ok {
+			t.Errorf("Expected %s to be a public suffix, got %s", suffix, org)
+		}
+	}
+}
+
+func TestGuessOrganizationalDomain(t *testing.T) {
+	tests := map[string]string{
+		"test.tld":            "test.tld",
+		"a.b.test.tld.":       "test.tld",
+		"Mail.Test.Co.UK":     "test.co.uk",
+		"co.uk":               "co.uk",
+		"mail.test.co.museum": "co.museum",
+		"tld":                 "tld",
+	}
+	for domain, expected := range tests {
+		if org := guessOrganizationalDomain(domain); org != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, domain, org)
+		}
+	}
+}
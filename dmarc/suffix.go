@@ -0,0 +1,91 @@
+package dmarc
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jorgenschaefer/smtpproxy/idna"
+)
+
+// SuffixList is a public suffix list (https://publicsuffix.org/),
+// which says below which domains names can be registered. DMARC uses
+// it to find organizational domains (RFC 7489, section 3.2).
+type SuffixList struct {
+	// Rules by their domain in ASCII form. Wildcard rules are
+	// stored as "*.domain", exceptions as "!domain".
+	rules map[string]bool
+}
+
+// LoadSuffixList reads the list from the file at path.
+func LoadSuffixList(path string) (*SuffixList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSuffixList(f)
+}
+
+// ParseSuffixList reads the list in the format of
+// public_suffix_list.dat: one rule per line, and comments starting
+// with "//".
+func ParseSuffixList(r io.Reader) (*SuffixList, error) {
+	l := &SuffixList{rules: map[string]bool{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+		prefix := ""
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			prefix, rule = "!", rule[1:]
+		case strings.HasPrefix(rule, "*."):
+			prefix, rule = "*.", rule[2:]
+		}
+		if ascii, err := idna.ToASCII(rule); err == nil {
+			rule = ascii
+		}
+		l.rules[prefix+rule] = true
+	}
+	return l, scanner.Err()
+}
+
+// OrganizationalDomain returns the registered domain of a domain in
+// ASCII form: its public suffix and one more label. It returns false
+// if domain is a public suffix itself.
+func (l *SuffixList) OrganizationalDomain(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if ascii, err := idna.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	labels := strings.Split(domain, ".")
+	// The number of labels of the public suffix. Without a
+	// matching rule, it is the top-level domain.
+	suffix := 1
+	// The longest matching rule wins, unless an exception
+	// matches.
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		if l.rules["!"+name] {
+			suffix = len(labels) - i - 1
+			break
+		}
+		if i > 0 && l.rules["*."+name] {
+			suffix = len(labels) - i + 1
+			break
+		}
+		if l.rules[name] {
+			suffix = len(labels) - i
+			break
+		}
+	}
+	if len(labels) <= suffix {
+		return domain, false
+	}
+	return strings.Join(labels[len(labels)-suffix-1:], "."), true
+}
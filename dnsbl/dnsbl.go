@@ -1,51 +1,429 @@
 package dnsbl
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-type LookupFunction func(string) ([]string, error)
+// LookupFunction returns the addresses of a host name, or the TXT
+// records of a name, like net.Resolver.LookupHost and LookupTXT. It
+// should give up once ctx is done.
+type LookupFunction func(ctx context.Context, name string) ([]string, error)
+
+// Zone is a DNSBL zone and the return codes that count as listed.
+type Zone struct {
+	Name string
+	// The codes that count, with their weights. Without codes,
+	// every answer counts with weight 1.
+	Codes []Code
+	// Set for allowlist (DNSWL) zones, which list trusted clients.
+	Allow bool
+}
+
+// Code is a range of return codes, like 127.0.0.2/31 for the SBL
+// part of zen.spamhaus.org.
+type Code struct {
+	Network *net.IPNet
+	Weight  float64
+}
+
+// ParseZone parses a zone as written in the configuration: the name,
+// optionally followed by "=" and a comma-separated list of return
+// codes, each an address or network with an optional weight after a
+// colon, as in "zen.spamhaus.org=127.0.0.2/31:2,127.0.0.10/31:0.5".
+func ParseZone(spec string) (Zone, error) {
+	name, codes, hasCodes := strings.Cut(spec, "=")
+	zone := Zone{Name: name}
+	if name == "" {
+		return zone, errors.New("missing zone name")
+	}
+	if !hasCodes {
+		return zone, nil
+	}
+	for _, code := range strings.Split(codes, ",") {
+		network, weight, hasWeight := strings.Cut(code, ":")
+		ipnet, err := ParseNetwork(network)
+		if err != nil {
+			return zone, fmt.Errorf("invalid return code %#v in zone %s", code, name)
+		}
+		c := Code{Network: ipnet, Weight: 1}
+		if hasWeight {
+			c.Weight, err = strconv.ParseFloat(weight, 64)
+			if err != nil || c.Weight < 0 {
+				return zone, fmt.Errorf("invalid weight %#v in zone %s", weight, name)
+			}
+		}
+		zone.Codes = append(zone.Codes, c)
+	}
+	return zone, nil
+}
+
+// ParseNetwork parses a network in CIDR notation or a single
+// address.
+func ParseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %#v", network)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(network)
+	return ipnet, err
+}
+
+// weight returns the sum of the weights of the codes matching the
+// answers of the zone. Every code counts only once.
+func (zone Zone) weight(answers []net.IP) float64 {
+	if len(zone.Codes) == 0 {
+		return 1
+	}
+	sum := 0.0
+	for _, code := range zone.Codes {
+		for _, ip := range answers {
+			if code.Network.Contains(ip) {
+				sum += code.Weight
+				break
+			}
+		}
+	}
+	return sum
+}
+
+var loopback = &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+
+// Zones answer with 127.255.255.x when they refuse a query, for
+// example because it came from a public resolver or the rate limit
+// was exceeded. list.dnswl.org answers with 127.0.0.255.
+var refused = &net.IPNet{IP: net.IPv4(127, 255, 255, 0), Mask: net.CIDRMask(24, 32)}
+var refusedDNSWL = net.IPv4(127, 0, 0, 255)
+
+// isError returns true if an answer is not a valid return code
+// (RFC 5782, section 2.1).
+func isError(ip net.IP) bool {
+	return ip == nil || !loopback.Contains(ip) || refused.Contains(ip) || ip.Equal(refusedDNSWL)
+}
 
 type DNSBL struct {
-	servers []string
-	lookup  LookupFunction
+	zones     []Zone
+	allowed   []*net.IPNet
+	lookup    LookupFunction
+	lookupTXT LookupFunction
 }
 
-func New(servers []string, lookup LookupFunction) *DNSBL {
+// New returns a DNSBL that looks up addresses with lookup and the
+// reasons for listings with lookupTXT. Clients in the allowed
+// networks are trusted without any lookups.
+func New(zones []Zone, allowed []*net.IPNet, lookup, lookupTXT LookupFunction) *DNSBL {
 	blacklist := &DNSBL{
-		servers: make([]string, len(servers)),
-		lookup:  lookup,
+		zones:     make([]Zone, len(zones)),
+		allowed:   allowed,
+		lookup:    lookup,
+		lookupTXT: lookupTXT,
 	}
-	for i, srv := range servers {
-		if strings.HasSuffix(srv, ".") {
-			blacklist.servers[i] = srv
-		} else {
-			blacklist.servers[i] = srv + "."
+	for i, zone := range zones {
+		if !strings.HasSuffix(zone.Name, ".") {
+			zone.Name += "."
 		}
-
+		blacklist.zones[i] = zone
 	}
 	return blacklist
 }
 
-func (blacklist *DNSBL) Check(ipaddress net.Addr) (string, bool) {
-	prefix := makePrefix(ipaddress)
-	for _, srv := range blacklist.servers {
-		hosts, err := blacklist.lookup(fmt.Sprintf("%s.%s", prefix, srv))
-		if err == nil {
-			return fmt.Sprintf("DNSBL %s returned %s", srv, hosts), true
+// Enabled returns true if there are blocklist zones to query.
+func (blacklist *DNSBL) Enabled() bool {
+	for _, zone := range blacklist.zones {
+		if !zone.Allow {
+			return true
+		}
+	}
+	return false
+}
+
+// Entry is the answer of one zone.
+type Entry struct {
+	Zone    string
+	Answers []string
+	// The sum of the weights of the matching return codes.
+	Weight float64
+	// The TXT record of the listing, usually a reason and a URL.
+	Text string
+	// Set if the zone returned an error code instead. The entry
+	// does not count then.
+	Error bool
+	// Set for allowlist zones.
+	Allow bool
+}
+
+func (e Entry) String() string {
+	kind := "DNSBL"
+	if e.Allow {
+		kind = "DNSWL"
+	}
+	if e.Error {
+		return fmt.Sprintf("%s %s returned error %s", kind, e.Zone, e.Answers)
+	}
+	return fmt.Sprintf("%s %s returned %s (%g)", kind, e.Zone, e.Answers, e.Weight)
+}
+
+// counts returns true if the entry lists the client.
+func (e Entry) counts() bool {
+	return !e.Error && e.Weight > 0
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	// The sum of the weights of all blocklist listings.
+	Score float64
+	// The answers of all zones that list the address or returned
+	// an error, in the configured order.
+	Entries []Entry
+	// Describes why the client is trusted, if it is.
+	Allowed string
+}
+
+// Listed returns the blocklist entries that count toward the score.
+func (r Result) Listed() []Entry {
+	listed := []Entry{}
+	for _, e := range r.Entries {
+		if !e.Allow && e.counts() {
+			listed = append(listed, e)
+		}
+	}
+	return listed
+}
+
+// Errors returns the entries of zones that returned an error code.
+func (r Result) Errors() []Entry {
+	errs := []Entry{}
+	for _, e := range r.Entries {
+		if e.Error {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// Listing is a check that runs in the background.
+type Listing struct {
+	done chan struct{}
+	// Closed once the allowlist zones answered.
+	allowDone chan struct{}
+	cancel    context.CancelFunc
+	zones     []Zone
+	entries   []*Entry
+	// The allowed network the client is in.
+	network *net.IPNet
+}
+
+// Start queries all zones in parallel for address and returns
+// without waiting for the answers. Each lookup gives up after
+// timeout, which counts as not listed. Addresses other than TCP
+// addresses, like those of Unix sockets, are not looked up.
+func (blacklist *DNSBL) Start(address net.Addr, timeout time.Duration) *Listing {
+	ip, ok := addressIP(address)
+	if !ok {
+		return blacklist.finished(nil)
+	}
+	for _, network := range blacklist.allowed {
+		if network.Contains(ip) {
+			return blacklist.finished(network)
+		}
+	}
+	return blacklist.start(makePrefix(address), timeout)
+}
+
+// StartDomain queries all zones in parallel for a domain, like Start
+// does for addresses. The zones have to be domain-based (RHSBL)
+// zones. Address literals and names without a dot are not queried.
+func (blacklist *DNSBL) StartDomain(domain string, timeout time.Duration) *Listing {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, "[") || net.ParseIP(domain) != nil {
+		return blacklist.finished(nil)
+	}
+	return blacklist.start(domain, timeout)
+}
+
+// finished returns a listing without lookups, for a client in network
+// if it is not nil.
+func (blacklist *DNSBL) finished(network *net.IPNet) *Listing {
+	l := &Listing{
+		done:      make(chan struct{}),
+		allowDone: make(chan struct{}),
+		cancel:    func() {},
+		network:   network,
+	}
+	close(l.allowDone)
+	close(l.done)
+	return l
+}
+
+func (blacklist *DNSBL) start(prefix string, timeout time.Duration) *Listing {
+	if len(blacklist.zones) == 0 {
+		return blacklist.finished(nil)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listing{
+		done:      make(chan struct{}),
+		allowDone: make(chan struct{}),
+		cancel:    cancel,
+		zones:     blacklist.zones,
+		entries:   make([]*Entry, len(blacklist.zones)),
+	}
+	var wg, allowWG sync.WaitGroup
+	for i, zone := range blacklist.zones {
+		wg.Add(1)
+		if zone.Allow {
+			allowWG.Add(1)
+		}
+		go func(i int, zone Zone) {
+			defer wg.Done()
+			l.entries[i] = blacklist.query(ctx, prefix+"."+zone.Name, zone, timeout)
+			if zone.Allow {
+				allowWG.Done()
+			}
+		}(i, zone)
+	}
+	go func() {
+		allowWG.Wait()
+		close(l.allowDone)
+	}()
+	go func() {
+		wg.Wait()
+		cancel()
+		close(l.done)
+	}()
+	return l
+}
+
+// query returns the entry for a zone, or nil if the name is not
+// listed.
+func (blacklist *DNSBL) query(ctx context.Context, name string, zone Zone, timeout time.Duration) *Entry {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	hosts, err := blacklist.lookup(ctx, name)
+	if err != nil || len(hosts) == 0 {
+		return nil
+	}
+	e := &Entry{Zone: zone.Name, Answers: hosts, Allow: zone.Allow}
+	answers := make([]net.IP, len(hosts))
+	for i, host := range hosts {
+		answers[i] = net.ParseIP(host)
+		if isError(answers[i]) {
+			e.Error = true
+			return e
+		}
+	}
+	e.Weight = zone.weight(answers)
+	if e.Weight > 0 && !zone.Allow && blacklist.lookupTXT != nil {
+		// The reason is nice to have, a failed lookup does not
+		// change the listing.
+		if txts, err := blacklist.lookupTXT(ctx, name); err == nil {
+			e.Text = strings.Join(txts, " ")
+		}
+	}
+	return e
+}
+
+var link = regexp.MustCompile(`(?i)\bhttps?://([a-z0-9][a-z0-9.-]*[a-z0-9])`)
+
+// LinkDomains returns the distinct domains of up to max http and
+// https links in a message body. Quoted-printable soft line breaks are
+// removed, other encodings are not decoded.
+func LinkDomains(body io.Reader, max int) ([]string, error) {
+	domains := []string{}
+	seen := map[string]bool{}
+	r := bufio.NewReader(body)
+	line := ""
+	for len(domains) < max {
+		// Overlong lines are split, which can break a link.
+		chunk, err := r.ReadSlice('\n')
+		line += strings.TrimRight(string(chunk), "\r\n")
+		if err == nil && strings.HasSuffix(line, "=") && len(line) < 64*1024 {
+			line = strings.TrimSuffix(line, "=")
+			continue
+		}
+		for _, match := range link.FindAllStringSubmatch(line, -1) {
+			domain := strings.ToLower(match[1])
+			if seen[domain] || net.ParseIP(domain) != nil || len(domains) >= max {
+				continue
+			}
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+		line = ""
+		if err == io.EOF {
+			break
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return domains, err
+		}
+	}
+	return domains, nil
+}
+
+// Allowed waits for the allowlist zones only. If the client is
+// trusted, it returns a description of the allowlist entry and true.
+func (l *Listing) Allowed() (string, bool) {
+	<-l.allowDone
+	if l.network != nil {
+		return "allowlist " + l.network.String(), true
+	}
+	for i, zone := range l.zones {
+		// The blocklist lookups may still be running.
+		if zone.Allow && l.entries[i] != nil && l.entries[i].counts() {
+			return l.entries[i].String(), true
 		}
 	}
 	return "", false
 }
 
-func makePrefix(address net.Addr) string {
+// Wait waits for all lookups to finish and returns the result.
+func (l *Listing) Wait() Result {
+	<-l.done
+	result := Result{Entries: []Entry{}}
+	result.Allowed, _ = l.Allowed()
+	for _, e := range l.entries {
+		if e == nil {
+			continue
+		}
+		result.Entries = append(result.Entries, *e)
+		if !e.Error && !e.Allow {
+			result.Score += e.Weight
+		}
+	}
+	return result
+}
+
+// Cancel stops the lookups that are still running.
+func (l *Listing) Cancel() {
+	l.cancel()
+}
+
+func addressIP(address net.Addr) (net.IP, bool) {
 	tcpaddress, ok := address.(*net.TCPAddr)
 	if !ok {
-		panic("Check() did not receive a TCPAddr")
+		return nil, false
+	}
+	return tcpaddress.IP, true
+}
+
+func makePrefix(address net.Addr) string {
+	parsed, ok := addressIP(address)
+	if !ok {
+		panic("makePrefix() did not receive a TCPAddr")
 	}
-	parsed := tcpaddress.IP
 
 	if ip := parsed.To4(); ip != nil {
 		reversed := make([]string, net.IPv4len)
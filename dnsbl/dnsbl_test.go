@@ -1,44 +1,261 @@
 package dnsbl
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestCheck(t *testing.T) {
+func zones(specs ...string) []Zone {
+	zones := []Zone{}
+	for _, spec := range specs {
+		zone, err := ParseZone(spec)
+		if err != nil {
+			panic(err)
+		}
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+func TestStart(t *testing.T) {
+	var mu sync.Mutex
 	args := []string{}
 	result := []string{}
-	blacklist := New([]string{"rbl.tld", "rbl2.tld."},
-		func(host string) ([]string, error) {
+	blacklist := New(zones("rbl.tld", "rbl2.tld."), nil,
+		func(ctx context.Context, host string) ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
 			args = append(args, host)
 			if len(result) == 0 {
 				return result, errors.New("Failed to resolve")
 			} else {
 				return result, nil
 			}
-		})
-	blacklist.Check(makeAddr("1.2.3.4"))
-	if len(args) != 2 || args[0] != "4.3.2.1.rbl.tld." || args[1] != "4.3.2.1.rbl2.tld." {
-		t.Errorf("Unexpected check order: %#v", args)
+		}, nil)
+	if r := blacklist.Start(makeAddr("1.2.3.4"), time.Second).Wait(); r.Score != 0 {
+		t.Errorf("Did not expect a positive result, got %#v", r)
 	}
-
-	_, ok := blacklist.Check(makeAddr("1.2.3.4"))
-	if ok {
-		t.Error("Did not expect a positive result")
+	sort.Strings(args)
+	if len(args) != 2 || args[0] != "4.3.2.1.rbl.tld." || args[1] != "4.3.2.1.rbl2.tld." {
+		t.Errorf("Unexpected queries: %#v", args)
 	}
 
 	result = []string{"127.0.0.10"}
-	description, ok := blacklist.Check(makeAddr("1.2.3.4"))
-	if !ok {
-		t.Error("Did expect a positive result")
+	r := blacklist.Start(makeAddr("1.2.3.4"), time.Second).Wait()
+	if r.Score != 2 || len(r.Listed()) != 2 {
+		t.Errorf("Did expect a positive result, got %#v", r)
 	}
-	expected := "DNSBL rbl.tld. returned [127.0.0.10]"
-	if description != expected {
+	expected := "DNSBL rbl.tld. returned [127.0.0.10] (1)"
+	if description := r.Listed()[0].String(); description != expected {
 		t.Errorf("Expected %#v to equal %#v", description, expected)
 	}
 }
 
+func TestStartUnixAddr(t *testing.T) {
+	blacklist := New(zones("rbl.tld"), nil,
+		func(ctx context.Context, host string) ([]string, error) {
+			t.Errorf("Did not expect a lookup of %s", host)
+			return nil, nil
+		}, nil)
+	l := blacklist.Start(&net.UnixAddr{Name: "/run/smtp.sock", Net: "unix"}, time.Second)
+	if r := l.Wait(); r.Score != 0 || len(r.Entries) != 0 {
+		t.Errorf("Expected an empty result, got %#v", r)
+	}
+	if _, ok := l.Allowed(); ok {
+		t.Error("Did not expect a Unix socket client to be allowed")
+	}
+}
+
+func TestStartCodes(t *testing.T) {
+	answers := map[string][]string{
+		"4.3.2.1.zen.tld.":   {"127.0.0.4", "127.0.0.10"},
+		"4.3.2.1.bl.tld.":    {"127.0.0.2"},
+		"4.3.2.1.other.tld.": {"127.0.0.5"},
+		"4.3.2.1.busy.tld.":  {"127.255.255.254"},
+		"4.3.2.1.wild.tld.":  {"192.0.2.1"},
+	}
+	texts := map[string][]string{
+		"4.3.2.1.zen.tld.": {"Listed in XBL,", "see https://zen.tld/"},
+	}
+	fake := func(records map[string][]string) LookupFunction {
+		return func(ctx context.Context, name string) ([]string, error) {
+			if r, ok := records[name]; ok {
+				return r, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+	}
+	blacklist := New(zones(
+		"zen.tld=127.0.0.2/31:2,127.0.0.4/30:2,127.0.0.10/31:0.5",
+		"bl.tld=127.0.0.2:1.5",
+		"other.tld=127.0.0.2",
+		"busy.tld",
+		"wild.tld",
+	), nil, fake(answers), fake(texts))
+	r := blacklist.Start(makeAddr("1.2.3.4"), time.Second).Wait()
+	if r.Score != 4 {
+		t.Errorf("Expected a score of 4, got %#v", r)
+	}
+	listed := r.Listed()
+	if len(listed) != 2 || listed[0].Zone != "zen.tld." || listed[0].Weight != 2.5 ||
+		listed[0].Text != "Listed in XBL, see https://zen.tld/" || listed[1].Zone != "bl.tld." {
+		t.Errorf("Unexpected listings %#v", listed)
+	}
+	errs := r.Errors()
+	if len(errs) != 2 || errs[0].Zone != "busy.tld." || errs[1].Zone != "wild.tld." {
+		t.Errorf("Expected the error codes to be detected, got %#v", errs)
+	}
+	expected := "DNSBL busy.tld. returned error [127.255.255.254]"
+	if errs[0].String() != expected {
+		t.Errorf("Expected %#v, got %#v", expected, errs[0].String())
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	dnswl, _ := ParseZone("dnswl.tld=127.0.10.0/24")
+	dnswl.Allow = true
+	lookups := make(chan string, 10)
+	allowed, _ := ParseNetwork("192.0.2.0/24")
+	blacklist := New(append(zones("rbl.tld"), dnswl), []*net.IPNet{allowed},
+		func(ctx context.Context, host string) ([]string, error) {
+			lookups <- host
+			if strings.HasSuffix(host, ".rbl.tld.") {
+				// Answers after the allowlist
+				<-ctx.Done()
+				return []string{"127.0.0.2"}, nil
+			}
+			if strings.HasPrefix(host, "4.3.2.1.") {
+				return []string{"127.0.10.2"}, nil
+			}
+			return []string{"127.0.0.255"}, nil
+		}, nil)
+
+	l := blacklist.Start(makeAddr("1.2.3.4"), 50*time.Millisecond)
+	description, ok := l.Allowed()
+	if !ok || description != "DNSWL dnswl.tld. returned [127.0.10.2] (1)" {
+		t.Errorf("Expected the client to be allowed, got %#v", description)
+	}
+	r := l.Wait()
+	if r.Allowed != description || r.Score != 1 || len(r.Listed()) != 1 {
+		t.Errorf("Unexpected result %#v", r)
+	}
+
+	// Refused allowlist queries do not count
+	l = blacklist.Start(makeAddr("5.6.7.8"), time.Millisecond)
+	if description, ok := l.Allowed(); ok {
+		t.Errorf("Did not expect the client to be allowed, got %#v", description)
+	}
+	l.Wait()
+	for len(lookups) > 0 {
+		<-lookups
+	}
+
+	description, ok = blacklist.Start(makeAddr("192.0.2.10"), time.Second).Allowed()
+	if !ok || description != "allowlist 192.0.2.0/24" {
+		t.Errorf("Expected the network to be allowed, got %#v", description)
+	}
+	if len(lookups) != 0 {
+		t.Error("Expected no lookups for allowed networks")
+	}
+}
+
+func TestStartDomain(t *testing.T) {
+	queries := make(chan string, 10)
+	blacklist := New(zones("dbl.tld=127.0.1.2/31"), nil,
+		func(ctx context.Context, name string) ([]string, error) {
+			queries <- name
+			if name == "spam.tld.dbl.tld." {
+				return []string{"127.0.1.2"}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}, nil)
+	if r := blacklist.StartDomain("Spam.TLD.", time.Second).Wait(); r.Score != 1 {
+		t.Errorf("Expected the domain to be listed, got %#v", r)
+	}
+	if r := blacklist.StartDomain("ham.tld", time.Second).Wait(); r.Score != 0 {
+		t.Errorf("Did not expect the domain to be listed, got %#v", r)
+	}
+	for _, name := range []string{"localhost", "[192.0.2.1]", "192.0.2.1", ""} {
+		blacklist.StartDomain(name, time.Second).Wait()
+	}
+	if len(queries) != 2 {
+		t.Errorf("Expected only two queries, got %d", len(queries))
+	}
+}
+
+func TestLinkDomains(t *testing.T) {
+	body := "See http://Spam.tld/offer and https://ham.tld.\r\n" +
+		"Again: HTTP://spam.tld, http://192.0.2.1/ and https://soft.=\r\n" +
+		"broken.tld/x=3D1\r\n" +
+		strings.Repeat("x", 5000) + " https://long.tld\r\n" +
+		"http://third.tld http://fourth.tld\r\n" +
+		"http://fifth.tld"
+	domains, err := LinkDomains(strings.NewReader(body), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"spam.tld", "ham.tld", "soft.broken.tld", "long.tld", "third.tld"}
+	if strings.Join(domains, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, domains)
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	zone, err := ParseZone("zen.tld=127.0.0.2/31:2,127.0.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Name != "zen.tld" || len(zone.Codes) != 2 ||
+		zone.Codes[0].Network.String() != "127.0.0.2/31" || zone.Codes[0].Weight != 2 ||
+		zone.Codes[1].Network.String() != "127.0.0.10/32" || zone.Codes[1].Weight != 1 {
+		t.Errorf("Unexpected zone %#v", zone)
+	}
+	if _, err := ParseNetwork("2001:db8::1"); err != nil {
+		t.Errorf("Expected an IPv6 address to parse, got %v", err)
+	}
+	for _, spec := range []string{"", "=127.0.0.2", "zen.tld=", "zen.tld=127.0.0.2:x", "zen.tld=127.0.0.2:-1"} {
+		if _, err := ParseZone(spec); err == nil {
+			t.Errorf("Expected an error for %#v", spec)
+		}
+	}
+}
+
+func TestStartTimeout(t *testing.T) {
+	started := make(chan bool, 2)
+	blacklist := New(zones("slow.tld", "fast.tld"), nil,
+		func(ctx context.Context, host string) ([]string, error) {
+			started <- true
+			if strings.HasSuffix(host, ".fast.tld.") {
+				// Only answers once the other lookup runs.
+				<-started
+				return []string{"127.0.0.2"}, nil
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, nil)
+	r := blacklist.Start(makeAddr("1.2.3.4"), 50*time.Millisecond).Wait()
+	if len(r.Entries) != 1 || r.Entries[0].Zone != "fast.tld." {
+		t.Errorf("Expected the fast zone to list the address, got %#v", r)
+	}
+
+	blacklist = New(zones("slow.tld"), nil,
+		func(ctx context.Context, host string) ([]string, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, nil)
+	l := blacklist.Start(makeAddr("1.2.3.4"), time.Hour)
+	l.Cancel()
+	if r := l.Wait(); r.Score != 0 {
+		t.Error("Did not expect a canceled lookup to list the address")
+	}
+}
+
 func TestMakePrefix(t *testing.T) {
 	tests := map[string]string{
 		"10.11.12.13":          "13.12.11.10",
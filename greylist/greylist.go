@@ -0,0 +1,208 @@
+// Package greylist temporarily rejects mail from unknown clients, as
+// described in RFC 6647. Most spam bots never retry, while real mail
+// servers do. The state is kept in an append-only log file, so it
+// survives restarts. Expired entries are removed every hour.
+
+package greylist
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Triplets not retried within this time are forgotten.
+	RetryWindow = 48 * time.Hour
+	// Clients that retried are accepted without delay for this
+	// long after their last mail.
+	WhitelistPeriod = 35 * 24 * time.Hour
+	// Whitelisted clients are only logged again after this time,
+	// to keep the log small.
+	refreshInterval = 24 * time.Hour
+	// How often expired entries are removed, from memory as well
+	// as from the log. Most triplets are never retried.
+	compactInterval = time.Hour
+)
+
+// Greylist is safe for concurrent use by several sessions.
+type Greylist struct {
+	mu   sync.Mutex
+	path string
+	log  *os.File
+	// When each triplet was first seen.
+	triplets map[string]time.Time
+	// When each whitelisted client network last sent mail.
+	clients map[string]time.Time
+	// When the log was last compacted.
+	compacted time.Time
+	now       func() time.Time
+}
+
+// Open reads the state from the log file at path, creating it if it
+// does not exist. Expired entries are removed from the file.
+func Open(path string) (*Greylist, error) {
+	g := &Greylist{
+		path:     path,
+		triplets: map[string]time.Time{},
+		clients:  map[string]time.Time{},
+		now:      time.Now,
+	}
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	if err := g.compact(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Close closes the log file.
+func (g *Greylist) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.log.Close()
+}
+
+// Check returns true if mail from the client at ip for the sender and
+// recipient is accepted. Unknown triplets are accepted once they are
+// retried after delay. This whitelists the client's network.
+func (g *Greylist) Check(ip net.IP, sender, recipient string, delay time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	if now.Sub(g.compacted) >= compactInterval {
+		// Errors are ignored as in append(). The old log stays
+		// in use.
+		g.compact()
+	}
+	network := Network(ip)
+	if seen, ok := g.clients[network]; ok && now.Sub(seen) < WhitelistPeriod {
+		if now.Sub(seen) >= refreshInterval {
+			g.whitelist(network, now)
+		}
+		return true
+	}
+	key := network + " " + strings.ToLower(sender) + " " + strings.ToLower(recipient)
+	first, ok := g.triplets[key]
+	if !ok || now.Sub(first) >= RetryWindow {
+		g.triplets[key] = now
+		g.append("T", now, key)
+		return false
+	}
+	if now.Sub(first) < delay {
+		return false
+	}
+	delete(g.triplets, key)
+	g.whitelist(network, now)
+	return true
+}
+
+func (g *Greylist) whitelist(network string, now time.Time) {
+	g.clients[network] = now
+	g.append("W", now, network)
+}
+
+// append writes an entry to the log. Errors are ignored, as losing
+// the state only delays some mail.
+func (g *Greylist) append(kind string, t time.Time, key string) {
+	fmt.Fprintf(g.log, "%s %d %s\n", kind, t.Unix(), key)
+}
+
+// Network returns the /24 network of an IPv4 address, or the /64
+// network of an IPv6 address, as mail servers often retry from a
+// different address of the same network.
+func Network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func (g *Greylist) load() error {
+	f, err := os.Open(g.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			// A partially written last line.
+			continue
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		t := time.Unix(seconds, 0)
+		switch fields[0] {
+		case "T":
+			g.triplets[fields[2]] = t
+		case "W":
+			g.clients[fields[2]] = t
+			// The triplets of whitelisted clients are not
+			// needed anymore.
+			for key := range g.triplets {
+				if strings.HasPrefix(key, fields[2]+" ") {
+					delete(g.triplets, key)
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// compact removes expired entries and writes the others to a new log
+// file, which replaces the old one, and opens it for appending.
+func (g *Greylist) compact() error {
+	now := g.now()
+	g.compacted = now
+	tmp := g.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for key, t := range g.triplets {
+		if now.Sub(t) >= RetryWindow {
+			delete(g.triplets, key)
+			continue
+		}
+		fmt.Fprintf(w, "T %d %s\n", t.Unix(), key)
+	}
+	for network, t := range g.clients {
+		if now.Sub(t) >= WhitelistPeriod {
+			delete(g.clients, network)
+			continue
+		}
+		fmt.Fprintf(w, "W %d %s\n", t.Unix(), network)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, g.path); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(g.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if g.log != nil {
+		g.log.Close()
+	}
+	g.log = log
+	return nil
+}
@@ -0,0 +1,147 @@
+package greylist
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist")
+	g, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	now := time.Unix(1000000, 0)
+	g.now = func() time.Time { return now }
+	client := net.ParseIP("192.0.2.10")
+	delay := 5 * time.Minute
+
+	if g.Check(client, "me@test.tld", "you@test.tld", delay) {
+		t.Error("Expected the first attempt to be greylisted")
+	}
+	now = now.Add(time.Minute)
+	if g.Check(client, "me@test.tld", "you@test.tld", delay) {
+		t.Error("Expected an early retry to be greylisted")
+	}
+	now = now.Add(delay)
+	if g.Check(client, "other@test.tld", "you@test.tld", delay) {
+		t.Error("Expected another sender to be greylisted")
+	}
+	// A retry from another address of the same network passes.
+	if !g.Check(net.ParseIP("192.0.2.20"), "ME@test.tld", "you@test.tld", delay) {
+		t.Error("Expected the retry to be accepted")
+	}
+	// The network is whitelisted now.
+	if !g.Check(client, "other@test.tld", "someone@test.tld", delay) {
+		t.Error("Expected the client to be whitelisted")
+	}
+	if g.Check(net.ParseIP("192.0.3.10"), "me@test.tld", "you@test.tld", delay) {
+		t.Error("Expected another network to be greylisted")
+	}
+	now = now.Add(WhitelistPeriod)
+	if g.Check(client, "me@test.tld", "you@test.tld", delay) {
+		t.Error("Expected the whitelisting to expire")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist")
+	g, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	g.now = func() time.Time { return start.Add(-time.Hour) }
+	g.Check(net.ParseIP("192.0.2.10"), "me@test.tld", "you@test.tld", 0)
+	g.Check(net.ParseIP("2001:db8::1"), "me@test.tld", "you@test.tld", 0)
+	g.Check(net.ParseIP("2001:db8::2"), "me@test.tld", "you@test.tld", 0)
+	g.now = func() time.Time { return start.Add(-RetryWindow) }
+	g.Check(net.ParseIP("198.51.100.1"), "old@test.tld", "you@test.tld", 0)
+	g.Close()
+
+	// A partially written entry
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("T 12")
+	f.Close()
+
+	g, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if !g.Check(net.ParseIP("192.0.2.10"), "me@test.tld", "you@test.tld", time.Minute) {
+		t.Error("Expected the triplet to be remembered")
+	}
+	if !g.Check(net.ParseIP("2001:db8::ffff"), "other@test.tld", "you@test.tld", time.Minute) {
+		t.Error("Expected the IPv6 network to be remembered as whitelisted")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "old@test.tld") || strings.Contains(string(data), "T 12\n") {
+		t.Errorf("Expected expired entries to be removed, got:\n%s", data)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.10":       "192.0.2.0/24",
+		"::ffff:192.0.2.1": "192.0.2.0/24",
+		"2001:db8:1:2:3::": "2001:db8:1:2::/64",
+	}
+	for ip, expected := range tests {
+		if network := Network(net.ParseIP(ip)); network != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, ip, network)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist")
+	g, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	now := time.Unix(1000000, 0)
+	g.now = func() time.Time { return now }
+	g.compacted = now
+
+	// Bots that never retry, and a client that gets whitelisted
+	for i := 0; i < 10; i++ {
+		g.Check(net.ParseIP("192.0.2.10"), "bot@test.tld", "you"+strconv.Itoa(i)+"@test.tld", 0)
+	}
+	g.Check(net.ParseIP("198.51.100.1"), "me@test.tld", "you@test.tld", 0)
+	now = now.Add(time.Minute)
+	g.Check(net.ParseIP("198.51.100.1"), "me@test.tld", "you@test.tld", 0)
+
+	now = now.Add(RetryWindow)
+	g.Check(net.ParseIP("203.0.113.1"), "new@test.tld", "you@test.tld", 0)
+	if len(g.triplets) != 1 || len(g.clients) != 1 {
+		t.Errorf("Expected the unretried triplets to expire, got %d triplets, %d clients",
+			len(g.triplets), len(g.clients))
+	}
+	now = now.Add(WhitelistPeriod)
+	g.Check(net.ParseIP("203.0.113.1"), "new@test.tld", "you@test.tld", 0)
+	if len(g.triplets) != 1 || len(g.clients) != 0 {
+		t.Errorf("Expected the whitelisting to expire, got %d triplets, %d clients",
+			len(g.triplets), len(g.clients))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("Expected the log to be compacted to 1 entry, got %#v", string(data))
+	}
+}
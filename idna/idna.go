@@ -0,0 +1,245 @@
+// Package idna converts internationalized domain names between their
+// Unicode form and the ASCII form used in the DNS (RFC 5890), where
+// each label with non-ASCII characters is encoded with Punycode (RFC
+// 3492) and prefixed with "xn--", like
+//
+//	bücher.tld = xn--bcher-kva.tld
+//
+// Labels are lower cased before they are encoded. Unlike a full
+// IDNA2008 implementation, the package does not normalize labels or
+// check which characters they contain.
+
+package idna
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidLabel = errors.New("invalid Punycode label")
+	ErrLabelTooLong = errors.New("label too long")
+)
+
+// The prefix of labels encoded with Punycode.
+const acePrefix = "xn--"
+
+// Parameters of Punycode (RFC 3492, section 5).
+const (
+	base        = 36
+	tmin        = 1
+	tmax        = 26
+	skew        = 38
+	damp        = 700
+	initialBias = 72
+	initialN    = 128
+)
+
+// ToASCII returns the ASCII form of domain. Labels that only consist
+// of ASCII characters are returned unchanged.
+func ToASCII(domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if IsASCII(label) {
+			continue
+		}
+		encoded, err := encode(strings.ToLower(label))
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + encoded
+		if len(labels[i]) > 63 {
+			return "", ErrLabelTooLong
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToUnicode returns the Unicode form of domain. Labels without the
+// "xn--" prefix are returned unchanged.
+func ToUnicode(domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if len(label) < len(acePrefix) || !strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			continue
+		}
+		encoded := strings.ToLower(label[len(acePrefix):])
+		decoded, err := decode(encoded)
+		if err != nil {
+			return "", err
+		}
+		// Only accept the encoding ToASCII would use, so each
+		// domain has exactly one ASCII form.
+		if IsASCII(decoded) || decoded != strings.ToLower(decoded) {
+			return "", ErrInvalidLabel
+		}
+		if again, _ := encode(decoded); again != encoded {
+			return "", ErrInvalidLabel
+		}
+		labels[i] = decoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// IsASCII returns true if s only consists of ASCII characters.
+func IsASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// encode encodes a label with Punycode (RFC 3492, section 6.3).
+func encode(label string) (string, error) {
+	input := []rune(label)
+	var output []byte
+	for _, c := range input {
+		if c < utf8.RuneSelf {
+			output = append(output, byte(c))
+		}
+	}
+	basic := len(output)
+	if basic > 0 {
+		output = append(output, '-')
+	}
+	n, delta, bias := rune(initialN), 0, initialBias
+	for h := basic; h < len(input); {
+		m := rune(math.MaxInt32)
+		for _, c := range input {
+			if c >= n && c < m {
+				m = c
+			}
+		}
+		if int(m-n) > (math.MaxInt32-delta)/(h+1) {
+			return "", ErrInvalidLabel
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, c := range input {
+			if c < n {
+				delta++
+			}
+			if c != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := threshold(k, bias)
+				if q < t {
+					break
+				}
+				output = append(output, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			output = append(output, digit(q))
+			bias = adapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(output), nil
+}
+
+// decode decodes a Punycode label (RFC 3492, section 6.2).
+func decode(encoded string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(encoded, '-'); b >= 0 {
+		for _, c := range encoded[:b] {
+			if c >= utf8.RuneSelf {
+				return "", ErrInvalidLabel
+			}
+			output = append(output, c)
+		}
+		pos = b + 1
+	}
+	n, i, bias := rune(initialN), 0, initialBias
+	for pos < len(encoded) {
+		oldi, w := i, 1
+		for k := base; ; k += base {
+			if pos >= len(encoded) {
+				return "", ErrInvalidLabel
+			}
+			d, ok := value(encoded[pos])
+			pos++
+			if !ok || d > (math.MaxInt32-i)/w {
+				return "", ErrInvalidLabel
+			}
+			i += d * w
+			t := threshold(k, bias)
+			if d < t {
+				break
+			}
+			if w > math.MaxInt32/(base-t) {
+				return "", ErrInvalidLabel
+			}
+			w *= base - t
+		}
+		length := len(output) + 1
+		bias = adapt(i-oldi, length, oldi == 0)
+		if i/length > math.MaxInt32-int(n) {
+			return "", ErrInvalidLabel
+		}
+		n += rune(i / length)
+		i %= length
+		if n < initialN || n > utf8.MaxRune || (n >= 0xd800 && n <= 0xdfff) {
+			return "", ErrInvalidLabel
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+	return string(output), nil
+}
+
+func threshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return tmin
+	case k >= bias+tmax:
+		return tmax
+	}
+	return k - bias
+}
+
+// adapt is the bias adaptation function (RFC 3492, section 6.1).
+func adapt(delta, length int, first bool) int {
+	if first {
+		delta /= damp
+	} else {
+		delta /= 2
+	}
+	delta += delta / length
+	k := 0
+	for delta > ((base-tmin)*tmax)/2 {
+		delta /= base - tmin
+		k += base
+	}
+	return k + (base-tmin+1)*delta/(delta+skew)
+}
+
+func digit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func value(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
@@ -0,0 +1,70 @@
+package idna
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPunycode(t *testing.T) {
+	tests := map[string]string{
+		"bücher":      "bcher-kva",
+		"münchen":     "mnchen-3ya",
+		"faß":         "fa-hia",
+		"中国":          "fiqs8s",
+		"рф":          "p1ai",
+		"испытание":   "80akhbyknj4f",
+		"3年B組金八先生":    "3B-ww4c5e180e575a65lsy2b",
+		"-> $1.00 <-": "-> $1.00 <--",
+		"ドメイン名例":      "eckwd4c7cu47r2wf",
+	}
+	for label, expected := range tests {
+		encoded, err := encode(label)
+		if err != nil || encoded != expected {
+			t.Errorf("Encoded %#v as %#v, %v, expected %#v", label, encoded, err, expected)
+		}
+		decoded, err := decode(expected)
+		if err != nil || decoded != label {
+			t.Errorf("Decoded %#v as %#v, %v, expected %#v", expected, decoded, err, label)
+		}
+	}
+	for _, invalid := range []string{"bcher-kv", "bcher-k!a", "ü-kva", "99999999999"} {
+		if decoded, err := decode(invalid); err == nil {
+			t.Errorf("Expected an error decoding %#v, got %#v", invalid, decoded)
+		}
+	}
+}
+
+func TestDomains(t *testing.T) {
+	tests := []struct {
+		unicode string
+		ascii   string
+	}{
+		{"test.tld", "test.tld"},
+		{"Test.TLD", "Test.TLD"},
+		{"bücher.tld", "xn--bcher-kva.tld"},
+		{"mail.Bücher.tld.", "mail.xn--bcher-kva.tld."},
+		{"испытание.рф", "xn--80akhbyknj4f.xn--p1ai"},
+	}
+	for _, test := range tests {
+		if ascii, err := ToASCII(test.unicode); err != nil || ascii != test.ascii {
+			t.Errorf("Expected %#v as ASCII to be %#v, got %#v, %v", test.unicode, test.ascii, ascii, err)
+		}
+		unicode, err := ToUnicode(test.ascii)
+		if expected := strings.Replace(test.unicode, "Bü", "bü", 1); err != nil || unicode != expected {
+			t.Errorf("Expected %#v as Unicode to be %#v, got %#v, %v", test.ascii, expected, unicode, err)
+		}
+	}
+	if unicode, err := ToUnicode("XN--BCHER-KVA.tld"); err != nil || unicode != "bücher.tld" {
+		t.Errorf("Expected the prefix to be case insensitive, got %#v, %v", unicode, err)
+	}
+	// Not the canonical encoding: ASCII only, upper case, and the
+	// basic code points out of order
+	for _, invalid := range []string{"xn--test-.tld", "xn--bcher-2pa.tld", "xn--bcher-kva-.tld", "xn--zz.tld"} {
+		if unicode, err := ToUnicode(invalid); err == nil {
+			t.Errorf("Expected an error for %#v, got %#v", invalid, unicode)
+		}
+	}
+	if ascii, err := ToASCII(strings.Repeat("ü", 60) + ".tld"); err != ErrLabelTooLong {
+		t.Errorf("Expected ErrLabelTooLong, got %#v, %v", ascii, err)
+	}
+}
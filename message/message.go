@@ -0,0 +1,102 @@
+// Package message reads the header of a mail message. Header fields
+// are kept exactly as they were received, which signatures over the
+// header need.
+
+package message
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+type Field struct {
+	// Name is the field name without the colon. It is empty for
+	// lines that are not a valid header field.
+	Name string
+	// Raw is the whole field, including the name and all line
+	// breaks, which are always CRLF.
+	Raw string
+}
+
+// Value returns the unfolded field body without surrounding
+// whitespace.
+func (f Field) Value() string {
+	value := f.Raw
+	if i := strings.IndexByte(value, ':'); i >= 0 && f.Name != "" {
+		value = value[i+1:]
+	}
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.TrimSpace(value)
+}
+
+type Header []Field
+
+// ReadHeader reads the header fields up to and including the empty
+// line that ends the header. Bare LF line ends are turned into CRLF.
+// Lines that are not header fields are kept as fields without a name,
+// so nothing is lost when the header is written again.
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	header := Header{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return header, err
+		}
+		if line == "" {
+			return header, nil
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") + "\r\n"
+		if line == "\r\n" {
+			return header, nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(header) > 0 {
+			header[len(header)-1].Raw += line
+		} else {
+			header = append(header, Field{Name: fieldName(line), Raw: line})
+		}
+		if err == io.EOF {
+			return header, nil
+		}
+	}
+}
+
+func fieldName(line string) string {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return ""
+	}
+	name := strings.TrimRight(line[:i], " \t")
+	for _, c := range name {
+		// RFC 5322, section 3.6.8
+		if c < 33 || c > 126 {
+			return ""
+		}
+	}
+	return name
+}
+
+// Get returns all fields with the given name, in order.
+func (h Header) Get(name string) []Field {
+	fields := []Field{}
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// WriteTo writes the header including the empty line that ends it.
+func (h Header) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, field := range h {
+		n, err := io.WriteString(w, field.Raw)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	n, err := io.WriteString(w, "\r\n")
+	return total + int64(n), err
+}
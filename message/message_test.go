@@ -0,0 +1,58 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	input := "From: me@test.tld\nSubject: A long\n\tsubject\r\nnot a field\n X-Empty:\n\nBody\n"
+	r := bufio.NewReader(strings.NewReader(input))
+	header, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != 3 {
+		t.Fatalf("Expected 3 fields, got %#v", header)
+	}
+	expected := []Field{
+		{Name: "From", Raw: "From: me@test.tld\r\n"},
+		{Name: "Subject", Raw: "Subject: A long\r\n\tsubject\r\n"},
+		{Name: "", Raw: "not a field\r\n X-Empty:\r\n"},
+	}
+	for i, field := range expected {
+		if header[i] != field {
+			t.Errorf("Expected %#v, got %#v", field, header[i])
+		}
+	}
+	if value := header[1].Value(); value != "A long\tsubject" {
+		t.Errorf("Unexpected value %#v", value)
+	}
+	if subjects := header.Get("subject"); len(subjects) != 1 {
+		t.Errorf("Expected to find the subject, got %#v", subjects)
+	}
+	body, _ := io.ReadAll(r)
+	if string(body) != "Body\n" {
+		t.Errorf("Expected the body to be left, got %#v", string(body))
+	}
+
+	var buf bytes.Buffer
+	header.WriteTo(&buf)
+	expectedText := "From: me@test.tld\r\nSubject: A long\r\n\tsubject\r\nnot a field\r\n X-Empty:\r\n\r\n"
+	if buf.String() != expectedText {
+		t.Errorf("Expected %#v, got %#v", expectedText, buf.String())
+	}
+}
+
+func TestReadHeaderWithoutBody(t *testing.T) {
+	header, err := ReadHeader(bufio.NewReader(strings.NewReader("From: me@test.tld")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != 1 || header[0].Raw != "From: me@test.tld\r\n" {
+		t.Errorf("Unexpected header %#v", header)
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/smtpd"
+)
+
+// chunks is a message being received with BDAT (RFC 3030).
+type chunks struct {
+	// Bytes received so far.
+	size int64
+	// Set once a chunk was rejected. The rest of the message is
+	// discarded.
+	failed bool
+	// Where the message goes: a spool file if it has to be checked
+	// first, or the relay host.
+	spool *os.File
+	relay io.WriteCloser
+}
+
+// handleBdat receives a chunk of the message. Unlike with DATA, the
+// client sends the chunk without waiting for a reply, so it is read
+// even if the message is rejected.
+func (s *State) handleBdat(args string) error {
+	size, last, ok := parseBdat(args)
+	if !ok {
+		return s.TarpitError("Error: Syntax error in BDAT command")
+	}
+	chunk := &readErrorReader{r: s.conn.ChunkReader(5*60, size)}
+	if !s.transaction || len(s.recipients) == 0 || s.chunks != nil && s.chunks.failed {
+		// Chunks pipelined after a rejected one end up here,
+		// too.
+		if _, err := io.Copy(io.Discard, chunk); err != nil {
+			return s.dataError(err)
+		}
+		s.conn.Reply(503, "5.5.1 No valid transaction")
+		if last {
+			s.endTransaction()
+		}
+		return nil
+	}
+	if s.chunks == nil {
+		if s.listed(config.StageData) {
+			return s.TarpitError("Error: DNSBL check positive")
+		}
+		if err := s.beginData(); err != nil {
+			s.chunks = &chunks{failed: true}
+			if _, err := io.Copy(io.Discard, chunk); err != nil {
+				return s.dataError(err)
+			}
+			err = s.hookRejected(err)
+			if last {
+				s.endTransaction()
+			}
+			return err
+		}
+		if err := s.startChunks(); err != nil {
+			return err
+		}
+	}
+	c := s.chunks
+	c.size += size
+	if c.size > s.config.MaxMessageSize {
+		s.abortRelay()
+		if _, err := io.Copy(io.Discard, chunk); err != nil {
+			return s.dataError(err)
+		}
+		return s.dataError(smtpd.ErrMessageTooLarge)
+	}
+
+	var w io.Writer = c.relay
+	if c.spool != nil {
+		w = c.spool
+	}
+	if _, err := io.Copy(w, chunk); err != nil {
+		s.abortRelay()
+		if chunk.err != nil {
+			return s.dataError(chunk.err)
+		}
+		io.Copy(io.Discard, chunk)
+		if c.spool != nil {
+			return s.spoolError(err)
+		}
+		return s.relayError(err)
+	}
+	if !last {
+		s.conn.Reply(250, fmt.Sprintf("2.0.0 %d bytes received", size))
+		return nil
+	}
+	defer s.endChunks()
+	if c.spool != nil {
+		return s.verifySpool(c.spool)
+	}
+	return s.finishData(c.relay)
+}
+
+// endTransaction ends the transaction after the reply to the last
+// chunk of a rejected message, as RFC 3030, section 2, requires. The
+// relay host discards its transaction.
+func (s *State) endTransaction() {
+	s.abortRelay()
+	s.Reset()
+}
+
+// startChunks prepares for the first chunk of the message.
+func (s *State) startChunks() error {
+	if s.dkim != nil || s.checkLinks() {
+		spool, err := s.createSpool()
+		if err != nil {
+			return err
+		}
+		s.chunks = &chunks{spool: spool}
+		return nil
+	}
+	s.chunks = &chunks{}
+	w, err := s.relayData()
+	if err != nil {
+		s.chunks = nil
+		return s.relayError(err)
+	}
+	s.chunks.relay = w
+	headers := strings.Join(append(s.headers, ""), "\r\n")
+	if _, err := io.WriteString(w, headers); err != nil {
+		s.abortRelay()
+		return s.relayError(err)
+	}
+	return nil
+}
+
+// endChunks removes the spool file of a message received with BDAT,
+// if any.
+func (s *State) endChunks() {
+	if s.chunks == nil {
+		return
+	}
+	if s.chunks.spool != nil {
+		s.chunks.spool.Close()
+		os.Remove(s.chunks.spool.Name())
+	}
+	s.chunks = nil
+}
+
+// parseBdat parses the arguments of a BDAT command: the size of the
+// chunk, and whether it is the last one.
+func parseBdat(args string) (int64, bool, bool) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		return 0, false, false
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, false
+	}
+	if len(fields) == 2 {
+		if !strings.EqualFold(fields[1], "LAST") {
+			return 0, false, false
+		}
+		return size, true, true
+	}
+	return size, false, true
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jorgenschaefer/smtpproxy/dkim"
+	"github.com/jorgenschaefer/smtpproxy/dnsbl"
+	"github.com/jorgenschaefer/smtpproxy/message"
+)
+
+// relaySpooled reads the whole message into a temporary file before
+// relaying it, as the Authentication-Results header and the ARC set
+// need the DKIM results for the complete message, and links in the
+// body are checked before it is relayed.
+func (s *State) relaySpooled() error {
+	spool, err := s.createSpool()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	s.conn.Reply(354, "End data with <CRLF>.<CRLF>")
+	data := s.dotReader()
+	body := &readErrorReader{r: data}
+	if _, err := io.Copy(spool, body); err != nil {
+		s.abortRelay()
+		if body.err != nil {
+			return s.dataError(body.err)
+		}
+		io.Copy(io.Discard, body)
+		return s.spoolError(err)
+	}
+	s.logLineEnds(data)
+	return s.verifySpool(spool)
+}
+
+// createSpool creates the temporary file for the message.
+func (s *State) createSpool() (*os.File, error) {
+	spool, err := os.CreateTemp("", "smtpproxy-")
+	if err != nil {
+		s.conn.Reply(451, "4.3.0 Local error, try again later")
+		s.args["error"] = err.Error()
+		return nil, s.Error("Error creating spool file")
+	}
+	return spool, nil
+}
+
+// verifySpool checks the links, DKIM signatures and DMARC policy of
+// the spooled message, and relays it.
+func (s *State) verifySpool(spool io.ReadSeeker) error {
+	if s.checkLinks() {
+		// The whole message is scanned, as a message without
+		// header would otherwise hide its links.
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return s.spoolError(err)
+		}
+		domains, err := dnsbl.LinkDomains(spool, maxLinkDomains)
+		if err != nil {
+			return s.spoolError(err)
+		}
+		if !s.checkDomains("5.7.1 Message contains a link to a domain blocked by RHSBL",
+			"Message rejected by RHSBL", domains...) {
+			s.Reset()
+			return nil
+		}
+	}
+	if s.dkim == nil {
+		return s.relaySpool(spool, nil)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return s.spoolError(err)
+	}
+	verifications, err := s.dkim.Verify(spool)
+	if err != nil {
+		return s.spoolError(err)
+	}
+	s.addDKIMResults(verifications)
+	if s.dmarc != nil {
+		header, _, err := readHeader(spool)
+		if err != nil {
+			return s.spoolError(err)
+		}
+		if !s.checkDMARC(header, verifications) {
+			return nil
+		}
+	}
+	var arc []string
+	if sealer, ok := s.config.ARC(); ok {
+		if arc, err = s.seal(spool, sealer); err != nil {
+			return s.spoolError(err)
+		}
+	}
+	return s.relaySpool(spool, append(arc, s.authenticationResults()))
+}
+
+// relaySpool relays the spooled message, with the additional header
+// fields in front.
+func (s *State) relaySpool(spool io.ReadSeeker, fields []string) error {
+	header, r, err := readHeader(spool)
+	if err != nil {
+		return s.spoolError(err)
+	}
+	w, err := s.relayData()
+	if err != nil {
+		return s.relayError(err)
+	}
+	headers := append(fields, s.headers...)
+	_, err = io.WriteString(w, strings.Join(append(headers, ""), "\r\n"))
+	if err == nil {
+		_, err = s.removeOwnResults(header).WriteTo(w)
+	}
+	if err == nil {
+		_, err = io.Copy(w, r)
+	}
+	if err != nil {
+		s.abortRelay()
+		return s.relayError(err)
+	}
+	return s.finishData(w)
+}
+
+// readHeader reads the header of the spooled message from the start.
+// The returned reader is positioned at the body.
+func readHeader(spool io.ReadSeeker) (message.Header, *bufio.Reader, error) {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(spool)
+	header, err := message.ReadHeader(r)
+	return header, r, err
+}
+
+// seal validates the ARC chain of the spooled message and returns
+// the fields of our ARC set.
+func (s *State) seal(spool io.ReadSeeker, sealer *dkim.Sealer) ([]string, error) {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	chain, err := s.dkim.VerifyChain(spool)
+	if err != nil {
+		return nil, err
+	}
+	result := "arc=" + string(chain.Result)
+	if chain.Reason != "" {
+		result += " reason=" + quote(chain.Reason)
+	}
+	s.results = append(s.results, result)
+	s.args["arc"] = string(chain.Result)
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return sealer.Seal(spool, chain, s.authservID(), s.results)
+}
+
+// spoolError reports a local problem with the spool file. The client
+// may try again later.
+func (s *State) spoolError(err error) error {
+	s.abortRelay()
+	s.conn.Reply(451, "4.3.0 Local error, try again later")
+	s.args["error"] = err.Error()
+	return s.Error("Error spooling mail")
+}
+
+func (s *State) addDKIMResults(verifications []dkim.Verification) {
+	if len(verifications) == 0 {
+		s.results = append(s.results, "dkim=none")
+		s.args["dkim"] = string(dkim.None)
+		return
+	}
+	summary := []string{}
+	for _, v := range verifications {
+		result := "dkim=" + string(v.Result)
+		if v.Reason != "" {
+			result += " reason=" + quote(v.Reason)
+		}
+		result += " header.d=" + v.Domain + " header.s=" + v.Selector
+		if v.Signature != "" {
+			// RFC 6008 identifies signatures by the start of
+			// the signature data.
+			b := v.Signature
+			if len(b) > 8 {
+				b = b[:8]
+			}
+			result += " header.b=" + quote(b)
+		}
+		s.results = append(s.results, result)
+		summary = append(summary, string(v.Result))
+	}
+	s.args["dkim"] = strings.Join(summary, ", ")
+}
+
+// authenticationResults returns the Authentication-Results header
+// field (RFC 8601) without the final line end.
+func (s *State) authenticationResults() string {
+	results := s.results
+	if len(results) == 0 {
+		results = []string{"none"}
+	}
+	return "Authentication-Results: " + s.authservID() + ";\r\n\t" +
+		strings.Join(results, ";\r\n\t")
+}
+
+func (s *State) authservID() string {
+	if s.config.AuthservID != "" {
+		return s.config.AuthservID
+	}
+	return hostname()
+}
+
+// removeOwnResults removes Authentication-Results fields that claim
+// to be from us, as they could not have been added by us (RFC 8601,
+// section 5).
+func (s *State) removeOwnResults(header message.Header) message.Header {
+	kept := message.Header{}
+	for _, field := range header {
+		if strings.EqualFold(field.Name, "Authentication-Results") {
+			id, _, _ := strings.Cut(field.Value(), ";")
+			if strings.EqualFold(strings.TrimSpace(id), s.authservID()) {
+				continue
+			}
+		}
+		kept = append(kept, field)
+	}
+	return kept
+}
+
+// quote returns a quoted string as used in header fields.
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
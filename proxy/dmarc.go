@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/dkim"
+	"github.com/jorgenschaefer/smtpproxy/dmarc"
+	"github.com/jorgenschaefer/smtpproxy/message"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+)
+
+// What a local action does, for the dis= comment (RFC 7489, section
+// 11.2).
+var dispositions = map[config.Action]dmarc.Policy{
+	config.ActionReject: dmarc.PolicyReject,
+	config.ActionTag:    dmarc.PolicyQuarantine,
+	config.ActionLog:    dmarc.PolicyNone,
+}
+
+// checkDMARC evaluates the DMARC policy of the author domain and
+// applies the configured action. It returns false if the message was
+// rejected.
+func (s *State) checkDMARC(header message.Header, verifications []dkim.Verification) bool {
+	domains := []string{}
+	for _, v := range verifications {
+		if v.Result == dkim.Pass {
+			domains = append(domains, v.Domain)
+		}
+	}
+	// SPF checks the HELO name for the null sender.
+	spfDomain := s.helo
+	if at := strings.LastIndexByte(s.sender, '@'); at >= 0 {
+		spfDomain = s.sender[at+1:]
+	}
+	e := s.dmarc.Check(header, spfDomain, s.spfResult == spf.Pass, domains)
+	s.args["dmarc"] = string(e.Result)
+
+	action := config.ActionLog
+	result := "dmarc=" + string(e.Result)
+	if e.Result == dmarc.Fail {
+		action = s.config.DMARCAction(e.Policy)
+		result += " (p=" + string(e.Published) + " dis=" + string(dispositions[action]) + ")"
+	}
+	if e.Domain != "" {
+		result += " header.from=" + e.Domain
+	}
+	s.results = append(s.results, result)
+
+	switch action {
+	case config.ActionReject:
+		s.conn.Reply(550, "5.7.1 Message rejected by the DMARC policy of "+e.Domain)
+		s.args["error"] = e.Reason
+		s.logger.Println(s.Error("Message rejected by DMARC"))
+		s.Reset()
+		return false
+	case config.ActionTag:
+		s.headers = append(s.headers, "X-Quarantine: DMARC policy of "+e.Domain)
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/dnsbl"
+)
+
+// listed returns true if clients are rejected at stage and the
+// weights of the zones listing the client reach the threshold. It
+// waits for the lookups to finish and records the result in the log
+// arguments.
+func (s *State) listed(stage config.Stage) bool {
+	if s.config.DNSBLReject != stage || s.allowed() {
+		return false
+	}
+	result := s.listing.Wait()
+	if listed := result.Listed(); len(listed) > 0 {
+		s.args["dnsbl"] = joinEntries(listed)
+		s.args["dnsbl_score"] = fmt.Sprintf("%g", result.Score)
+	}
+	// Zones that refuse our queries, for example because of a
+	// rate limit, must not block all mail.
+	if errs := result.Errors(); len(errs) > 0 {
+		s.args["dnsbl_error"] = joinEntries(errs)
+	}
+	return result.Score >= s.config.DNSBLThreshold
+}
+
+// allowed returns true if the client is on an allowlist, so it
+// skips the spam checks. It waits for the allowlist lookups and
+// records the decision in the log arguments.
+func (s *State) allowed() bool {
+	description, ok := s.listing.Allowed()
+	if ok {
+		s.args["dnswl"] = description
+	}
+	return ok
+}
+
+func joinEntries(entries []dnsbl.Entry) string {
+	descriptions := make([]string, len(entries))
+	for i, e := range entries {
+		descriptions[i] = e.String()
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// blockedReply returns the reply text for listed clients.
+func (s *State) blockedReply() string {
+	return withReason("5.7.1 Client host blocked by DNSBL", s.listing.Wait())
+}
+
+// withReason adds the reason given by the first zone that has one to
+// a reply.
+func withReason(reply string, result dnsbl.Result) string {
+	for _, e := range result.Listed() {
+		if text := printable(e.Text); text != "" {
+			return reply + ": " + text
+		}
+	}
+	return reply
+}
+
+// Links in a message are only checked up to this number of domains.
+const maxLinkDomains = 10
+
+// checkLinks returns true if the domains of links in messages are
+// checked.
+func (s *State) checkLinks() bool {
+	return s.config.RHSBLBody && s.rhsbl.Enabled() && !s.allowed()
+}
+
+// checkDomains looks up the domains in the RHSBL zones in parallel.
+// If the weights of the zones listing one of them reach the
+// threshold, it rejects the command with reply, logs description and
+// returns false.
+func (s *State) checkDomains(reply, description string, domains ...string) bool {
+	if !s.rhsbl.Enabled() || s.allowed() {
+		return true
+	}
+	listings := make([]*dnsbl.Listing, len(domains))
+	for i, domain := range domains {
+		listings[i] = s.rhsbl.StartDomain(domain, s.config.DNSBLTimeout)
+	}
+	defer func() {
+		for _, l := range listings {
+			l.Cancel()
+		}
+	}()
+	for i, l := range listings {
+		result := l.Wait()
+		if result.Score < s.config.DNSBLThreshold {
+			continue
+		}
+		s.args["rhsbl"] = domains[i] + ": " + joinEntries(result.Listed())
+		s.conn.Reply(550, withReason(reply, result))
+		s.logger.Println(s.Error(description))
+		delete(s.args, "rhsbl")
+		return false
+	}
+	return true
+}
+
+// printable removes control and non-ASCII characters from text from
+// the DNS, so it can be used in a reply, and shortens it.
+func printable(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, text)
+	if len(text) > 200 {
+		text = text[:200]
+	}
+	return strings.TrimSpace(text)
+}
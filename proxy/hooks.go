@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/dkim"
+	"github.com/jorgenschaefer/smtpproxy/dmarc"
+	"github.com/jorgenschaefer/smtpproxy/dnsbl"
+	"github.com/jorgenschaefer/smtpproxy/greylist"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+)
+
+// Options are everything a session needs besides the connection.
+type Options struct {
+	Config *config.Config
+	Role   config.Role
+	// Recipients decides which recipients are accepted. Defaults
+	// to Config.
+	Recipients RecipientPolicy
+	// DNSBL defaults to the zones in Config.
+	DNSBL *dnsbl.DNSBL
+	// RHSBL defaults to the domain-based zones in Config.
+	RHSBL *dnsbl.DNSBL
+	// SPF defaults to using DNS if Config has SPF or DMARC
+	// actions.
+	SPF *spf.Checker
+	// DKIM defaults to using DNS. Signatures are only verified if
+	// Config.VerifyDKIM is set, ARC sealing is configured or
+	// Config has DMARC actions.
+	DKIM *dkim.Verifier
+	// DMARC defaults to using DNS if Config has DMARC actions.
+	DMARC *dmarc.Checker
+	// Greylist greylists recipients if set.
+	Greylist *greylist.Greylist
+	// Logger defaults to standard output.
+	Logger Logger
+	Hooks  Hooks
+}
+
+type Logger interface {
+	Println(v ...interface{})
+}
+
+var defaultLogger = log.New(os.Stdout, "", 0)
+
+type RecipientPolicy interface {
+	ValidRecipient(recipient string) bool
+}
+
+// Info describes the state of a session for hooks.
+type Info struct {
+	RemoteAddr net.Addr
+	TLS        bool
+	Helo       string
+	Sender     string
+	Recipients []string
+	// Set if the client is on an allowlist. Hooks doing spam
+	// checks should skip them.
+	Allowed bool
+}
+
+// Hooks are called in order for each command until one of them
+// returns an error.
+type Hooks struct {
+	Connect []ConnectHook
+	Helo    []HeloHook
+	Mail    []MailHook
+	Rcpt    []RcptHook
+	Data    []DataHook
+}
+
+// Hooks return nil to accept a command. To reject it, they return a
+// *Reply. Any other error is a temporary failure.
+
+// ConnectHook is called before the client is greeted. Instead of the
+// greeting, only replies with code 421 or 554 are valid (RFC 5321,
+// section 4.3.2).
+type ConnectHook interface {
+	CheckConnect(info Info) error
+}
+
+type HeloHook interface {
+	CheckHelo(info Info, name string) error
+}
+
+type MailHook interface {
+	CheckMail(info Info, sender string) error
+}
+
+type RcptHook interface {
+	CheckRcpt(info Info, recipient string) error
+}
+
+// DataHook is called before the client is asked to send the message.
+type DataHook interface {
+	CheckData(info Info) error
+}
+
+// Reply rejects a command with a specific reply to the client. If
+// Tarpit is set, the client is tarpitted afterwards.
+type Reply struct {
+	Code    int
+	Message string
+	Tarpit  bool
+}
+
+func (r *Reply) Error() string {
+	return fmt.Sprintf("%d %s", r.Code, r.Message)
+}
+
+func (s *State) Info() Info {
+	return Info{
+		RemoteAddr: s.conn.RemoteAddr(),
+		TLS:        s.tls,
+		Helo:       s.helo,
+		Sender:     s.sender,
+		Recipients: append([]string{}, s.recipients...),
+		Allowed:    s.allowed(),
+	}
+}
+
+func (h *Hooks) checkConnect(info Info) error {
+	for _, hook := range h.Connect {
+		if err := hook.CheckConnect(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) checkHelo(info Info, name string) error {
+	for _, hook := range h.Helo {
+		if err := hook.CheckHelo(info, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) checkMail(info Info, sender string) error {
+	for _, hook := range h.Mail {
+		if err := hook.CheckMail(info, sender); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) checkRcpt(info Info, recipient string) error {
+	for _, hook := range h.Rcpt {
+		if err := hook.CheckRcpt(info, recipient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) checkData(info Info) error {
+	for _, hook := range h.Data {
+		if err := hook.CheckData(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookRejected tells the client that a hook rejected a command. The
+// session goes on unless the hook asked for a tarpit.
+func (s *State) hookRejected(err error) error {
+	return s.hookReply(err, 451)
+}
+
+// hookReply is hookRejected with the code to reply with if the hook
+// failed temporarily.
+func (s *State) hookReply(err error, temporary int) error {
+	var reply *Reply
+	if errors.As(err, &reply) {
+		s.args["reply"] = reply.Error()
+		s.conn.Reply(reply.Code, reply.Message)
+		if reply.Tarpit {
+			return s.TarpitError("Error: Rejected by hook")
+		}
+		s.logger.Println(s.Error("Rejected by hook"))
+		delete(s.args, "reply")
+		return nil
+	}
+	s.args["error"] = err.Error()
+	s.conn.Reply(temporary, "4.3.0 Temporary failure, try again later")
+	s.logger.Println(s.Error("Error in hook"))
+	delete(s.args, "error")
+	return nil
+}
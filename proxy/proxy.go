@@ -1,61 +1,193 @@
 package proxy
 
 import (
-	"fmt"
+	"io"
 	"net"
 	"net/smtp"
 	"net/textproto"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/jorgenschaefer/smtpproxy/argerror"
 	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/dkim"
+	"github.com/jorgenschaefer/smtpproxy/dmarc"
 	"github.com/jorgenschaefer/smtpproxy/dnsbl"
+	"github.com/jorgenschaefer/smtpproxy/greylist"
+	"github.com/jorgenschaefer/smtpproxy/idna"
 	"github.com/jorgenschaefer/smtpproxy/smtpd"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+	"github.com/jorgenschaefer/smtpproxy/srs"
 )
 
 type State struct {
 	conn       smtpd.Connection
+	config     *config.Config
+	policy     RecipientPolicy
+	logger     Logger
+	hooks      Hooks
+	helo       string
 	sender     string
 	recipients []string
 	args       map[string]string
 	blacklist  *dnsbl.DNSBL
+	listing    *dnsbl.Listing
+	rhsbl      *dnsbl.DNSBL
+	spf        *spf.Checker
+	spfResult  spf.Result
+	dkim       *dkim.Verifier
+	dmarc      *dmarc.Checker
+	greylist   *greylist.Greylist
+	headers    []string
+	// Authentication results for the Authentication-Results
+	// header (RFC 8601).
+	results    []string
+	tls        bool
+	requireTLS bool
+	// Set after EHLO, which offers the extensions.
+	ehlo bool
+	// Set if the client announced a binary message (RFC 3030).
+	binary bool
+	// Set if the client announced internationalized addresses
+	// (RFC 6531).
+	utf8 bool
+	// The message being received with BDAT, if any.
+	chunks *chunks
+	relay  *smtp.Client
+	// Set once MAIL was accepted, as the sender can be empty.
+	transaction bool
+	// Addresses the relay host was given, which can differ from
+	// the recipients because of overrides and SRS.
+	forwarded map[string]bool
 }
 
-func Greet(conn smtpd.Connection) (*State, error) {
+func Greet(conn smtpd.Connection, opts Options) (*State, error) {
+	cfg := opts.Config
 	s := &State{
-		conn:      conn,
-		args:      map[string]string{},
-		blacklist: dnsbl.New(config.DNSBL(), net.LookupHost),
+		conn:       conn,
+		config:     cfg,
+		policy:     opts.Recipients,
+		logger:     opts.Logger,
+		hooks:      opts.Hooks,
+		forwarded:  map[string]bool{},
+		args:       map[string]string{},
+		blacklist:  opts.DNSBL,
+		rhsbl:      opts.RHSBL,
+		spf:        opts.SPF,
+		greylist:   opts.Greylist,
+		tls:        conn.IsTLS(),
+		requireTLS: opts.Role == config.RoleSubmission,
+	}
+	if s.policy == nil {
+		s.policy = cfg
+	}
+	if s.logger == nil {
+		s.logger = defaultLogger
+	}
+	if s.blacklist == nil {
+		s.blacklist = dnsbl.New(cfg.DNSBLZones(), cfg.AllowedNetworks(),
+			net.DefaultResolver.LookupHost, net.DefaultResolver.LookupTXT)
+	}
+	if s.rhsbl == nil {
+		s.rhsbl = dnsbl.New(cfg.RHSBLZones(), nil,
+			net.DefaultResolver.LookupHost, net.DefaultResolver.LookupTXT)
+	}
+	checkDMARC := len(cfg.DMARC) > 0
+	if s.spf == nil && (len(cfg.SPF) > 0 || checkDMARC) {
+		s.spf = spf.New(spf.DefaultResolver)
+	}
+	// ARC sets record the DKIM results.
+	if _, sealing := cfg.ARC(); cfg.VerifyDKIM || sealing || checkDMARC {
+		s.dkim = opts.DKIM
+		if s.dkim == nil {
+			s.dkim = dkim.New(net.LookupTXT)
+		}
+	}
+	if checkDMARC {
+		s.dmarc = opts.DMARC
+		if s.dmarc == nil {
+			s.dmarc = dmarc.New(net.LookupTXT)
+		}
+		s.dmarc = s.dmarc.WithSuffixList(cfg.PublicSuffixes())
 	}
 	s.args["client"] = s.conn.RemoteAddr().String()
-	if err := conn.Printf("220-%s here, please hold.\r\n", hostname()); err != nil {
+	if s.tls {
+		s.args["protocol"] = "ESMTPS"
+	}
+	// The lookups run while the client waits for the greeting.
+	s.listing = s.blacklist.Start(conn.RemoteAddr(), cfg.DNSBLTimeout)
+	err := s.hooks.checkConnect(s.Info())
+	if err != nil {
+		s.listing.Cancel()
+		// Rejected clients are not greeted at all.
+		if err := s.hookReply(err, 421); err != nil {
+			return nil, err
+		}
+		return nil, s.Error("Connection rejected")
+	}
+	if err := s.greet(); err != nil {
+		s.listing.Cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *State) greet() error {
+	if err := s.conn.Printf("220-%s here, please hold.\r\n", hostname()); err != nil {
+		s.args["error"] = err.Error()
+		return s.Error("Error writing server greeting")
+	}
+	// Trusted clients do not have to wait. For the others, the
+	// DNSBL lookups run during the delay.
+	if !s.allowed() {
+		if err := s.greetingDelay(); err != nil {
+			return err
+		}
+	}
+	if s.listed(config.StageConnect) {
+		s.conn.Reply(554, s.blockedReply())
+		return s.TarpitError("Error: DNSBL check positive")
+	}
+	if err := s.conn.Reply(220, "Thank you for holding, how can I help you?"); err != nil {
 		s.args["error"] = err.Error()
-		return nil, s.Error("Error writing server greeting")
+		return s.Error("Error writing server greeting continuation")
 	}
-	command, args, err := conn.ReadCommand(5)
+	return nil
+}
+
+// greetingDelay tarpits clients that speak before the greeting.
+func (s *State) greetingDelay() error {
+	command, args, err := s.conn.ReadCommand(s.config.GreetingDelay)
 	if err == nil {
 		s.args["command"] = command
 		if args != "" {
 			s.args["command"] += " " + args
 		}
-		return nil, s.TarpitError("Error: Client spoke before its turn")
+		return s.TarpitError("Error: Client spoke before its turn")
 	}
-	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
-		s.args["error"] = err.Error()
-		return nil, s.Error("Error during greeting")
+	if err == smtpd.ErrInterrupted {
+		return s.shutdown()
 	}
-
-	if err := conn.Reply(220, "Thank you for holding, how can I help you?"); err != nil {
+	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
 		s.args["error"] = err.Error()
-		return nil, s.Error("Error writing server greeting continuation")
+		return s.Error("Error during greeting")
 	}
-	return s, nil
+	return nil
 }
 
 func (s *State) HandleCommand() error {
-	command, args, err := s.conn.ReadCommand(30)
+	read := s.conn.ReadCommand
+	// A message sent with BDAT is allowed to finish during a
+	// shutdown, like one sent with DATA.
+	if s.chunks != nil {
+		read = s.conn.ReadMessageCommand
+	}
+	command, args, err := read(30)
+	if err == smtpd.ErrInterrupted {
+		return s.shutdown()
+	}
 	if err != nil {
 		s.args["error"] = err.Error()
 		return s.Error("Error reading client command")
@@ -64,31 +196,37 @@ func (s *State) HandleCommand() error {
 	if args != "" {
 		s.args["command"] += " " + args
 	}
+	if s.conn.Pipelined() && !s.mayPipeline(strings.ToUpper(command)) {
+		s.conn.Reply(554, "5.5.0 Error: improper use of SMTP command pipelining")
+		return s.TarpitError("Error: Improper command pipelining")
+	}
 	switch strings.ToUpper(command) {
-	case "HELO":
-		s.conn.Reply(250, hostname())
-		s.args["protocol"] = "SMTP"
-	case "EHLO":
-		if _, ok := config.TLS(); ok {
-			s.conn.Reply(250, hostname(), "8BITMIME", "STARTTLS")
-		} else {
-			s.conn.Reply(250, hostname(), "8BITMIME")
-		}
-		s.args["protocol"] = "ESMTP"
+	case "HELO", "EHLO":
+		return s.handleHelo(strings.ToUpper(command), args)
 	case "STARTTLS":
-		if tls, ok := config.TLS(); ok {
-			s.conn.Reply(220, "Ready to start TLS")
-			s.conn.StartTLS(tls)
-			s.args["protocol"] = "ESMTPS"
-		} else {
+		tls, ok := s.config.TLS()
+		if !ok || s.tls {
 			return s.Error("Error: Unexpected STARTTLS command")
 		}
+		s.conn.Reply(220, "Ready to start TLS")
+		if err := s.conn.StartTLS(tls); err != nil {
+			s.args["error"] = err.Error()
+			return s.Error("Error during TLS handshake")
+		}
+		// RFC 3207 requires us to forget everything the
+		// client told us before.
+		s.Reset()
+		s.ehlo = false
+		s.tls = true
+		s.args["protocol"] = "ESMTPS"
 	case "MAIL":
 		return s.handleMail(args)
 	case "RCPT":
 		return s.handleRcpt(args)
 	case "DATA":
 		return s.HandleData()
+	case "BDAT":
+		return s.handleBdat(args)
 	case "RSET":
 		s.Reset()
 		s.conn.Reply(250, "Ok")
@@ -105,11 +243,35 @@ func (s *State) HandleCommand() error {
 	return nil
 }
 
-var PERMANENTARGS = []string{"client", "protocol"}
+// mayPipeline returns true if the client may send further commands
+// without waiting for the reply to command. Only commands that do not
+// change the course of the session may be followed by others (RFC
+// 2920, section 3.1), and only once PIPELINING was offered. Spam bots
+// often just send everything at once.
+func (s *State) mayPipeline(command string) bool {
+	switch command {
+	case "HELO", "EHLO", "STARTTLS", "DATA", "VRFY", "NOOP":
+		return false
+	case "QUIT":
+		return true
+	}
+	return s.ehlo
+}
+
+var PERMANENTARGS = []string{"client", "protocol", "helo", "dnswl", "dnsbl", "dnsbl_score", "dnsbl_error"}
 
 func (s *State) Reset() {
+	s.closeRelay()
+	s.transaction = false
 	s.sender = ""
 	s.recipients = []string{}
+	s.forwarded = map[string]bool{}
+	s.binary = false
+	s.utf8 = false
+	s.endChunks()
+	s.headers = nil
+	s.results = nil
+	s.spfResult = spf.None
 	args := map[string]string{}
 	for _, key := range PERMANENTARGS {
 		if val, ok := s.args[key]; ok {
@@ -119,10 +281,41 @@ func (s *State) Reset() {
 	s.args = args
 }
 
+// Close ends the session with the relay host, if any.
+func (s *State) Close() {
+	s.listing.Cancel()
+	s.endChunks()
+	s.closeRelay()
+}
+
+func (s *State) closeRelay() {
+	if s.relay != nil {
+		if err := s.relay.Quit(); err != nil {
+			s.relay.Close()
+		}
+		s.relay = nil
+	}
+}
+
+// abortRelay closes the relay connection without a QUIT, which
+// would terminate an unfinished message.
+func (s *State) abortRelay() {
+	if s.relay != nil {
+		s.relay.Close()
+		s.relay = nil
+	}
+}
+
 func (s *State) Error(description string) error {
 	return argerror.New(description, s.args)
 }
 
+// shutdown tells the client that the server is going away.
+func (s *State) shutdown() error {
+	s.conn.Reply(421, "4.3.2 Service shutting down, try again later")
+	return s.Error("Shutting down")
+}
+
 type TarpitError struct {
 	argerror.ArgError
 }
@@ -131,77 +324,422 @@ func (s *State) TarpitError(description string) error {
 	return TarpitError{s.Error(description).(argerror.ArgError)}
 }
 
+func (s *State) handleHelo(command, name string) error {
+	err := s.hooks.checkHelo(s.Info(), name)
+	if err != nil {
+		return s.hookRejected(err)
+	}
+	if !s.checkDomains("5.7.1 HELO name blocked by RHSBL", "HELO rejected by RHSBL", name) {
+		return nil
+	}
+	s.helo = name
+	s.args["helo"] = name
+	s.ehlo = command == "EHLO"
+	if command == "HELO" {
+		s.conn.Reply(250, hostname())
+		if s.tls {
+			s.args["protocol"] = "SMTPS"
+		} else {
+			s.args["protocol"] = "SMTP"
+		}
+		return nil
+	}
+	extensions := []string{hostname(), "8BITMIME", "PIPELINING",
+		"SIZE " + strconv.FormatInt(s.config.MaxMessageSize, 10),
+		"CHUNKING", "BINARYMIME", "SMTPUTF8"}
+	if _, ok := s.config.TLS(); ok && !s.tls {
+		extensions = append(extensions, "STARTTLS")
+	}
+	s.conn.Reply(250, extensions...)
+	if s.tls {
+		s.args["protocol"] = "ESMTPS"
+	} else {
+		s.args["protocol"] = "ESMTP"
+	}
+	return nil
+}
+
 func (s *State) handleMail(args string) error {
-	if s.sender != "" {
+	if s.transaction {
 		return s.TarpitError("Error: Duplicate MAIL command")
 	}
+	if s.requireTLS && !s.tls {
+		s.conn.Reply(530, "5.7.0 Must issue a STARTTLS command first")
+		return nil
+	}
 	sender, ok := extractSender(args)
 	if !ok {
 		return s.TarpitError("Error: Syntax error in MAIL command")
 	}
-	s.sender = sender
+	params := extractParameters(args)
+	if !s.checkSize(sender, params) {
+		return nil
+	}
+	binary := strings.EqualFold(params["BODY"], "BINARYMIME")
+	_, utf8 := params["SMTPUTF8"]
+	if !utf8 && !idna.IsASCII(sender) {
+		s.args["sender"] = sender
+		s.conn.Reply(553, "5.6.7 Non-ASCII addresses require SMTPUTF8")
+		s.logger.Println(s.Error("Sender rejected: non-ASCII address without SMTPUTF8"))
+		delete(s.args, "sender")
+		return nil
+	}
+	// Results of an earlier, rejected MAIL command.
+	s.results = nil
+	s.spfResult = spf.None
 	s.args["sender"] = sender
+	err := s.hooks.checkMail(s.Info(), sender)
+	if err != nil {
+		err = s.hookRejected(err)
+		delete(s.args, "sender")
+		return err
+	}
+	// The DNS only knows the ASCII form of internationalized
+	// domains.
+	lookup := asciiAddress(sender)
+	if at := strings.LastIndexByte(lookup, '@'); at >= 0 &&
+		!s.checkDomains("5.7.1 Sender domain blocked by RHSBL", "Sender rejected by RHSBL", lookup[at+1:]) {
+		delete(s.args, "sender")
+		return nil
+	}
+	if !s.checkSPF(lookup) {
+		delete(s.args, "sender")
+		delete(s.args, "spf")
+		return nil
+	}
+	// Rewrite the sender, so that the relay host's SPF checks
+	// see our domain.
+	forward := sender
+	if rewriter, ok := s.config.SRS(); ok {
+		forward, err = rewriter.Forward(sender)
+		if err != nil {
+			s.args["error"] = err.Error()
+			s.conn.Reply(553, "5.1.7 Invalid sender address")
+			s.logger.Println(s.Error("Error rewriting sender"))
+			delete(s.args, "error")
+			delete(s.args, "sender")
+			delete(s.args, "spf")
+			return nil
+		}
+		if forward != sender {
+			s.args["srs"] = forward
+		}
+	}
+	client, err := DialRelay(s.config.RelayHost)
+	if err != nil {
+		s.args["error"] = err.Error()
+		s.conn.Reply(451, "4.4.1 Relay host unavailable, try again later")
+		return s.Error("Error connecting to relay host")
+	}
+	s.relay = client
+	if binary && !s.relayBinary() {
+		s.closeRelay()
+		s.conn.Reply(554, "5.6.3 Binary messages can not be relayed")
+		s.logger.Println(s.Error("Sender rejected: relay host does not support BINARYMIME"))
+		delete(s.args, "sender")
+		delete(s.args, "spf")
+		delete(s.args, "srs")
+		return nil
+	}
+	// Clients ask for SMTPUTF8 whenever it is offered, so only
+	// addresses that need it are rejected (RFC 6531, section 3.2).
+	if !idna.IsASCII(forward) && !s.relayUTF8() {
+		s.closeRelay()
+		s.conn.Reply(553, "5.6.7 Internationalized addresses can not be relayed")
+		s.logger.Println(s.Error("Sender rejected: relay host does not support SMTPUTF8"))
+		delete(s.args, "sender")
+		delete(s.args, "spf")
+		delete(s.args, "srs")
+		return nil
+	}
+	if err := s.relayMail(forward, binary); err != nil {
+		s.closeRelay()
+		return s.relayReply(err, "Sender rejected by relay host")
+	}
+	s.transaction = true
+	s.binary = binary
+	s.utf8 = utf8
+	s.sender = sender
 	s.conn.Reply(250, "Ok")
 	return nil
 }
 
 func (s *State) handleRcpt(args string) error {
-	if s.sender == "" {
+	if !s.transaction {
 		return s.TarpitError("Error: RCPT without MAIL")
 	}
 	recipient, ok := extractRecipient(args)
 	if !ok {
 		return s.TarpitError("Error: Syntax error in RCPT command")
 	}
-	if !isValidRecipient(recipient) {
+	if !s.utf8 && !idna.IsASCII(recipient) {
+		s.args["recipient"] = recipient
+		s.conn.Reply(553, "5.6.7 Non-ASCII addresses require SMTPUTF8")
+		s.logger.Println(s.Error("Recipient rejected: non-ASCII address without SMTPUTF8"))
+		delete(s.args, "recipient")
+		return nil
+	}
+	if s.listed(config.StageRcpt) {
+		s.args["recipient"] = recipient
+		s.conn.Reply(550, s.blockedReply())
+		s.logger.Println(s.Error("Recipient rejected by DNSBL"))
+		delete(s.args, "recipient")
+		return nil
+	}
+	// Bounces to rewritten senders go back to the original
+	// sender, whatever the recipient policy says.
+	forward, bounce := recipient, false
+	if rewriter, ok := s.config.SRS(); ok {
+		original, err := rewriter.Reverse(recipient)
+		if err == nil {
+			forward, bounce = original, true
+		} else if err != srs.ErrNotSRS {
+			s.args["recipient"] = recipient
+			s.args["error"] = err.Error()
+			s.conn.Reply(550, "5.1.1 Invalid SRS address")
+			s.logger.Println(s.Error("Recipient rejected"))
+			delete(s.args, "recipient")
+			delete(s.args, "error")
+			return nil
+		}
+	}
+	if !bounce && !s.policy.ValidRecipient(recipient) {
 		s.args["recipient"] = recipient
 		return s.TarpitError("Error: Relay access denied")
 	}
+	err := s.hooks.checkRcpt(s.Info(), recipient)
+	if err != nil {
+		s.args["recipient"] = recipient
+		err = s.hookRejected(err)
+		delete(s.args, "recipient")
+		return err
+	}
+	if !s.checkGreylist(recipient) {
+		return nil
+	}
+	if override, ok := s.config.Override(); ok && !bounce {
+		forward = override
+	}
+	if !idna.IsASCII(forward) && !s.relayUTF8() {
+		s.args["recipient"] = recipient
+		s.conn.Reply(553, "5.6.7 Internationalized addresses can not be relayed")
+		s.logger.Println(s.Error("Recipient rejected: relay host does not support SMTPUTF8"))
+		delete(s.args, "recipient")
+		return nil
+	}
+	// Each address is given to the relay host once, as several
+	// recipients can map to the same one, like the override or an
+	// SRS bounce address.
+	if !s.forwarded[forward] {
+		if err := s.relay.Rcpt(forward); err != nil {
+			s.args["recipient"] = recipient
+			err = s.relayReply(err, "Recipient rejected by relay host")
+			delete(s.args, "recipient")
+			return err
+		}
+		s.forwarded[forward] = true
+	}
 	s.recipients = append(s.recipients, recipient)
 	s.args["recipients"] = strings.Join(s.recipients, ", ")
 	s.conn.Reply(250, "Ok")
 	return nil
+}
 
+// checkGreylist returns false if the recipient was greylisted.
+func (s *State) checkGreylist(recipient string) bool {
+	addr, ok := s.conn.RemoteAddr().(*net.TCPAddr)
+	if s.greylist == nil || !ok || s.allowed() {
+		return true
+	}
+	if s.greylist.Check(addr.IP, s.sender, recipient, s.config.GreylistDelay) {
+		return true
+	}
+	s.args["recipient"] = recipient
+	s.conn.Reply(451, "4.7.1 Greylisted, try again later")
+	s.logger.Println(s.Error("Recipient greylisted"))
+	delete(s.args, "recipient")
+	return false
 }
 
 func (s *State) HandleData() error {
-	if s.sender == "" {
+	if !s.transaction {
 		return s.TarpitError("Error: DATA without MAIL")
 	}
 	if len(s.recipients) == 0 {
 		return s.TarpitError("Error: DATA without RCPT")
 	}
-	s.conn.Reply(354, "End data with <CRLF>.<CRLF>")
-	body, err := s.conn.ReadDotBytes(5 * 60)
+	if s.binary || s.chunks != nil {
+		// RFC 3030, sections 3 and 4.2
+		s.conn.Reply(503, "5.5.1 Use BDAT for this message")
+		return nil
+	}
+	if s.listed(config.StageData) {
+		return s.TarpitError("Error: DNSBL check positive")
+	}
+	if err := s.beginData(); err != nil {
+		return s.hookRejected(err)
+	}
+	if s.dkim != nil || s.checkLinks() {
+		return s.relaySpooled()
+	}
+	w, err := s.relayData()
 	if err != nil {
-		s.conn.Reply(501, "You confuse me")
-		s.args["error"] = err.Error()
-		return s.Error("Error reading mail data")
+		return s.relayError(err)
 	}
-	recipients := s.recipients
-	if override, ok := config.OverrideRecipient(); ok {
-		recipients = []string{override}
+	s.conn.Reply(354, "End data with <CRLF>.<CRLF>")
+	data := s.dotReader()
+	body := &readErrorReader{r: data}
+	headers := strings.NewReader(strings.Join(append(s.headers, ""), "\r\n"))
+	if _, err := io.Copy(w, io.MultiReader(headers, body)); err != nil {
+		// We never finish the DATA command, so the relay
+		// discards the partial message.
+		s.abortRelay()
+		if body.err != nil {
+			return s.dataError(body.err)
+		}
+		// The client still sends the rest of the message.
+		io.Copy(io.Discard, body)
+		return s.relayError(err)
 	}
-	if msg, ok := s.blacklist.Check(s.conn.RemoteAddr()); ok {
-		s.args["dnsbl"] = msg
-		return s.TarpitError("Error: DNSBL check positive")
+	s.logLineEnds(data)
+	return s.finishData(w)
+}
+
+// checkSize rejects the message up front if the client declared a
+// size beyond our limit (RFC 1870).
+func (s *State) checkSize(sender string, params map[string]string) bool {
+	value, ok := params["SIZE"]
+	if !ok {
+		return true
 	}
-	if err := smtp.SendMail(config.RelayHost(), nil, s.sender, recipients, body); err != nil {
-		s.args["error"] = err.Error()
-		if protoErr, ok := err.(*textproto.Error); ok {
-			s.conn.Reply(protoErr.Code, "Error delivering the mail")
-			return s.TarpitError("Error delivering mail")
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		s.conn.Reply(501, "5.5.4 Invalid SIZE parameter")
+		return false
+	}
+	if size <= s.config.MaxMessageSize {
+		return true
+	}
+	s.args["sender"] = sender
+	s.args["size"] = value
+	s.conn.Reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+	s.logger.Println(s.Error("Sender rejected: message too large"))
+	delete(s.args, "sender")
+	delete(s.args, "size")
+	return false
+}
+
+// dotReader returns a reader for the message data, with the
+// configured handling of bare line ends.
+func (s *State) dotReader() *smtpd.DotReader {
+	policy := smtpd.NormalizeLineEnds
+	if s.config.BareLineEnds == config.LineEndsReject {
+		policy = smtpd.RejectLineEnds
+	}
+	return s.conn.DotReader(5*60, s.config.MaxMessageSize, policy)
+}
+
+// dataError reports an error reading the message data. Unless the
+// message was just too large, we do not know where it ends, so the
+// session is over.
+func (s *State) dataError(err error) error {
+	s.args["error"] = err.Error()
+	if err == smtpd.ErrMessageTooLarge {
+		s.conn.Reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+		s.logger.Println(s.Error("Message too large"))
+		s.Reset()
+		return nil
+	}
+	if err == smtpd.ErrBareLineEnd {
+		// Like Postfix with smtpd_forbid_bare_newline.
+		s.conn.Reply(521, "5.5.2 Bare CR or LF received, use CRLF")
+		return s.Error("Error: bare line end in mail data")
+	}
+	s.conn.Reply(501, "You confuse me")
+	return s.Error("Error reading mail data")
+}
+
+// logLineEnds logs the bare line ends that were normalized in the
+// message data. A line with a single dot between them looks like an
+// SMTP smuggling attempt, as other servers might end the message
+// there.
+func (s *State) logLineEnds(data *smtpd.DotReader) {
+	cr, lf := data.BareLineEnds()
+	if cr+lf == 0 {
+		return
+	}
+	s.args["bare_cr"] = strconv.Itoa(cr)
+	s.args["bare_lf"] = strconv.Itoa(lf)
+	description := "Bare line ends in mail data"
+	if terminator := data.Terminator(); terminator != "" {
+		s.args["terminator"] = terminator
+		description = "Possible SMTP smuggling in mail data"
+	}
+	s.logger.Println(s.Error(description))
+	delete(s.args, "bare_cr")
+	delete(s.args, "bare_lf")
+	delete(s.args, "terminator")
+}
+
+// beginData runs the DataHooks before the message is received. The
+// error is the rejection by a hook.
+func (s *State) beginData() error {
+	err := s.hooks.checkData(s.Info())
+	if err == nil && s.blacklist.Enabled() {
+		// The lookups for allowed clients are skipped or
+		// cancelled.
+		if description, ok := s.listing.Allowed(); ok {
+			s.results = append(s.results, "x-dnsbl=none reason="+quote(description))
 		} else {
-			s.conn.Reply(450, "Error delivering the mail, try again later")
-			return s.Error("Error delivering mail")
+			s.results = append(s.results, "x-dnsbl=pass")
 		}
 	}
-	fmt.Println(s.Error("Mail sent"))
+	return err
+}
+
+// finishData ends the DATA command, or the last BDAT chunk, after the
+// message was relayed.
+func (s *State) finishData(w io.WriteCloser) error {
+	// Only closing the writer tells us whether the relay
+	// accepted the message.
+	if err := w.Close(); err != nil {
+		return s.relayError(err)
+	}
+	s.closeRelay()
+	s.logger.Println(s.Error("Mail sent"))
 	s.conn.Reply(250, "Ok")
 	s.Reset()
 	return nil
 }
 
+// relayReply passes the relay host's rejection of an envelope
+// command on to the client, so the client's MTA can bounce the
+// message properly. The session goes on. If the relay connection
+// failed instead, the session is ended.
+func (s *State) relayReply(err error, description string) error {
+	s.args["error"] = err.Error()
+	protoErr, ok := err.(*textproto.Error)
+	if !ok {
+		s.conn.Reply(451, "4.4.2 Lost connection to relay host, try again later")
+		return s.Error(description)
+	}
+	s.conn.Reply(protoErr.Code, strings.Split(protoErr.Msg, "\n")...)
+	s.logger.Println(s.Error(description))
+	delete(s.args, "error")
+	return nil
+}
+
+func (s *State) relayError(err error) error {
+	s.args["error"] = err.Error()
+	if protoErr, ok := err.(*textproto.Error); ok {
+		s.conn.Reply(protoErr.Code, "Error delivering the mail")
+		return s.TarpitError("Error delivering mail")
+	} else {
+		s.conn.Reply(450, "Error delivering the mail, try again later")
+		return s.Error("Error delivering mail")
+	}
+}
+
 func hostname() string {
 	name, err := os.Hostname()
 	if err != nil {
@@ -210,7 +748,8 @@ func hostname() string {
 	return name
 }
 
-var mailFrom = regexp.MustCompile("(?i)from:<(.+)>")
+// The sender is empty for bounces.
+var mailFrom = regexp.MustCompile("(?i)from:<(.*)>")
 
 func extractSender(data string) (string, bool) {
 	found := mailFrom.FindStringSubmatch(data)
@@ -220,6 +759,33 @@ func extractSender(data string) (string, bool) {
 	return found[1], true
 }
 
+// extractParameters returns the ESMTP parameters after the address
+// of a MAIL or RCPT command, by upper case keyword (RFC 5321, section
+// 4.1.2).
+func extractParameters(data string) map[string]string {
+	params := map[string]string{}
+	end := strings.LastIndexByte(data, '>')
+	for _, param := range strings.Fields(data[end+1:]) {
+		keyword, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(keyword)] = value
+	}
+	return params
+}
+
+// asciiAddress returns address with its domain in ASCII form (RFC
+// 5890). The local part stays as it is.
+func asciiAddress(address string) string {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return address
+	}
+	domain, err := idna.ToASCII(address[at+1:])
+	if err != nil {
+		return address
+	}
+	return address[:at+1] + domain
+}
+
 var rcptTo = regexp.MustCompile("(?i)to:<(.+)>")
 
 func extractRecipient(data string) (string, bool) {
@@ -229,7 +795,3 @@ func extractRecipient(data string) (string, bool) {
 	}
 	return found[1], true
 }
-
-func isValidRecipient(recipient string) bool {
-	return config.ValidRecipient().MatchString(recipient)
-}
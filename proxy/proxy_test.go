@@ -1,6 +1,13 @@
 package proxy
 
-import "testing"
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestExtractSender(t *testing.T) {
 	var goodCases = map[string]string{
@@ -8,6 +15,7 @@ func TestExtractSender(t *testing.T) {
 		"FROM:<foo@bar.com>":          "foo@bar.com",
 		"FrOm:<foo@bar.com>":          "foo@bar.com",
 		"from:<foo@bar.com> 8BITMIME": "foo@bar.com",
+		"from:<>":                     "",
 	}
 	for k, v := range goodCases {
 		sender, ok := extractSender(k)
@@ -58,3 +66,99 @@ func TestExtractRecipient(t *testing.T) {
 		}
 	}
 }
+
+func TestExtractParameters(t *testing.T) {
+	tests := map[string]map[string]string{
+		"FROM:<foo@bar.com>":                         {},
+		"FROM:<foo@bar.com> size=1024 BODY=8BITMIME": {"SIZE": "1024", "BODY": "8BITMIME"},
+		"FROM:<>  SMTPUTF8":                          {"SMTPUTF8": ""},
+	}
+	for data, expected := range tests {
+		if params := extractParameters(data); !reflect.DeepEqual(params, expected) {
+			t.Errorf("Parsed %#v as %#v, expected %#v", data, params, expected)
+		}
+	}
+}
+
+func TestASCIIAddress(t *testing.T) {
+	tests := map[string]string{
+		"":                   "",
+		"me@test.tld":        "me@test.tld",
+		"jörg@bücher.tld":    "jörg@xn--bcher-kva.tld",
+		"me@mail.Bücher.tld": "me@mail.xn--bcher-kva.tld",
+		"bücher":             "bücher",
+	}
+	for address, expected := range tests {
+		if ascii := asciiAddress(address); ascii != expected {
+			t.Errorf("Converted %#v to %#v, expected %#v", address, ascii, expected)
+		}
+	}
+}
+
+func TestParseBdat(t *testing.T) {
+	tests := []struct {
+		args string
+		size int64
+		last bool
+		ok   bool
+	}{
+		{"1024", 1024, false, true},
+		{"0 last", 0, true, true},
+		{" 12  LAST ", 12, true, true},
+		{"", 0, false, false},
+		{"-1", 0, false, false},
+		{"12 FIRST", 0, false, false},
+		{"12 LAST 13", 0, false, false},
+	}
+	for _, test := range tests {
+		size, last, ok := parseBdat(test.args)
+		if size != test.size || last != test.last || ok != test.ok {
+			t.Errorf("Parsed %#v as %d, %v, %v, expected %d, %v, %v",
+				test.args, size, last, ok, test.size, test.last, test.ok)
+		}
+	}
+}
+
+func TestDialRelayTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { relayTimeout = timeout }(relayTimeout)
+	relayTimeout = 100 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The relay host greets the first connection and answers EHLO,
+	// but never replies to MAIL. The second one is never greeted.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 relay.tld\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "250 relay.tld\r\n")
+		r.ReadString('\n')
+		conn2, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn2.Close()
+		// Wait until the proxy gives up.
+		conn2.Read(make([]byte, 1))
+	}()
+	client, err := DialRelay(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Mail("me@test.tld")
+	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Errorf("Expected a timeout for MAIL, got %#v", err)
+	}
+	_, err = DialRelay(ln.Addr().String())
+	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Errorf("Expected a timeout for the greeting, got %#v", err)
+	}
+}
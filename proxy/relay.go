@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// How long to wait for the connection to the relay host, and for
+// each of its replies. RFC 5321, section 4.5.3.2, recommends five
+// minutes for most replies.
+var (
+	relayDialTimeout = 30 * time.Second
+	relayTimeout     = 5 * time.Minute
+)
+
+// DialRelay connects to the relay host, using STARTTLS if it is
+// offered, the same way smtp.SendMail does. Connecting and each reply
+// of the relay host time out.
+func DialRelay(addr string) (*smtp.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, relayDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	// The deadline for the greeting. Commands set their own.
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	client, err := smtp.NewClient(&deadlineConn{Conn: conn, timeout: relayTimeout}, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// deadlineConn sets a new deadline whenever something is sent, so
+// the relay host has timeout to reply to each command. While the
+// client sends a message, the deadline moves on with each write.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// readErrorReader remembers errors from reading, so they can be
+// told apart from errors writing to the relay in io.Copy().
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// relayBinary returns true if the relay host accepts binary messages,
+// which have to be sent with BDAT (RFC 3030).
+func (s *State) relayBinary() bool {
+	binary, _ := s.relay.Extension("BINARYMIME")
+	chunking, _ := s.relay.Extension("CHUNKING")
+	return binary && chunking
+}
+
+// relayUTF8 returns true if the relay host accepts internationalized
+// addresses (RFC 6531).
+func (s *State) relayUTF8() bool {
+	ok, _ := s.relay.Extension("SMTPUTF8")
+	return ok
+}
+
+// relayMail starts the transaction with the relay host. net/smtp
+// does not know about binary messages, so MAIL is sent by hand for
+// them. Like net/smtp, it adds SMTPUTF8 if the relay host supports
+// it.
+func (s *State) relayMail(sender string, binary bool) error {
+	if !binary {
+		return s.relay.Mail(sender)
+	}
+	params := "BODY=BINARYMIME"
+	if s.relayUTF8() {
+		params += " SMTPUTF8"
+	}
+	id, err := s.relay.Text.Cmd("MAIL FROM:<%s> %s", sender, params)
+	if err != nil {
+		return err
+	}
+	s.relay.Text.StartResponse(id)
+	defer s.relay.Text.EndResponse(id)
+	_, _, err = s.relay.Text.ReadResponse(250)
+	return err
+}
+
+// relayData returns a writer for the message to the relay host.
+// Messages received with BDAT may contain binary data or bare line
+// ends, so they are relayed with BDAT as well if the relay host
+// supports it. Otherwise, bare CRs become line ends, so the relay
+// host does not see <CR>.<CR> (see smtpd.DotReader).
+func (s *State) relayData() (io.WriteCloser, error) {
+	if s.chunks == nil {
+		return s.relay.Data()
+	}
+	if ok, _ := s.relay.Extension("CHUNKING"); ok {
+		return &chunkWriter{text: s.relay.Text}, nil
+	}
+	w, err := s.relay.Data()
+	if err != nil {
+		return nil, err
+	}
+	return &crWriter{w: w}, nil
+}
+
+// The size of the chunks sent to the relay host.
+const chunkSize = 64 * 1024
+
+// chunkWriter sends a message with BDAT commands. Errors from the
+// relay host are of type *textproto.Error, as with net/smtp.
+type chunkWriter struct {
+	text *textproto.Conn
+	buf  []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < chunkSize {
+		return len(p), nil
+	}
+	return len(p), w.send("")
+}
+
+// Close sends the last chunk. The reply tells whether the relay host
+// accepted the message.
+func (w *chunkWriter) Close() error {
+	return w.send(" LAST")
+}
+
+func (w *chunkWriter) send(last string) error {
+	id := w.text.Next()
+	w.text.StartRequest(id)
+	fmt.Fprintf(w.text.W, "BDAT %d%s\r\n", len(w.buf), last)
+	w.text.W.Write(w.buf)
+	err := w.text.W.Flush()
+	w.text.EndRequest(id)
+	w.buf = w.buf[:0]
+	if err != nil {
+		return err
+	}
+	w.text.StartResponse(id)
+	defer w.text.EndResponse(id)
+	_, _, err = w.text.ReadResponse(250)
+	return err
+}
+
+// crWriter turns bare CRs into LFs, which the DotWriter from
+// net/smtp sends as CRLF.
+type crWriter struct {
+	w io.WriteCloser
+	// The last byte was a CR.
+	cr bool
+}
+
+func (w *crWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		switch {
+		case w.cr && b == '\n':
+			out = append(out, '\r')
+		case w.cr:
+			out = append(out, '\n')
+		}
+		w.cr = b == '\r'
+		if !w.cr {
+			out = append(out, b)
+		}
+	}
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *crWriter) Close() error {
+	if w.cr {
+		w.cr = false
+		if _, err := w.w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return w.w.Close()
+}
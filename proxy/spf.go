@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+)
+
+// checkSPF checks whether the client may send mail for sender and
+// applies the configured action. It returns false if the sender was
+// rejected.
+func (s *State) checkSPF(sender string) bool {
+	addr, ok := s.conn.RemoteAddr().(*net.TCPAddr)
+	if s.spf == nil || !ok {
+		return true
+	}
+	result, reason := s.spf.Check(addr.IP, s.helo, sender)
+	s.spfResult = result
+	s.args["spf"] = string(result)
+	if sender != "" {
+		s.results = append(s.results, "spf="+string(result)+" smtp.mailfrom="+sender)
+	} else {
+		s.results = append(s.results, "spf="+string(result)+" smtp.helo="+s.helo)
+	}
+	switch s.config.SPFAction(result) {
+	case config.ActionReject:
+		// RFC 7372 defines the enhanced status codes.
+		switch result {
+		case spf.TempError:
+			s.conn.Reply(451, "4.7.24 SPF check failed temporarily, try again later")
+		case spf.PermError:
+			s.conn.Reply(550, "5.7.24 Invalid SPF record for sender")
+		default:
+			s.conn.Reply(550, "5.7.23 Sender not permitted by SPF ("+string(result)+")")
+		}
+		s.args["error"] = reason
+		s.logger.Println(s.Error("Sender rejected by SPF"))
+		delete(s.args, "error")
+		return false
+	case config.ActionTag:
+		s.headers = append(s.headers, spf.Header(result, reason, addr.IP, s.helo, sender))
+	}
+	return true
+}
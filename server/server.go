@@ -0,0 +1,466 @@
+// Package server implements the SMTP proxy as a server that can be
+// embedded in other programs. Policy decisions can be added with
+// hooks, see the proxy package.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/argerror"
+	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/dkim"
+	"github.com/jorgenschaefer/smtpproxy/dmarc"
+	"github.com/jorgenschaefer/smtpproxy/dnsbl"
+	"github.com/jorgenschaefer/smtpproxy/greylist"
+	"github.com/jorgenschaefer/smtpproxy/proxy"
+	"github.com/jorgenschaefer/smtpproxy/smtpd"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+)
+
+// ErrServerClosed is returned by Serve() after Shutdown() was called.
+var ErrServerClosed = errors.New("server closed")
+
+type Server struct {
+	config     atomic.Pointer[config.Config]
+	recipients proxy.RecipientPolicy
+	dnsbl      *dnsbl.DNSBL
+	rhsbl      *dnsbl.DNSBL
+	spf        *spf.Checker
+	dkim       *dkim.Verifier
+	dmarc      *dmarc.Checker
+	greylist   *greylist.Greylist
+	logger     proxy.Logger
+	hooks      proxy.Hooks
+
+	mu        sync.Mutex
+	closing   bool
+	listeners map[net.Listener]bool
+	serving   sync.WaitGroup
+	sessions  *sessions
+}
+
+type Option func(*Server)
+
+// New returns a server. Without options, it uses the defaults from
+// config.New(), which relay mail for all recipients to nowhere.
+func New(opts ...Option) *Server {
+	s := &Server{
+		logger:    log.New(os.Stdout, "", 0),
+		listeners: map[net.Listener]bool{},
+		sessions:  newSessions(),
+	}
+	s.config.Store(config.New())
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.useLogger(s.Config())
+	return s
+}
+
+// WithConfig replaces the whole configuration.
+func WithConfig(cfg *config.Config) Option {
+	return func(s *Server) {
+		s.config.Store(cfg)
+	}
+}
+
+// WithRelay sets the address of the relay host, including the port.
+func WithRelay(address string) Option {
+	return func(s *Server) {
+		s.modifyConfig(func(cfg *config.Config) {
+			cfg.RelayHost = address
+		})
+	}
+}
+
+// WithTLS enables STARTTLS and implicit TLS listeners.
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(s *Server) {
+		s.modifyConfig(func(cfg *config.Config) {
+			cfg.SetTLS(tlsConfig)
+		})
+	}
+}
+
+// WithRecipientPolicy decides which recipients are accepted, instead
+// of the configured regular expression.
+func WithRecipientPolicy(policy proxy.RecipientPolicy) Option {
+	return func(s *Server) {
+		s.recipients = policy
+	}
+}
+
+// WithDNSBL sets the DNSBL and DNSWL zones to query, the networks of
+// trusted clients, and how to look up addresses and the TXT records
+// with the reasons for listings.
+func WithDNSBL(zones []dnsbl.Zone, allowed []*net.IPNet, lookup, lookupTXT dnsbl.LookupFunction) Option {
+	return func(s *Server) {
+		s.dnsbl = dnsbl.New(zones, allowed, lookup, lookupTXT)
+	}
+}
+
+// WithRHSBL sets the domain-based (RHSBL) zones to query and how to
+// look them up.
+func WithRHSBL(zones []dnsbl.Zone, lookup, lookupTXT dnsbl.LookupFunction) Option {
+	return func(s *Server) {
+		s.rhsbl = dnsbl.New(zones, nil, lookup, lookupTXT)
+	}
+}
+
+// WithSPFResolver checks SPF with resolver instead of DNS. What to do
+// with the results is configured with Config.SPF.
+func WithSPFResolver(resolver spf.Resolver) Option {
+	return func(s *Server) {
+		s.spf = spf.New(resolver)
+	}
+}
+
+// WithDKIMLookup looks up DKIM keys with lookup instead of DNS.
+// Signatures are only verified if Config.VerifyDKIM is set.
+func WithDKIMLookup(lookup dkim.LookupFunction) Option {
+	return func(s *Server) {
+		s.dkim = dkim.New(lookup)
+	}
+}
+
+// WithDMARCLookup looks up DMARC records with lookup instead of DNS.
+// What to do with failing mail is configured with Config.DMARC.
+func WithDMARCLookup(lookup dmarc.LookupFunction) Option {
+	return func(s *Server) {
+		s.dmarc = dmarc.New(lookup)
+	}
+}
+
+// WithARC seals messages with ARC sets from sealer, instead of the
+// configured key.
+func WithARC(sealer *dkim.Sealer) Option {
+	return func(s *Server) {
+		s.modifyConfig(func(cfg *config.Config) {
+			cfg.SetARC(sealer)
+		})
+	}
+}
+
+// WithGreylist greylists recipients. The delay is configured with
+// Config.GreylistDelay.
+func WithGreylist(g *greylist.Greylist) Option {
+	return func(s *Server) {
+		s.greylist = g
+	}
+}
+
+// WithLogger logs to logger instead of standard output.
+func WithLogger(logger proxy.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithHooks adds hooks, which are called after the ones added
+// before.
+func WithHooks(hooks proxy.Hooks) Option {
+	return func(s *Server) {
+		s.hooks.Connect = append(s.hooks.Connect, hooks.Connect...)
+		s.hooks.Helo = append(s.hooks.Helo, hooks.Helo...)
+		s.hooks.Mail = append(s.hooks.Mail, hooks.Mail...)
+		s.hooks.Rcpt = append(s.hooks.Rcpt, hooks.Rcpt...)
+		s.hooks.Data = append(s.hooks.Data, hooks.Data...)
+	}
+}
+
+func (s *Server) modifyConfig(modify func(cfg *config.Config)) {
+	cfg := *s.config.Load()
+	modify(&cfg)
+	s.config.Store(&cfg)
+}
+
+// Config returns the current configuration.
+func (s *Server) Config() *config.Config {
+	return s.config.Load()
+}
+
+// SetConfig replaces the configuration for new sessions. Running
+// sessions finish with the configuration they started with.
+func (s *Server) SetConfig(cfg *config.Config) {
+	s.useLogger(cfg)
+	s.config.Store(cfg)
+}
+
+// useLogger makes the certificate manager of cfg log to the server's
+// logger.
+func (s *Server) useLogger(cfg *config.Config) {
+	if certs, ok := cfg.Certificates(); ok {
+		certs.SetLogger(s.logger)
+	}
+}
+
+// LearnRelaySize asks the relay host for its SIZE limit (RFC 1870)
+// and lowers the maximum message size to it, so clients learn about
+// the limit before sending the message. It returns the maximum
+// message size in use. If the configuration is replaced in the
+// meantime, the new one is kept.
+func (s *Server) LearnRelaySize() (int64, error) {
+	cfg := s.Config()
+	client, err := proxy.DialRelay(cfg.RelayHost)
+	if err != nil {
+		return cfg.MaxMessageSize, err
+	}
+	defer client.Close()
+	ok, param := client.Extension("SIZE")
+	client.Quit()
+	if !ok {
+		return cfg.MaxMessageSize, nil
+	}
+	size, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || size < 0 {
+		return cfg.MaxMessageSize, fmt.Errorf("Invalid SIZE limit %#v", param)
+	}
+	// A limit of 0 means there is none.
+	if size == 0 || size >= cfg.MaxMessageSize {
+		return cfg.MaxMessageSize, nil
+	}
+	lowered := *cfg
+	lowered.MaxMessageSize = size
+	if !s.config.CompareAndSwap(cfg, &lowered) {
+		return s.Config().MaxMessageSize, errors.New("Configuration changed while querying the relay host")
+	}
+	return size, nil
+}
+
+// ListenAndServe listens on all listeners from the configuration and
+// serves them until ctx is done or Shutdown() is called.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listeners := s.Config().Listeners()
+	opened := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ln, err := listenOn(l)
+		if err != nil {
+			for _, ln := range opened {
+				ln.Close()
+			}
+			return fmt.Errorf("Error listening on %s: %v", l, err)
+		}
+		opened = append(opened, ln)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, ln := range opened {
+		go func(ln net.Listener, role config.Role) {
+			errs <- s.ServeRole(ctx, ln, role)
+		}(ln, listeners[i].Role)
+	}
+	var result error
+	for range opened {
+		err := <-errs
+		if err != nil && err != ErrServerClosed && result == nil {
+			result = err
+			// Take the other listeners down as well.
+			for _, ln := range opened {
+				ln.Close()
+			}
+		}
+	}
+	return result
+}
+
+func listenOn(l config.Listener) (net.Listener, error) {
+	if l.Address != "" {
+		return net.Listen("tcp", l.Address)
+	} else {
+		f := os.NewFile(l.FD, "LISTEN_FD")
+		defer f.Close()
+		return net.FileListener(f)
+	}
+}
+
+// Serve accepts plain SMTP connections on ln until ctx is done or
+// Shutdown() is called. Listeners from tls.NewListener() are treated
+// as implicit TLS.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	return s.ServeRole(ctx, ln, config.RoleSMTP)
+}
+
+// ServeRole accepts connections on ln with the given role until ctx
+// is done or Shutdown() is called. It returns nil when ctx is done,
+// and ErrServerClosed after Shutdown().
+func (s *Server) ServeRole(ctx context.Context, ln net.Listener, role config.Role) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = true
+	s.serving.Add(1)
+	s.mu.Unlock()
+	defer s.serving.Done()
+
+	s.logger.Println(argerror.New("SMTP proxy started", map[string]string{
+		"address": ln.Addr().String(),
+		"role":    string(role),
+	}))
+	defer s.logger.Println(argerror.New("SMTP proxy stopped", map[string]string{
+		"address": ln.Addr().String(),
+	}))
+
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			delete(s.listeners, ln)
+			closing := s.closing
+			s.mu.Unlock()
+			switch {
+			case closing:
+				return ErrServerClosed
+			case ctx.Err() != nil:
+				return nil
+			default:
+				ln.Close()
+				return err
+			}
+		}
+		// New sessions use the current configuration. Running
+		// sessions keep theirs.
+		cfg := s.Config()
+		if role != config.RoleSMTPS {
+			c := smtpd.NewConnection(conn)
+			s.sessions.add(c)
+			go func() {
+				defer s.sessions.done(c)
+				s.handleConnection(c, cfg, role)
+			}()
+			continue
+		}
+		// The handshake runs in the session's goroutine, so a
+		// slow client does not block Accept().
+		s.sessions.handshake(conn)
+		go func(conn net.Conn) {
+			tlsConfig, _ := cfg.TLS()
+			tlsconn, err := s.handshake(conn, tlsConfig)
+			if err != nil {
+				s.sessions.handshakeDone(conn)
+				return
+			}
+			c := smtpd.NewConnection(tlsconn)
+			s.sessions.add(c)
+			s.sessions.handshakeDone(conn)
+			defer s.sessions.done(c)
+			s.handleConnection(c, cfg, role)
+		}(conn)
+	}
+}
+
+// handshakeTimeout limits the TLS handshake on the SMTPS listener,
+// so clients that never send a ClientHello do not keep a session.
+var handshakeTimeout = 30 * time.Second
+
+// handshake starts implicit TLS on conn. The connection is closed if
+// the handshake fails.
+func (s *Server) handshake(conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tlsconn := tls.Server(conn, cfg)
+	tlsconn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsconn.Handshake(); err != nil {
+		s.logger.Println(argerror.New("TLS handshake failed", map[string]string{
+			"client": conn.RemoteAddr().String(),
+			"error":  err.Error(),
+		}))
+		conn.Close()
+		return nil, err
+	}
+	tlsconn.SetDeadline(time.Time{})
+	return tlsconn, nil
+}
+
+// Shutdown stops accepting connections and ends all sessions
+// gracefully: Idle sessions get a 421 reply and tarpits are released,
+// while sessions relaying a message may finish. When ctx is done
+// before that, the remaining connections are closed and ctx.Err() is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+	// Make sure no new sessions are started before shutting down
+	// the running ones.
+	s.serving.Wait()
+	if closed := s.sessions.shutdown(ctx); closed > 0 {
+		s.logger.Println(argerror.New("Closed sessions after shutdown timeout",
+			map[string]string{"sessions": fmt.Sprintf("%d", closed)}))
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *Server) handleConnection(conn smtpd.Connection, cfg *config.Config, role config.Role) {
+	defer conn.Close()
+	// Replies to pipelined commands may still be buffered.
+	defer conn.Flush()
+	s.logger.Println(argerror.New("New connection",
+		map[string]string{"client": conn.RemoteAddr().String()}))
+	defer s.logger.Println(argerror.New("Connection finished",
+		map[string]string{"client": conn.RemoteAddr().String()}))
+	state, err := proxy.Greet(conn, proxy.Options{
+		Config:     cfg,
+		Role:       role,
+		Recipients: s.recipients,
+		DNSBL:      s.dnsbl,
+		RHSBL:      s.rhsbl,
+		SPF:        s.spf,
+		DKIM:       s.dkim,
+		DMARC:      s.dmarc,
+		Greylist:   s.greylist,
+		Logger:     s.logger,
+		Hooks:      s.hooks,
+	})
+	if err != nil {
+		s.logger.Println(err.Error())
+		s.maybeTarpit(err, conn)
+		return
+	}
+	defer state.Close()
+	for {
+		if err := state.HandleCommand(); err != nil {
+			s.logger.Println(err.Error())
+			s.maybeTarpit(err, conn)
+			return
+		}
+	}
+}
+
+func (s *Server) maybeTarpit(err error, conn smtpd.Connection) {
+	_, ok := err.(proxy.TarpitError)
+	if ok {
+		args := map[string]string{
+			"client": conn.RemoteAddr().String(),
+		}
+		bytesread, duration, err := conn.Tarpit()
+		args["bytesread"] = fmt.Sprintf("%d", bytesread)
+		args["duration"] = duration.String()
+		args["error"] = err.Error()
+		s.logger.Println(argerror.New("Client escaped tarpit", args))
+	}
+}
@@ -0,0 +1,1496 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/config"
+	"github.com/jorgenschaefer/smtpproxy/dkim"
+	"github.com/jorgenschaefer/smtpproxy/dnsbl"
+	"github.com/jorgenschaefer/smtpproxy/greylist"
+	"github.com/jorgenschaefer/smtpproxy/internal/testcert"
+	"github.com/jorgenschaefer/smtpproxy/proxy"
+	"github.com/jorgenschaefer/smtpproxy/spf"
+	"github.com/jorgenschaefer/smtpproxy/srs"
+)
+
+func TestSMTPProxy(t *testing.T) {
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Error(err)
+	}
+	var buf bytes.Buffer
+	relayDone := serveMail(smtpln, &buf)
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	cfg := loadConfig(t)
+	proxyAddr := startProxy(t, New(WithConfig(cfg)), config.RoleSMTP)
+	// Send mail to the proxy server
+	err = smtp.SendMail(proxyAddr, nil, "me@test.tld",
+		[]string{"you@test.tld"}, []byte("Hello"))
+	if err != nil {
+		t.Error(err)
+	}
+	<-relayDone
+	data := buf.String()
+	expected := "EHLO localhost\r\nMAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
+	if data != expected {
+		t.Errorf("Expected a mail, got %#v", data)
+	}
+}
+
+func TestSMTPProxyStartTLS(t *testing.T) {
+	certFile, keyFile, certPEM, err := testcert.WriteFiles(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := serveMail(smtpln, &buf)
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("SERVER_CERT", certFile)
+	t.Setenv("SERVER_KEY", keyFile)
+	cfg := loadConfig(t)
+	proxyAddr := startProxy(t, New(WithConfig(cfg)), config.RoleSMTP)
+	// Send mail to the proxy server over TLS
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("Expected STARTTLS to be advertised")
+	}
+	err = c.StartTLS(&tls.Config{ServerName: "localhost", RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("Did not expect STARTTLS to be advertised after STARTTLS")
+	}
+	if state, ok := c.TLSConnectionState(); !ok || !state.HandshakeComplete {
+		t.Error("Expected a completed TLS handshake")
+	}
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	data := buf.String()
+	expected := "EHLO localhost\r\nMAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
+	if data != expected {
+		t.Errorf("Expected a mail, got %#v", data)
+	}
+}
+
+func TestSMTPProxyImplicitTLS(t *testing.T) {
+	certFile, keyFile, certPEM, err := testcert.WriteFiles(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := serveMail(smtpln, &buf)
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("SERVER_CERT", certFile)
+	t.Setenv("SERVER_KEY", keyFile)
+	cfg := loadConfig(t)
+	proxyAddr := startProxy(t, New(WithConfig(cfg)), config.RoleSMTPS)
+	// Send mail to the proxy server over TLS
+	conn, err := tls.Dial("tcp", proxyAddr,
+		&tls.Config{ServerName: "localhost", RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("Did not expect STARTTLS to be advertised on implicit TLS")
+	}
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	data := buf.String()
+	expected := "EHLO localhost\r\nMAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
+	if data != expected {
+		t.Errorf("Expected a mail, got %#v", data)
+	}
+}
+
+func TestSMTPProxyHandshakeTimeout(t *testing.T) {
+	certFile, keyFile, _, err := testcert.WriteFiles(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELAY_HOST", "localhost:25")
+	t.Setenv("SERVER_CERT", certFile)
+	t.Setenv("SERVER_KEY", keyFile)
+	cfg := loadConfig(t)
+	// Clients that never send a ClientHello must not delay the
+	// shutdown
+	srv := New(WithConfig(cfg))
+	proxyAddr := startProxy(t, srv, config.RoleSMTPS)
+	silent, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected the shutdown not to wait for the handshake, got %v", err)
+	}
+
+	// Nor keep their connection
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 100 * time.Millisecond
+	proxyAddr = startProxy(t, New(WithConfig(cfg)), config.RoleSMTPS)
+	silent, err = net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestSMTPProxyMessageTooLarge(t *testing.T) {
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("MAX_MESSAGE_SIZE", "1024")
+	cfg := loadConfig(t)
+	proxyAddr := startProxy(t, New(WithConfig(cfg)), config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, size := c.Extension("SIZE"); !ok || size != "1024" {
+		t.Errorf("Expected SIZE 1024 to be advertised, got %#v", size)
+	}
+	// A declared size is checked right away
+	id, err := c.Text.Cmd("MAIL FROM:<me@test.tld> SIZE=2048")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(552)
+	c.Text.EndResponse(id)
+	if err != nil {
+		t.Errorf("Expected the declared size to be rejected, got %#v", err)
+	}
+	// Send a large mail to the proxy server
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(bytes.Repeat([]byte("0123456789abcdef\r\n"), 1024))
+	err = w.Close()
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 552 {
+		t.Errorf("Expected the mail to be rejected, got %#v", err)
+	}
+	// The session goes on
+	if err := c.Quit(); err != nil {
+		t.Errorf("Expected no error, got %#v", err)
+	}
+	<-relayDone
+	data := buf.String()
+	if strings.Contains(data, "\r\n.\r\n") {
+		t.Errorf("Expected the relay not to receive a complete mail, got %#v", data)
+	}
+}
+
+func TestLearnRelaySize(t *testing.T) {
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	go func() {
+		readMailScript(smtpln, &buf, "220 Hi\r\n250-Hi\r\n250 SIZE 1000\r\n221 Ok\r\n")
+		readMailScript(smtpln, &buf, "220 Hi\r\n250-Hi\r\n250 SIZE 0\r\n221 Ok\r\n")
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	srv := New(WithConfig(loadConfig(t)))
+	size, err := srv.LearnRelaySize()
+	if err != nil || size != 1000 || srv.Config().MaxMessageSize != 1000 {
+		t.Errorf("Expected the relay's limit, got %d, %v", size, err)
+	}
+	// No limit
+	srv = New(WithConfig(loadConfig(t)))
+	size, err = srv.LearnRelaySize()
+	if err != nil || size != config.DefaultMaxMessageSize {
+		t.Errorf("Expected the default limit, got %d, %v", size, err)
+	}
+}
+
+func TestLearnRelaySizeReload(t *testing.T) {
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	srv := New(WithConfig(loadConfig(t)))
+	reloaded := loadConfig(t)
+	go func() {
+		conn, err := smtpln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The configuration is replaced while the relay host is
+		// asked.
+		srv.SetConfig(reloaded)
+		fmt.Fprint(conn, "220 Hi\r\n250-Hi\r\n250 SIZE 1000\r\n221 Ok\r\n")
+		io.Copy(io.Discard, conn)
+	}()
+	size, err := srv.LearnRelaySize()
+	if err == nil || size != config.DefaultMaxMessageSize || srv.Config() != reloaded {
+		t.Errorf("Expected the new configuration to be kept, got %d, %v", size, err)
+	}
+}
+
+func TestSMTPProxyRecipientRejected(t *testing.T) {
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &buf, "220 Hi\r\n250 Ok\r\n250 Ok\r\n"+
+			"550-5.1.1 No such user\r\n550 5.1.1 Really\r\n250 Ok\r\n"+
+			"354 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	cfg := loadConfig(t)
+	proxyAddr := startProxy(t, New(WithConfig(cfg)), config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("nobody@test.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 ||
+		protoErr.Msg != "5.1.1 No such user\n5.1.1 Really" {
+		t.Errorf("Expected the relay's rejection, got %#v", err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	data := buf.String()
+	expected := "EHLO localhost\r\nMAIL FROM:<me@test.tld>\r\nRCPT TO:<nobody@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
+	if data != expected {
+		t.Errorf("Expected a mail, got %#v", data)
+	}
+}
+
+type rejectRecipient string
+
+func (r rejectRecipient) CheckRcpt(info proxy.Info, recipient string) error {
+	if recipient == string(r) {
+		return &proxy.Reply{Code: 550, Message: "5.7.1 Not this one"}
+	}
+	return nil
+}
+
+func TestServerHooks(t *testing.T) {
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	cfg := config.New()
+	cfg.GreetingDelay = 1
+	srv := New(WithConfig(cfg), WithRelay(smtpln.Addr().String()),
+		WithHooks(proxy.Hooks{
+			Rcpt: []proxy.RcptHook{rejectRecipient("spam@test.tld")},
+		}))
+	proxyAddr := startProxy(t, srv, config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("spam@test.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 ||
+		protoErr.Msg != "5.7.1 Not this one" {
+		t.Errorf("Expected the hook's rejection, got %#v", err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	data := buf.String()
+	expected := "EHLO localhost\r\nMAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
+	if data != expected {
+		t.Errorf("Expected a mail, got %#v", data)
+	}
+}
+
+type failConnect struct{}
+
+func (failConnect) CheckConnect(info proxy.Info) error {
+	return errors.New("database unavailable")
+}
+
+func TestServerConnectHookError(t *testing.T) {
+	cfg := config.New()
+	cfg.GreetingDelay = 1
+	srv := New(WithConfig(cfg), WithRelay("127.0.0.1:1"),
+		WithHooks(proxy.Hooks{
+			Connect: []proxy.ConnectHook{failConnect{}},
+		}))
+	proxyAddr := startProxy(t, srv, config.RoleSMTP)
+	c, err := textproto.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Only 220, 421 and 554 are valid instead of a greeting.
+	code, msg, err := c.ReadResponse(0)
+	if code != 421 || msg != "4.3.0 Temporary failure, try again later" {
+		t.Errorf("Expected 421, got %d %s (%v)", code, msg, err)
+	}
+}
+
+func TestServerSPF(t *testing.T) {
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	cfg := loadConfig(t)
+	cfg.SPF = map[string]config.Action{
+		"fail":     config.ActionReject,
+		"softfail": config.ActionTag,
+	}
+	records := map[string]string{
+		"fail.tld": "v=spf1 -all",
+		"soft.tld": "v=spf1 ~all",
+	}
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+	srv := New(WithConfig(cfg), WithSPFResolver(spf.Resolver{
+		TXT: func(name string) ([]string, error) {
+			if record, ok := records[name]; ok {
+				return []string{record}, nil
+			}
+			return nil, notFound
+		},
+	}))
+	proxyAddr := startProxy(t, srv, config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Mail("me@fail.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 {
+		t.Errorf("Expected the sender to be rejected, got %#v", err)
+	}
+	if err := c.Mail("me@soft.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	data := buf.String()
+	if !strings.HasPrefix(data, "EHLO localhost\r\nMAIL FROM:<me@soft.tld>\r\n") {
+		t.Errorf("Expected only the second sender to be relayed, got %#v", data)
+	}
+	if !strings.Contains(data, "DATA\r\nReceived-SPF: softfail (soft.tld: ~all matched) client-ip=") ||
+		!strings.Contains(data, "\r\nHello\r\n.\r\n") {
+		t.Errorf("Expected a Received-SPF header, got %#v", data)
+	}
+}
+
+func TestServerDKIM(t *testing.T) {
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	cfg := loadConfig(t)
+	cfg.VerifyDKIM = true
+	cfg.AuthservID = "mx.test.tld"
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyHash := sha256.Sum256([]byte("Hello\r\n"))
+	signature := "DKIM-Signature: v=1; a=ed25519-sha256; d=test.tld; s=sel; h=From; bh=" +
+		base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	headerHash := sha256.Sum256([]byte("From: me@test.tld\r\n" + signature))
+	signature += base64.StdEncoding.EncodeToString(ed25519.Sign(key, headerHash[:]))
+	srv := New(WithConfig(cfg), WithDKIMLookup(func(name string) ([]string, error) {
+		if name != "sel._domainkey.test.tld" {
+			return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+		}
+		return []string{"k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	}))
+	proxyAddr := startProxy(t, srv, config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Authentication-Results: mx.test.tld; dkim=pass\r\n"+
+		signature+"\r\nFrom: me@test.tld\r\n\r\nHello\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	data := buf.String()
+	expected := "DATA\r\nAuthentication-Results: mx.test.tld;\r\n" +
+		"\tdkim=pass header.d=test.tld header.s=sel header.b=\"" + signature[len(signature)-88:][:8] + "\"\r\n" +
+		signature + "\r\nFrom: me@test.tld\r\n\r\nHello\r\n.\r\n"
+	if !strings.Contains(data, expected) {
+		t.Errorf("Expected a verified message %#v, got %#v", expected, data)
+	}
+}
+
+func TestServerARC(t *testing.T) {
+	// Start relay
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	cfg := loadConfig(t)
+	cfg.AuthservID = "mx.test.tld"
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, err := dkim.NewSealer("test.tld", "arc", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(name string) ([]string, error) {
+		if name != "arc._domainkey.test.tld" {
+			return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+		}
+		return []string{"k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	}
+	srv := New(WithConfig(cfg), WithARC(sealer), WithDKIMLookup(lookup))
+	proxyAddr := startProxy(t, srv, config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "From: me@test.tld\r\nSubject: Hi\r\n\r\nHello\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	data := buf.String()
+	start := strings.Index(data, "DATA\r\n") + len("DATA\r\n")
+	end := strings.Index(data, "\r\n.\r\n")
+	if start < len("DATA\r\n") || end < start {
+		t.Fatalf("Expected a message, got %#v", data)
+	}
+	msg := data[start : end+2]
+	if !strings.HasPrefix(msg, "ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=test.tld; s=arc;") ||
+		!strings.Contains(msg, "\r\nAuthentication-Results: mx.test.tld;\r\n\tdkim=none;\r\n\tarc=none\r\n") {
+		t.Errorf("Expected a sealed message, got %#v", msg)
+	}
+	chain, err := dkim.New(lookup).VerifyChain(strings.NewReader(msg))
+	if err != nil || chain.Result != dkim.Pass || chain.Instance != 1 {
+		t.Errorf("Expected the relayed chain to pass, got %#v, %v", chain, err)
+	}
+}
+
+func TestServerDMARC(t *testing.T) {
+	// Start relay, which gets a rejected and a quarantined mail
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected, quarantined bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &rejected, "220 Hi\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		readMail(smtpln, &quarantined)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("DMARC_ACTIONS", "reject=reject quarantine=tag")
+	cfg := loadConfig(t)
+	cfg.AuthservID = "mx.test.tld"
+	records := map[string]string{
+		"reject.tld":            "v=spf1 -all",
+		"quarantine.tld":        "v=spf1 -all",
+		"_dmarc.reject.tld":     "v=DMARC1; p=reject",
+		"_dmarc.quarantine.tld": "v=DMARC1; p=quarantine",
+	}
+	lookup := func(name string) ([]string, error) {
+		if record, ok := records[name]; ok {
+			return []string{record}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	}
+	srv := New(WithConfig(cfg), WithSPFResolver(spf.Resolver{TXT: lookup}),
+		WithDKIMLookup(lookup), WithDMARCLookup(lookup))
+	proxyAddr := startProxy(t, srv, config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	send := func(domain string) error {
+		if err := c.Mail("me@" + domain); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt("you@test.tld"); err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(w, "From: me@"+domain+"\r\n\r\nHello\r\n")
+		return w.Close()
+	}
+	err = send("reject.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 ||
+		!strings.HasPrefix(protoErr.Msg, "5.7.1 ") {
+		t.Errorf("Expected the message to be rejected, got %#v", err)
+	}
+	if err := send("quarantine.tld"); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+
+	if strings.Contains(rejected.String(), "DATA") {
+		t.Errorf("Expected the rejected message not to be relayed, got %#v", rejected.String())
+	}
+	expected := "DATA\r\nAuthentication-Results: mx.test.tld;\r\n" +
+		"\tspf=fail smtp.mailfrom=me@quarantine.tld;\r\n" +
+		"\tdkim=none;\r\n" +
+		"\tdmarc=fail (p=quarantine dis=quarantine) header.from=quarantine.tld\r\n" +
+		"X-Quarantine: DMARC policy of quarantine.tld\r\n" +
+		"From: me@quarantine.tld\r\n"
+	if !strings.Contains(quarantined.String(), expected) {
+		t.Errorf("Expected a quarantined message %#v, got %#v", expected, quarantined.String())
+	}
+}
+
+func TestServerGreylist(t *testing.T) {
+	// Start relay, which only gets the retried mail
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var greylisted, retried bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &greylisted, "220 Hi\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		readMail(smtpln, &retried)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("GREYLIST_DELAY", "0s")
+	cfg := loadConfig(t)
+	g, err := greylist.Open(filepath.Join(t.TempDir(), "greylist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	proxyAddr := startProxy(t, New(WithConfig(cfg), WithGreylist(g)), config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("you@test.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 451 {
+		t.Errorf("Expected the recipient to be greylisted, got %#v", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	if strings.Contains(greylisted.String(), "RCPT") {
+		t.Errorf("Expected the greylisted recipient not to be relayed, got %#v", greylisted.String())
+	}
+	if !strings.Contains(retried.String(), "RCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n") {
+		t.Errorf("Expected the retry to be relayed, got %#v", retried.String())
+	}
+}
+
+func TestServerDNSBL(t *testing.T) {
+	// Start relay, which gets no recipient
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &buf, "220 Hi\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	// Both zones list every client, which is enough together
+	t.Setenv("DNSBL_THRESHOLD", "1.5")
+	zones := []dnsbl.Zone{{Name: "rbl.tld"}}
+	pbl, _ := dnsbl.ParseZone("pbl.tld=127.0.0.10:0.5")
+	zones = append(zones, pbl)
+	lookup := func(ctx context.Context, name string) ([]string, error) {
+		if strings.HasSuffix(name, ".pbl.tld.") {
+			return []string{"127.0.0.10"}, nil
+		}
+		return []string{"127.0.0.2"}, nil
+	}
+	lookupTXT := func(ctx context.Context, name string) ([]string, error) {
+		return []string{"Listed, see https://rbl.tld/\r\n"}, nil
+	}
+
+	// The lookups run during the greeting delay.
+	slow := func(ctx context.Context, name string) ([]string, error) {
+		time.Sleep(800 * time.Millisecond)
+		return lookup(ctx, name)
+	}
+
+	t.Setenv("DNSBL_REJECT", "connect")
+	proxyAddr := startProxy(t, New(WithConfig(loadConfig(t)),
+		WithDNSBL(zones, nil, slow, lookupTXT)), config.RoleSMTP)
+	// The rejection ends the greeting, after the delay.
+	rejected, err := textproto.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for _, expected := range []string{
+		"220-",
+		"554 5.7.1 Client host blocked by DNSBL: Listed, see https://rbl.tld/",
+	} {
+		line, err := rejected.ReadLine()
+		if err != nil || !strings.HasPrefix(line, expected) {
+			t.Errorf("Expected %#v, got %#v, %v", expected, line, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 1500*time.Millisecond {
+		t.Errorf("Expected the rejection after the greeting delay, got it after %s", elapsed)
+	}
+	rejected.Close()
+
+	// Refused queries do not count
+	refused := func(ctx context.Context, name string) ([]string, error) {
+		return []string{"127.255.255.254"}, nil
+	}
+	proxyAddr = startProxy(t, New(WithConfig(loadConfig(t)),
+		WithDNSBL(zones, nil, refused, lookupTXT)), config.RoleSMTP)
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatalf("Expected the client to be accepted, got %#v", err)
+	}
+	c.Close()
+
+	t.Setenv("DNSBL_REJECT", "rcpt")
+	proxyAddr = startProxy(t, New(WithConfig(loadConfig(t)),
+		WithDNSBL(zones, nil, lookup, nil)), config.RoleSMTP)
+	c, err = smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("you@test.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 {
+		t.Errorf("Expected the recipient to be rejected, got %#v", err)
+	}
+	c.Quit()
+	<-relayDone
+	if strings.Contains(buf.String(), "RCPT") {
+		t.Errorf("Expected no recipient to be relayed, got %#v", buf.String())
+	}
+}
+
+func TestServerRHSBL(t *testing.T) {
+	// Start relay, which gets only the second message
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected, relayed bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &rejected, "220 Hi\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		readMail(smtpln, &relayed)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("RHSBL_BODY", "true")
+	lookup := func(ctx context.Context, name string) ([]string, error) {
+		if name == "spam.tld.dbl.tld." {
+			return []string{"127.0.1.2"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	proxyAddr := startProxy(t, New(WithConfig(loadConfig(t)),
+		WithRHSBL([]dnsbl.Zone{{Name: "dbl.tld"}}, lookup, nil)), config.RoleSMTP)
+
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Hello("Spam.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 {
+		t.Errorf("Expected the HELO name to be rejected, got %#v", err)
+	}
+	c.Close()
+
+	c, err = smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Mail("me@spam.tld")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 {
+		t.Errorf("Expected the sender to be rejected, got %#v", err)
+	}
+	send := func(body string) error {
+		if err := c.Mail("me@test.tld"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt("you@test.tld"); err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(w, body)
+		return w.Close()
+	}
+	err = send("Buy at http://spam.tld/")
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 {
+		t.Errorf("Expected the message to be rejected, got %#v", err)
+	}
+	if err := send("Subject: Hi\r\n\r\nSee https://ham.tld/"); err != nil {
+		t.Error(err)
+	}
+	c.Quit()
+	<-relayDone
+	if strings.Contains(rejected.String(), "DATA") {
+		t.Errorf("Expected the rejected message not to be relayed, got %#v", rejected.String())
+	}
+	if !strings.Contains(relayed.String(), "DATA\r\nSubject: Hi\r\n\r\nSee https://ham.tld/\r\n.\r\n") {
+		t.Errorf("Expected the message to be relayed, got %#v", relayed.String())
+	}
+}
+
+func TestServerBareLineEnds(t *testing.T) {
+	// Start relay, which gets both messages
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var normalized, rejected bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &normalized)
+		readMail(smtpln, &rejected)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	send := func(proxyAddr, data string, code int) {
+		c, err := textproto.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		expect := func(code int) {
+			t.Helper()
+			if _, _, err := c.ReadResponse(code); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect(220)
+		for _, command := range []string{"EHLO localhost", "MAIL FROM:<me@test.tld>", "RCPT TO:<you@test.tld>"} {
+			c.PrintfLine("%s", command)
+			expect(250)
+		}
+		c.PrintfLine("DATA")
+		expect(354)
+		fmt.Fprint(c.W, data)
+		c.W.Flush()
+		expect(code)
+	}
+	// Other servers might take <LF>.<LF> for the end of data, and
+	// the rest for another message.
+	data := "Hi\n.\nMAIL FROM:<evil@test.tld>\r\n.\r\n"
+	send(startProxy(t, New(WithConfig(loadConfig(t))), config.RoleSMTP), data, 250)
+	t.Setenv("BARE_LINE_ENDS", "reject")
+	send(startProxy(t, New(WithConfig(loadConfig(t))), config.RoleSMTP), data, 521)
+	<-relayDone
+	if !strings.Contains(normalized.String(), "DATA\r\nHi\r\n..\r\nMAIL FROM:<evil@test.tld>\r\n.\r\n") {
+		t.Errorf("Expected the dot to be escaped for the relay, got %#v", normalized.String())
+	}
+	if strings.Contains(rejected.String(), "evil") {
+		t.Errorf("Expected the message not to be relayed, got %#v", rejected.String())
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	// Start relay, which gets the first message, and the
+	// envelope of the last one
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf, across bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &buf)
+		readMailScript(smtpln, &across, "220 Hi\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	proxyAddr := startProxy(t, New(WithConfig(loadConfig(t))), config.RoleSMTP)
+	dial := func() *textproto.Conn {
+		c, err := textproto.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	send := func(c *textproto.Conn, commands string, codes ...int) {
+		t.Helper()
+		fmt.Fprint(c.W, commands)
+		c.W.Flush()
+		for _, code := range codes {
+			if _, _, err := c.ReadResponse(code); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := dial()
+	defer c.Close()
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil || !strings.Contains(msg, "\nPIPELINING\n") {
+		t.Errorf("Expected PIPELINING to be offered, got %#v, %v", msg, err)
+	}
+	send(c, "MAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\n", 250, 250, 354)
+	send(c, "Hello\r\n.\r\nQUIT\r\n", 250, 221)
+
+	// Clients may not pipeline before EHLO, or across DATA
+	c = dial()
+	defer c.Close()
+	send(c, "EHLO localhost\r\nMAIL FROM:<me@test.tld>\r\n", 554)
+	c = dial()
+	send(c, "EHLO localhost\r\n", 250)
+	send(c, "MAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n", 250, 250, 554)
+	c.Close()
+
+	<-relayDone
+	if !strings.Contains(buf.String(), "DATA\r\nHello\r\n.\r\n") {
+		t.Errorf("Expected the message to be relayed, got %#v", buf.String())
+	}
+	if strings.Contains(across.String(), "DATA") {
+		t.Errorf("Expected the last message not to be relayed, got %#v", across.String())
+	}
+}
+
+func TestServerChunking(t *testing.T) {
+	// Start relays: one with CHUNKING, one without, which rejects
+	// the binary message, and one that gets it with DATA
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunked, rejected, buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &chunked, "220 Hi\r\n250-Hi\r\n250-CHUNKING\r\n250 BINARYMIME\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		readMailScript(smtpln, &rejected, "220 Hi\r\n250 Ok\r\n221 Ok\r\n")
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	proxyAddr := startProxy(t, New(WithConfig(loadConfig(t))), config.RoleSMTP)
+	c, err := textproto.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	send := func(commands string, codes ...int) {
+		t.Helper()
+		fmt.Fprint(c.W, commands)
+		c.W.Flush()
+		for _, code := range codes {
+			if _, _, err := c.ReadResponse(code); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send("", 220)
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil || !strings.Contains(msg, "\nCHUNKING\n") {
+		t.Errorf("Expected CHUNKING to be offered, got %#v, %v", msg, err)
+	}
+
+	// The chunk is skipped without a transaction
+	send("BDAT 3\r\nabc", 503)
+	send("MAIL FROM:<me@test.tld> BODY=BINARYMIME\r\nRCPT TO:<you@test.tld>\r\n", 250, 250)
+	send("DATA\r\n", 503)
+	send("BDAT 6\r\nHello\nBDAT 5 LAST\r\n\x00\r.\r\n", 250, 250)
+
+	// Without CHUNKING, text messages are relayed with DATA
+	send("MAIL FROM:<me@test.tld> BODY=BINARYMIME\r\n", 554)
+	send("MAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\n", 250, 250)
+	send("BDAT 4\r\nHi\r\nBDAT 7 LAST\r\n.\rBye\r\n", 250, 250)
+	send("QUIT\r\n", 221)
+
+	<-relayDone
+	if !strings.Contains(chunked.String(), " BODY=BINARYMIME\r\n") {
+		t.Errorf("Expected a binary message to be relayed, got %#v", chunked.String())
+	}
+	if !strings.Contains(chunked.String(), " LAST\r\n") || !strings.Contains(chunked.String(), "Hello\n\x00\r.\r\nQUIT") {
+		t.Errorf("Expected the message to be relayed in one chunk, got %#v", chunked.String())
+	}
+	if strings.Contains(rejected.String(), "MAIL") {
+		t.Errorf("Expected the binary message not to be relayed, got %#v", rejected.String())
+	}
+	if !strings.Contains(buf.String(), "\r\nHi\r\n..\r\nBye\r\n.\r\n") {
+		t.Errorf("Expected the message to be relayed with DATA, got %#v", buf.String())
+	}
+}
+
+type rejectSenderData string
+
+func (r rejectSenderData) CheckData(info proxy.Info) error {
+	if info.Sender == string(r) {
+		return &proxy.Reply{Code: 554, Message: "5.7.1 Not from you"}
+	}
+	return nil
+}
+
+func TestServerChunkingRejected(t *testing.T) {
+	// Start relay, which gets the envelope of the rejected
+	// message, and the next message
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected, buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &rejected, "220 Hi\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n")
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	cfg := config.New()
+	cfg.GreetingDelay = 1
+	srv := New(WithConfig(cfg), WithRelay(smtpln.Addr().String()),
+		WithHooks(proxy.Hooks{
+			Data: []proxy.DataHook{rejectSenderData("spam@test.tld")},
+		}))
+	proxyAddr := startProxy(t, srv, config.RoleSMTP)
+	c, err := textproto.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	send := func(commands string, codes ...int) {
+		t.Helper()
+		fmt.Fprint(c.W, commands)
+		c.W.Flush()
+		for _, code := range codes {
+			if _, _, err := c.ReadResponse(code); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send("", 220)
+	send("EHLO localhost\r\n", 250)
+	send("MAIL FROM:<spam@test.tld>\r\nRCPT TO:<you@test.tld>\r\n", 250, 250)
+	send("BDAT 5\r\nHelloBDAT 0 LAST\r\n", 554, 503)
+	// The last chunk ended the transaction
+	send("MAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\n", 250, 250)
+	send("BDAT 5 LAST\r\nHello", 250)
+	send("QUIT\r\n", 221)
+
+	<-relayDone
+	if strings.Contains(rejected.String(), "DATA") {
+		t.Errorf("Expected the rejected message not to be relayed, got %#v", rejected.String())
+	}
+	if !strings.Contains(buf.String(), "MAIL FROM:<me@test.tld>\r\n") || !strings.Contains(buf.String(), "DATA\r\nHello\r\n.\r\n") {
+		t.Errorf("Expected the next message to be relayed, got %#v", buf.String())
+	}
+}
+
+func TestServerSMTPUTF8(t *testing.T) {
+	// Start relays: one with SMTPUTF8, and three without, which
+	// only get ASCII addresses
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf, rejected, ascii, noUTF8 bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &buf, "220 Hi\r\n250-Hi\r\n250 SMTPUTF8\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n354 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		readMailScript(smtpln, &rejected, "220 Hi\r\n250 Ok\r\n221 Ok\r\n")
+		readMailScript(smtpln, &ascii, "220 Hi\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		readMailScript(smtpln, &noUTF8, "220 Hi\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("VALID_RECIPIENTS", `@bücher\.tld$`)
+	proxyAddr := startProxy(t, New(WithConfig(loadConfig(t))), config.RoleSMTP)
+	c, err := textproto.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	send := func(commands string, codes ...int) {
+		t.Helper()
+		fmt.Fprint(c.W, commands)
+		c.W.Flush()
+		for _, code := range codes {
+			if _, _, err := c.ReadResponse(code); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send("", 220)
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil || !strings.Contains(msg, "\nSMTPUTF8") {
+		t.Errorf("Expected SMTPUTF8 to be offered, got %#v, %v", msg, err)
+	}
+
+	send("MAIL FROM:<jörg@test.tld>\r\n", 553)
+	send("MAIL FROM:<jörg@test.tld> SMTPUTF8\r\n", 250)
+	// Recipients match in either form of the domain
+	send("RCPT TO:<jürgen@bücher.tld>\r\nRCPT TO:<me@xn--bcher-kva.tld>\r\n", 250, 250)
+	send("DATA\r\n", 354)
+	send("Subject: Grüße\r\n\r\nHi\r\n.\r\n", 250)
+
+	send("MAIL FROM:<jörg@test.tld> SMTPUTF8\r\n", 553)
+	send("MAIL FROM:<me@test.tld> SMTPUTF8\r\n", 250)
+	send("RCPT TO:<jürgen@bücher.tld>\r\nRCPT TO:<me@xn--bcher-kva.tld>\r\n", 553, 250)
+	send("RSET\r\n", 250)
+
+	send("MAIL FROM:<me@test.tld>\r\nRCPT TO:<jürgen@bücher.tld>\r\n", 250, 553)
+	send("QUIT\r\n", 221)
+
+	<-relayDone
+	for _, expected := range []string{"MAIL FROM:<jörg@test.tld> SMTPUTF8\r\n",
+		"RCPT TO:<jürgen@bücher.tld>\r\n", "RCPT TO:<me@xn--bcher-kva.tld>\r\n", "Subject: Grüße\r\n"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %#v to be relayed, got %#v", expected, buf.String())
+		}
+	}
+	if strings.Contains(rejected.String(), "MAIL") {
+		t.Errorf("Expected the sender not to be relayed, got %#v", rejected.String())
+	}
+	if strings.Contains(ascii.String(), "jürgen") || !strings.Contains(ascii.String(), "RCPT TO:<me@xn--bcher-kva.tld>") {
+		t.Errorf("Expected only the ASCII recipient to be relayed, got %#v", ascii.String())
+	}
+	if strings.Contains(noUTF8.String(), "RCPT") {
+		t.Errorf("Expected the recipient not to be relayed, got %#v", noUTF8.String())
+	}
+}
+
+func TestServerAllowlist(t *testing.T) {
+	// Start relay, which gets the recipient right away
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &buf)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("DNSBL_REJECT", "connect")
+	t.Setenv("ALLOWLIST", "127.0.0.1 ::1")
+	cfg := loadConfig(t)
+	// For the Authentication-Results header
+	cfg.VerifyDKIM = true
+	g, err := greylist.Open(filepath.Join(t.TempDir(), "greylist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	lookup := func(ctx context.Context, name string) ([]string, error) {
+		return []string{"127.0.0.2"}, nil
+	}
+	proxyAddr := startProxy(t, New(WithConfig(cfg), WithGreylist(g),
+		WithDNSBL([]dnsbl.Zone{{Name: "rbl.tld"}}, cfg.AllowedNetworks(), lookup, nil)),
+		config.RoleSMTP)
+	start := time.Now()
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if time.Since(start) >= time.Second {
+		t.Error("Expected no greeting delay for allowed clients")
+	}
+	if err := c.Mail("me@test.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@test.tld"); err != nil {
+		t.Errorf("Expected the recipient not to be greylisted, got %#v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	<-relayDone
+	// The DNSBL was not checked.
+	if data := buf.String(); !strings.Contains(data, `x-dnsbl=none reason="allowlist `) {
+		t.Errorf("Expected the allowlist in the results, got %#v", data)
+	}
+}
+
+func TestServerSRS(t *testing.T) {
+	// Start relay, which gets a forwarded mail and a bounce
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forwarded, bounced bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMail(smtpln, &forwarded)
+		readMail(smtpln, &bounced)
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	t.Setenv("VALID_RECIPIENTS", `^you@test\.tld$`)
+	t.Setenv("SRS_DOMAIN", "fwd.tld")
+	t.Setenv("SRS_SECRET", "secret")
+	cfg := loadConfig(t)
+	proxyAddr := startProxy(t, New(WithConfig(cfg)), config.RoleSMTP)
+	rewriter := srs.New("fwd.tld", []byte("secret"))
+	sender, _ := rewriter.Forward("me@test.tld")
+	bounceTo, _ := rewriter.Forward("other@orig.tld")
+
+	c, err := smtp.Dial(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	send := func(from string, to string) {
+		if err := c.Mail(from); err != nil {
+			t.Fatal(err)
+		}
+		err = c.Rcpt("SRS0=xxxx=AA=orig.tld=other@fwd.tld")
+		if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 550 {
+			t.Errorf("Expected a forged SRS address to be rejected, got %#v", err)
+		}
+		if err := c.Rcpt(to); err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(w, "Hello")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("me@test.tld", "you@test.tld")
+	send("", bounceTo)
+	c.Quit()
+	<-relayDone
+
+	expected := "EHLO localhost\r\nMAIL FROM:<" + sender + ">\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
+	if forwarded.String() != expected {
+		t.Errorf("Expected the sender to be rewritten, got %#v", forwarded.String())
+	}
+	expected = "EHLO localhost\r\nMAIL FROM:<>\r\nRCPT TO:<other@orig.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
+	if bounced.String() != expected {
+		t.Errorf("Expected the bounce to go to the original sender, got %#v", bounced.String())
+	}
+}
+
+// startProxy serves srv on a new listener until the test ends, and
+// returns its address.
+func TestServerUnixSocket(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "smtp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.New()
+	cfg.GreetingDelay = 1
+	lookup := func(ctx context.Context, name string) ([]string, error) {
+		t.Errorf("Did not expect a lookup of %s", name)
+		return nil, nil
+	}
+	srv := New(WithConfig(cfg), WithRelay("127.0.0.1:1"),
+		WithDNSBL([]dnsbl.Zone{{Name: "rbl.tld"}}, nil, lookup, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go srv.Serve(ctx, ln)
+	c, err := textproto.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Cmd("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startProxy(t *testing.T, srv *Server, role config.Role) string {
+	ln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go srv.ServeRole(ctx, ln, role)
+	return ln.Addr().String()
+}
+
+func loadConfig(t *testing.T) *config.Config {
+	t.Setenv("GREETING_DELAY", "1")
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// serveMail runs readMail in the background. The returned channel is
+// closed once the relay connection ended, and buf can be read.
+func serveMail(ln net.Listener, buf *bytes.Buffer) <-chan bool {
+	done := make(chan bool)
+	go func() {
+		readMail(ln, buf)
+		close(done)
+	}()
+	return done
+}
+
+func readMail(ln net.Listener, buf *bytes.Buffer) {
+	readMailScript(ln, buf, "220 Hi\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n354 Ok\r\n250 Ok\r\n221 Ok\r\n")
+}
+
+func readMailScript(ln net.Listener, buf *bytes.Buffer, script string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, script)
+	b := make([]byte, 4096)
+	for {
+		n, err := conn.Read(b)
+		buf.Write(b[:n])
+		if err != nil {
+			return
+		}
+	}
+}
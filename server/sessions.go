@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/jorgenschaefer/smtpproxy/smtpd"
+)
+
+// sessions keeps track of running sessions, so they can be shut down
+// gracefully.
+type sessions struct {
+	mu    sync.Mutex
+	conns map[smtpd.Connection]bool
+	// Connections still in the TLS handshake, which have no
+	// session yet.
+	handshakes map[net.Conn]bool
+	closing    bool
+	wg         sync.WaitGroup
+}
+
+func newSessions() *sessions {
+	return &sessions{conns: map[smtpd.Connection]bool{}, handshakes: map[net.Conn]bool{}}
+}
+
+// handshake registers a connection in the TLS handshake. During
+// shutdown, the connection is closed right away.
+func (s *sessions) handshake(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wg.Add(1)
+	s.handshakes[conn] = true
+	if s.closing {
+		conn.Close()
+	}
+}
+
+// handshakeDone is called after the handshake. A session for the
+// connection has to be added before, so shutdown waits for it.
+func (s *sessions) handshakeDone(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.handshakes, conn)
+	s.wg.Done()
+}
+
+// add registers a new session. Sessions started during shutdown are
+// interrupted right away.
+func (s *sessions) add(conn smtpd.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wg.Add(1)
+	s.conns[conn] = true
+	if s.closing {
+		conn.Interrupt()
+	}
+}
+
+func (s *sessions) done(conn smtpd.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// shutdown interrupts all sessions, which makes idle sessions and
+// tarpits end right away, and waits for sessions that are busy
+// relaying a message. When ctx is done, the remaining connections are
+// closed, and shutdown returns without waiting any longer, as their
+// sessions may still wait for the relay host. It returns the number
+// of connections that had to be closed.
+func (s *sessions) shutdown(ctx context.Context) int {
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.Interrupt()
+	}
+	// There is no session to finish yet.
+	for conn := range s.handshakes {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	finished := make(chan bool)
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return 0
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	closed := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return closed
+}
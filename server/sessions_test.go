@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Setenv("RELAY_HOST", "localhost:25")
+	cfg := loadConfig(t)
+	srv := New(WithConfig(cfg))
+	proxyln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(context.Background(), proxyln)
+	}()
+
+	// An idle session
+	idle, err := net.Dial("tcp", proxyln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idleReader := bufio.NewReader(idle)
+	expectLine(t, idleReader, "220-")
+	expectLine(t, idleReader, "220 ")
+
+	// A tarpitted session
+	spammer, err := net.Dial("tcp", proxyln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spammer.Close()
+	spammerReader := bufio.NewReader(spammer)
+	expectLine(t, spammerReader, "220-")
+	spammer.Write([]byte("HELO early\r\n"))
+	// Give the proxy time to notice
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected all sessions to finish, got %v", err)
+	}
+	expectLine(t, idleReader, "421 ")
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, got %v", err)
+	}
+	if err := srv.Serve(context.Background(), proxyln); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed after shutdown, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// The relay host never answers MAIL.
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smtpln.Close()
+	go func() {
+		conn, err := smtpln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 Hi\r\n"))
+		r.ReadString('\n')
+		conn.Write([]byte("250 Ok\r\n"))
+		r.ReadString('\n')
+		r.ReadString('\n')
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	srv := New(WithConfig(loadConfig(t)))
+	proxyln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), proxyln)
+
+	client, err := net.Dial("tcp", proxyln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	r := bufio.NewReader(client)
+	expectLine(t, r, "220-")
+	expectLine(t, r, "220 ")
+	client.Write([]byte("HELO localhost\r\n"))
+	expectLine(t, r, "250 ")
+	client.Write([]byte("MAIL FROM:<me@test.tld>\r\n"))
+	// Give the proxy time to wait for the relay host
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to pass, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected shutdown to end at the deadline, took %s", elapsed)
+	}
+}
+
+func TestShutdownChunking(t *testing.T) {
+	smtpln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	relayDone := make(chan bool)
+	go func() {
+		readMailScript(smtpln, &buf, "220 Hi\r\n250-Hi\r\n250 CHUNKING\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n221 Ok\r\n")
+		close(relayDone)
+	}()
+	t.Setenv("RELAY_HOST", smtpln.Addr().String())
+	srv := New(WithConfig(loadConfig(t)))
+	proxyln, err := net.Listen("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), proxyln)
+
+	client, err := net.Dial("tcp", proxyln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(client)
+	expectLine(t, r, "220-")
+	expectLine(t, r, "220 ")
+	client.Write([]byte("EHLO localhost\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	for _, command := range []string{"MAIL FROM:<me@test.tld>\r\n", "RCPT TO:<you@test.tld>\r\n", "BDAT 7\r\nHello\r\n"} {
+		client.Write([]byte(command))
+		expectLine(t, r, "250 ")
+	}
+
+	// The message is finished after the shutdown started
+	shutdown := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.Write([]byte("BDAT 5 LAST\r\nBye\r\n"))
+	expectLine(t, r, "250 ")
+	expectLine(t, r, "421 ")
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected the session to finish, got %v", err)
+	}
+	<-relayDone
+	if data := buf.String(); !strings.Contains(data, "Hello\r\nBye\r\n") {
+		t.Errorf("Expected the message to be relayed, got %#v", data)
+	}
+}
+
+func expectLine(t *testing.T, r *bufio.Reader, prefix string) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Expected a line starting with %#v, got error %v", prefix, err)
+	}
+	if !strings.HasPrefix(line, prefix) {
+		t.Errorf("Expected a line starting with %#v, got %#v", prefix, line)
+	}
+}
@@ -0,0 +1,204 @@
+package smtpd
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+)
+
+// LineEndPolicy says what a DotReader does with a bare CR or LF in
+// message data. RFC 5321, section 2.3.8, only allows CRLF, and
+// accepting anything else lets an attacker smuggle a second message
+// past the sender's server with an end of data sequence that the
+// sender does not see, like <LF>.<LF>.
+type LineEndPolicy int
+
+const (
+	// A bare CR or LF ends the line, but never the message.
+	NormalizeLineEnds LineEndPolicy = iota
+	// A bare CR or LF makes the reader fail with ErrBareLineEnd.
+	RejectLineEnds
+)
+
+// ErrBareLineEnd is returned by a DotReader with the RejectLineEnds
+// policy when the client sends a bare CR or LF.
+var ErrBareLineEnd = errors.New("bare CR or LF in message data")
+
+type dotState int
+
+const (
+	stateBeginLine dotState = iota // At the start of a line
+	stateDot                       // After a dot at the start of a line
+	stateDotCR                     // After a dot and CR at the start of a line
+	stateData                      // In a line
+	stateCR                        // After a CR in a line
+	stateEOF                       // After the end of data
+)
+
+// Names of the line ends, as used by DotReader.Terminator().
+const (
+	crlf = "<CRLF>"
+	cr   = "<CR>"
+	lf   = "<LF>"
+)
+
+// DotReader reads a dot-encoded message body, as sent after DATA,
+// and returns it with LF line ends. Only <CRLF>.<CRLF> ends the
+// message. Unlike textproto.DotReader, it does not take a bare LF
+// for CRLF.
+type DotReader struct {
+	r      *bufio.Reader
+	lr     *io.LimitedReader
+	policy LineEndPolicy
+	state  dotState
+	// The line end before the current line.
+	before string
+	// Output that did not fit into the last Read().
+	pending []byte
+	// Set once the message exceeded the limit of lr. The rest of
+	// it is skipped.
+	tooLarge   bool
+	err        error
+	bareCR     int
+	bareLF     int
+	terminator string
+}
+
+// NewDotReader returns a DotReader reading from r. The reader can
+// read beyond the end of the message, so the rest of the session has
+// to be read from r as well.
+func NewDotReader(r *bufio.Reader, policy LineEndPolicy) *DotReader {
+	return &DotReader{r: r, policy: policy, before: crlf}
+}
+
+// BareLineEnds returns how many bare CRs and LFs were read.
+func (d *DotReader) BareLineEnds() (cr, lf int) {
+	return d.bareCR, d.bareLF
+}
+
+// Terminator returns the first line with a single dot that is not
+// surrounded by CRLF, like "<LF>.<LF>". Other servers might take it
+// for the end of data. It returns "" if there was none.
+func (d *DotReader) Terminator() string {
+	return d.terminator
+}
+
+func (d *DotReader) Read(p []byte) (int, error) {
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	for n < len(p) && d.err == nil {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			if d.lr != nil && d.lr.N <= 0 && !d.tooLarge {
+				// Skip the rest, so the session can
+				// go on after the message.
+				d.tooLarge = true
+				d.lr.N = math.MaxInt64
+				continue
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			d.err = err
+			break
+		}
+		var out []byte
+		switch d.state {
+		case stateBeginLine:
+			switch c {
+			case '.':
+				d.state = stateDot
+			case '\r':
+				d.state = stateCR
+			case '\n':
+				out = d.bareLineEnd(lf, "")
+			default:
+				out = []byte{c}
+				d.state = stateData
+			}
+		case stateDot:
+			switch c {
+			case '\r':
+				d.state = stateDotCR
+			case '\n':
+				out = d.bareLineEnd(lf, ".")
+			default:
+				// The dot was added for transparency
+				// (RFC 5321, section 4.5.2).
+				out = []byte{c}
+				d.state = stateData
+			}
+		case stateDotCR:
+			if c == '\n' {
+				if d.before == crlf {
+					d.state = stateEOF
+					d.err = io.EOF
+					if d.tooLarge {
+						d.err = ErrMessageTooLarge
+					}
+					break
+				}
+				if d.terminator == "" {
+					d.terminator = d.before + "." + crlf
+				}
+				out = []byte(".\n")
+				d.state = stateBeginLine
+				d.before = crlf
+				break
+			}
+			d.r.UnreadByte()
+			out = d.bareLineEnd(cr, ".")
+		case stateData:
+			switch c {
+			case '\r':
+				d.state = stateCR
+			case '\n':
+				out = d.bareLineEnd(lf, "")
+			default:
+				out = []byte{c}
+			}
+		case stateCR:
+			if c == '\n' {
+				out = []byte("\n")
+				d.state = stateBeginLine
+				d.before = crlf
+				break
+			}
+			d.r.UnreadByte()
+			out = d.bareLineEnd(cr, "")
+		}
+		if d.tooLarge {
+			continue
+		}
+		m := copy(p[n:], out)
+		n += m
+		d.pending = append(d.pending, out[m:]...)
+	}
+	if n > 0 || len(d.pending) > 0 {
+		return n, nil
+	}
+	return 0, d.err
+}
+
+// bareLineEnd ends the line with a bare CR or LF. The line is "." if
+// it consisted of a single dot, which is kept and remembered as a
+// possible terminator. It returns the output for the end of the
+// line.
+func (d *DotReader) bareLineEnd(end, line string) []byte {
+	if end == cr {
+		d.bareCR++
+	} else {
+		d.bareLF++
+	}
+	if d.policy == RejectLineEnds {
+		d.err = ErrBareLineEnd
+		return nil
+	}
+	if line == "." && d.terminator == "" {
+		d.terminator = d.before + "." + end
+	}
+	d.state = stateBeginLine
+	d.before = end
+	return []byte(line + "\n")
+}
@@ -0,0 +1,119 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDotReaderLineEnds(t *testing.T) {
+	tests := []struct {
+		data       string
+		body       string
+		rest       string
+		bareCR     int
+		bareLF     int
+		terminator string
+	}{
+		{"Hello\r\n..World\r\n.\r\nQUIT\r\n", "Hello\n.World\n", "QUIT\r\n", 0, 0, ""},
+		{".\r\n", "", "", 0, 0, ""},
+		{"Grüße\r\n\r\n.\r\n", "Grüße\n\n", "", 0, 0, ""},
+		{"A\n.\nMAIL FROM:<me@test.tld>\r\n.\r\n", "A\n.\nMAIL FROM:<me@test.tld>\n", "", 0, 2, "<LF>.<LF>"},
+		{"A\r.\rB\r\n.\r\n", "A\n.\nB\n", "", 2, 0, "<CR>.<CR>"},
+		{"A\r\n.\nB\r\n.\r\n", "A\n.\nB\n", "", 0, 1, "<CRLF>.<LF>"},
+		{"A\n.\r\nB\r\n.\r\n", "A\n.\nB\n", "", 0, 1, "<LF>.<CRLF>"},
+		{"A\r\n.\rB\r\n.\r\n", "A\n.\nB\n", "", 1, 0, "<CRLF>.<CR>"},
+		{"A\r\r\n..\nB\r\n.\r\n", "A\n\n.\nB\n", "", 1, 1, ""},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.data))
+		d := NewDotReader(r, NormalizeLineEnds)
+		// Read a byte at a time to test the pending output.
+		body, err := io.ReadAll(iotest.OneByteReader(d))
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %#v", test.data, err)
+		}
+		expectStringEqual(t, string(body), test.body)
+		rest, _ := io.ReadAll(r)
+		expectStringEqual(t, string(rest), test.rest)
+		if bareCR, bareLF := d.BareLineEnds(); bareCR != test.bareCR || bareLF != test.bareLF {
+			t.Errorf("Expected %d bare CRs and %d bare LFs in %q, got %d and %d",
+				test.bareCR, test.bareLF, test.data, bareCR, bareLF)
+		}
+		expectStringEqual(t, d.Terminator(), test.terminator)
+
+		d = NewDotReader(bufio.NewReader(strings.NewReader(test.data)), RejectLineEnds)
+		_, err = io.ReadAll(d)
+		if bare := test.bareCR+test.bareLF > 0; bare != (err == ErrBareLineEnd) {
+			t.Errorf("Unexpected error %#v for %q", err, test.data)
+		}
+	}
+
+	d := NewDotReader(bufio.NewReader(strings.NewReader("Hello\r\n")), NormalizeLineEnds)
+	if _, err := io.ReadAll(d); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %#v", err)
+	}
+}
+
+// FuzzDotReader checks that only <CRLF>.<CRLF> ends the message, and
+// that the body is relayed unchanged, so the relay host cannot see a
+// different end of data either.
+func FuzzDotReader(f *testing.F) {
+	f.Add([]byte("Hello\r\n..World\r\n.\r\nQUIT\r\n"))
+	f.Add([]byte("A\n.\nMAIL FROM:<me@test.tld>\r\n.\r\n"))
+	f.Add([]byte("A\r.\rB\r\n.\r\n"))
+	f.Add([]byte("A\r\n.\nB\n.\r\nC\r\r\n.\r\n"))
+	f.Add([]byte(".\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		d := NewDotReader(r, NormalizeLineEnds)
+		body, err := io.ReadAll(d)
+		rest, _ := io.ReadAll(r)
+		end := bytes.Index(append([]byte("\r\n"), data...), []byte("\r\n.\r\n"))
+		if end < 0 {
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("Expected io.ErrUnexpectedEOF for %q, got %#v", data, err)
+			}
+		} else if err != nil {
+			t.Fatalf("Expected no error for %q, got %#v", data, err)
+		} else if !bytes.Equal(rest, data[end+3:]) {
+			t.Fatalf("Expected the message in %q to end at %d, got rest %q", data, end, rest)
+		}
+		if bytes.IndexByte(body, '\r') >= 0 {
+			t.Fatalf("Expected no CR in body %q", body)
+		}
+
+		bareCR, bareLF := d.BareLineEnds()
+		d = NewDotReader(bufio.NewReader(bytes.NewReader(data)), RejectLineEnds)
+		if _, err := io.ReadAll(d); (err == ErrBareLineEnd) != (bareCR+bareLF > 0) {
+			t.Fatalf("Unexpected error %#v for %q with %d bare line ends", err, data, bareCR+bareLF)
+		}
+
+		if err != nil || len(body) == 0 {
+			return
+		}
+		// Encode the body as net/smtp does for the relay host,
+		// and read it again.
+		var encoded bytes.Buffer
+		bw := bufio.NewWriter(&encoded)
+		w := textproto.NewWriter(bw).DotWriter()
+		w.Write(body)
+		w.Close()
+		bw.Flush()
+		r = bufio.NewReader(&encoded)
+		relayed, err := io.ReadAll(NewDotReader(r, RejectLineEnds))
+		if err != nil {
+			t.Fatalf("Expected no error relaying %q, got %#v", body, err)
+		}
+		if !bytes.Equal(relayed, body) {
+			t.Fatalf("Expected %q to be relayed unchanged, got %q", body, relayed)
+		}
+		if rest, _ := io.ReadAll(r); len(rest) > 0 {
+			t.Fatalf("Expected the relayed message to end at the end, got rest %q", rest)
+		}
+	})
+}
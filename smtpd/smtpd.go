@@ -2,31 +2,56 @@ package smtpd
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
 	"net/textproto"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Connection interface {
 	Printf(format string, args ...interface{}) error
 	Reply(code int, messages ...string) error
-	StartTLS(*tls.Config)
+	StartTLS(*tls.Config) error
+	IsTLS() bool
 	ReadCommand(timeout int) (command, args string, err error)
-	ReadDotBytes(timeout int) ([]byte, error)
+	ReadMessageCommand(timeout int) (command, args string, err error)
+	Pipelined() bool
+	Flush() error
+	DotReader(timeout int, limit int64, policy LineEndPolicy) *DotReader
+	ChunkReader(timeout int, size int64) io.Reader
+	Interrupt()
 	Close() error
 	RemoteAddr() net.Addr
 	Tarpit() (int, time.Duration, error)
 }
 
+// ErrInterrupted is returned by ReadCommand() and Tarpit() after
+// Interrupt() was called.
+var ErrInterrupted = errors.New("connection interrupted")
+
 type NetConnection struct {
 	conn   net.Conn
 	reader *textproto.Reader
+	// Replies are buffered while the client has sent more
+	// commands (RFC 2920).
+	writer *bufio.Writer
 	lr     *io.LimitedReader
+	// The original connection, even after StartTLS(). Unlike
+	// conn, it is safe to use from other goroutines.
+	raw         net.Conn
+	interrupted atomic.Bool
+	// mu protects the read deadline and inData against
+	// Interrupt().
+	mu     sync.Mutex
+	inData bool
 }
 
 func NewConnection(conn net.Conn) Connection {
@@ -35,12 +60,46 @@ func NewConnection(conn net.Conn) Connection {
 		conn:   conn,
 		lr:     lr,
 		reader: textproto.NewReader(bufio.NewReader(lr)),
+		writer: bufio.NewWriter(conn),
+		raw:    conn,
 	}
 }
 
+// Printf writes to the client. The output is sent right away, unless
+// the client already sent the next command, in which case it is sent
+// together with the replies to that.
 func (c *NetConnection) Printf(format string, args ...interface{}) error {
-	_, err := fmt.Fprintf(c.conn, format, args...)
-	return err
+	if _, err := fmt.Fprintf(c.writer, format, args...); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// flush sends the buffered output, unless the client is not waiting
+// for it yet.
+func (c *NetConnection) flush() error {
+	if c.nextCommand() {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+// Flush sends the buffered output.
+func (c *NetConnection) Flush() error {
+	return c.writer.Flush()
+}
+
+// nextCommand returns true if the client sent a complete command line
+// that was not read yet.
+func (c *NetConnection) nextCommand() bool {
+	buffered, _ := c.reader.R.Peek(c.reader.R.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// Pipelined returns true if the client sent more than the last
+// command without waiting for the reply.
+func (c *NetConnection) Pipelined() bool {
+	return c.reader.R.Buffered() > 0
 }
 
 func (c *NetConnection) Reply(code int, messages ...string) error {
@@ -49,20 +108,45 @@ func (c *NetConnection) Reply(code int, messages ...string) error {
 		if i < len(messages)-1 {
 			sep = "-"
 		}
-		if err := c.Printf("%03d%s%s\r\n", code, sep, text); err != nil {
+		if _, err := fmt.Fprintf(c.writer, "%03d%s%s\r\n", code, sep, text); err != nil {
 			return err
 		}
 	}
-	return nil
+	return c.flush()
+}
+
+func (c *NetConnection) StartTLS(cfg *tls.Config) error {
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	tlsconn := tls.Server(c.conn, cfg)
+	c.conn = tlsconn
+	c.writer.Reset(tlsconn)
+	// Anything the client sent before the handshake is discarded
+	// together with the old buffer, as required by RFC 3207.
+	c.lr.R = tlsconn
+	c.reader = textproto.NewReader(bufio.NewReader(c.lr))
+	return tlsconn.Handshake()
 }
 
-func (c *NetConnection) StartTLS(cfg *tls.Config) {
-	c.conn = tls.Server(c.conn, cfg)
-	c.reader = textproto.NewReader(bufio.NewReader(c.conn))
+func (c *NetConnection) IsTLS() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
 }
 
 func (c *NetConnection) ReadCommand(timeout int) (command, args string, err error) {
-	c.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	return c.readCommand(timeout, false)
+}
+
+// ReadMessageCommand reads a command in the middle of a message, like
+// the next BDAT command. Like message data, it is not affected by
+// Interrupt().
+func (c *NetConnection) ReadMessageCommand(timeout int) (command, args string, err error) {
+	return c.readCommand(timeout, true)
+}
+
+func (c *NetConnection) readCommand(timeout int, inData bool) (command, args string, err error) {
+	c.setReadDeadline(time.Now().Add(time.Duration(timeout)*time.Second), inData)
 	// The maximum length for a command line according to RFC
 	// 5321, section 4.5.3.1.4., is 512 bytes. The maximum length
 	// of a text line (section 4.5.3.1.6.) is 1000, though, so
@@ -70,6 +154,9 @@ func (c *NetConnection) ReadCommand(timeout int) (command, args string, err erro
 	c.lr.N = 1000
 	line, err := c.reader.ReadLine()
 	if err != nil {
+		if c.interrupted.Load() {
+			err = ErrInterrupted
+		}
 		return "", "", err
 	}
 	parts := strings.SplitN(line, " ", 2)
@@ -80,15 +167,73 @@ func (c *NetConnection) ReadCommand(timeout int) (command, args string, err erro
 	}
 }
 
-func (c *NetConnection) ReadDotBytes(timeout int) ([]byte, error) {
-	c.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-	// 150MB is the current gmail maximum
-	c.lr.N = 150 * 1024 * 1024
-	return c.reader.ReadDotBytes()
+// ErrMessageTooLarge is returned by the reader from DotReader() when
+// the client sends more than the limit.
+var ErrMessageTooLarge = errors.New("message exceeds the size limit")
+
+// DotReader returns a reader for a dot-encoded message body, as
+// sent after DATA. The whole message has to arrive within timeout
+// seconds. If it is larger than limit bytes, the rest is skipped, and
+// the reader fails with ErrMessageTooLarge at the end of the message.
+// Bare CRs and LFs are handled according to policy.
+func (c *NetConnection) DotReader(timeout int, limit int64, policy LineEndPolicy) *DotReader {
+	c.writer.Flush()
+	c.setReadDeadline(time.Now().Add(time.Duration(timeout)*time.Second), true)
+	c.lr.N = limit
+	d := NewDotReader(c.reader.R, policy)
+	d.lr = c.lr
+	return d
+}
+
+// ChunkReader returns a reader for the next size bytes, as sent after
+// BDAT (RFC 3030). They have to arrive within timeout seconds. The
+// reader fails with io.ErrUnexpectedEOF if the client sends less.
+func (c *NetConnection) ChunkReader(timeout int, size int64) io.Reader {
+	c.setReadDeadline(time.Now().Add(time.Duration(timeout)*time.Second), true)
+	c.lr.N = size
+	return &chunkReader{io.LimitedReader{R: c.reader.R, N: size}}
+}
+
+type chunkReader struct {
+	io.LimitedReader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.LimitedReader.Read(p)
+	if err == io.EOF && r.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Interrupt makes a waiting ReadCommand() or Tarpit() return
+// ErrInterrupted, as do all later calls. Reading message data is not
+// affected. Interrupt is safe to call from other goroutines.
+func (c *NetConnection) Interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interrupted.Store(true)
+	if !c.inData {
+		c.raw.SetReadDeadline(time.Now())
+	}
+}
+
+// setReadDeadline sets the read deadline, unless the connection was
+// interrupted outside of message data.
+func (c *NetConnection) setReadDeadline(deadline time.Time, inData bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inData = inData
+	if !inData && c.interrupted.Load() {
+		deadline = time.Now()
+	}
+	c.conn.SetReadDeadline(deadline)
 }
 
+// Close closes the connection. It is safe to call from other
+// goroutines.
 func (c *NetConnection) Close() error {
-	return c.conn.Close()
+	return c.raw.Close()
 }
 
 func (c *NetConnection) RemoteAddr() net.Addr {
@@ -96,7 +241,8 @@ func (c *NetConnection) RemoteAddr() net.Addr {
 }
 
 func (c *NetConnection) Tarpit() (int, time.Duration, error) {
-	c.conn.SetReadDeadline(time.Time{})
+	c.writer.Flush()
+	c.setReadDeadline(time.Time{}, false)
 	buf := make([]byte, 1024, 1024)
 	bytes := 0
 	start := time.Now()
@@ -104,6 +250,9 @@ func (c *NetConnection) Tarpit() (int, time.Duration, error) {
 		n, err := c.conn.Read(buf)
 		bytes += n
 		if err != nil {
+			if c.interrupted.Load() {
+				err = ErrInterrupted
+			}
 			return bytes, time.Now().Sub(start), err
 		}
 	}
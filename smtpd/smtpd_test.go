@@ -2,11 +2,15 @@ package smtpd
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"math"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/internal/testcert"
 )
 
 func TestNewConnection(t *testing.T) {
@@ -37,7 +41,53 @@ func TestReply(t *testing.T) {
 	expectStringEqual(t, netconn.String(), "100-Yes\r\n100-No\r\n100 Maybe\r\n")
 }
 
-// FIXME: TestStartTLS
+func TestStartTLS(t *testing.T) {
+	certPEM, keyPEM, err := testcert.Generate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	server, client := net.Pipe()
+	c := NewConnection(server)
+	done := make(chan error)
+	go func() {
+		tlsclient := tls.Client(client, &tls.Config{
+			ServerName: "localhost",
+			RootCAs:    roots,
+		})
+		if err := tlsclient.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		_, err := tlsclient.Write([]byte("EHLO localhost\r\n"))
+		done <- err
+	}()
+
+	if c.IsTLS() {
+		t.Error("Did not expect a TLS connection before StartTLS()")
+	}
+	if err := c.StartTLS(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	if !c.IsTLS() {
+		t.Error("Expected a TLS connection after StartTLS()")
+	}
+	command, args, err := c.ReadCommand(23)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, command, "EHLO")
+	expectStringEqual(t, args, "localhost")
+	if err := <-done; err != nil {
+		t.Errorf("Client error: %#v", err)
+	}
+}
 
 func TestReadCommand(t *testing.T) {
 	netconn := newFakeConnection()
@@ -88,18 +138,148 @@ func TestReadCommand(t *testing.T) {
 	}
 }
 
-func TestReadDotBytes(t *testing.T) {
+func TestPipelining(t *testing.T) {
 	netconn := newFakeConnection()
 	c := NewConnection(netconn)
+	netconn.WriteString("NOOP\r\nQUIT\r\n")
 
-	// Not testing whether textproto.ReadDotBytes() actually works
-	c.ReadDotBytes(23)
+	c.ReadCommand(23)
+	if !c.Pipelined() {
+		t.Error("Expected the client to pipeline")
+	}
+	// The reply waits for the next one.
+	c.Reply(250, "Ok")
+	expectStringEqual(t, netconn.String(), "")
+	command, _, err := c.ReadCommand(23)
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, command, "QUIT")
+	if c.Pipelined() {
+		t.Error("Did not expect the client to pipeline")
+	}
+	c.Reply(221, "Bye")
+	expectStringEqual(t, netconn.String(), "250 Ok\r\n221 Bye\r\n")
+}
 
+func TestDotReader(t *testing.T) {
+	netconn := newFakeConnection()
+	c := NewConnection(netconn)
+	netconn.WriteString("Hello\r\n..World\r\n.\r\nQUIT\r\n")
+
+	body, err := io.ReadAll(c.DotReader(23, 1024, NormalizeLineEnds))
 	timeout := netconn.ReadDeadline.Sub(time.Now()).Seconds()
 	if math.Abs(timeout-23.0) > 0.01 {
-		t.Errorf("Expected ReadDotBytes to set read timeout 23s, but set %#v",
+		t.Errorf("Expected DotReader to set read timeout 23s, but set %#v",
 			timeout)
 	}
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, string(body), "Hello\n.World\n")
+	command, _, err := c.ReadCommand(23)
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, command, "QUIT")
+
+	// Supports limited reader
+	netconn.Reset()
+	for i := 0; i < 1024; i++ {
+		netconn.WriteString("line\r\n")
+	}
+	netconn.WriteString(".\r\nQUIT\r\n")
+	body, err = io.ReadAll(c.DotReader(23, 1024, NormalizeLineEnds))
+	if err != ErrMessageTooLarge {
+		t.Errorf("Expected ErrMessageTooLarge, but got %#v", err)
+	}
+	if len(body) > 1024 {
+		t.Errorf("Expected at most 1024 bytes, got %d", len(body))
+	}
+	// The rest of the message is skipped.
+	command, _, err = c.ReadCommand(23)
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, command, "QUIT")
+}
+
+func TestChunkReader(t *testing.T) {
+	netconn := newFakeConnection()
+	c := NewConnection(netconn)
+	netconn.WriteString("Hello\n\x00.\r\nQUIT\r\n")
+
+	chunk, err := io.ReadAll(c.ChunkReader(23, 10))
+	timeout := netconn.ReadDeadline.Sub(time.Now()).Seconds()
+	if math.Abs(timeout-23.0) > 0.01 {
+		t.Errorf("Expected ChunkReader to set read timeout 23s, but set %#v",
+			timeout)
+	}
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, string(chunk), "Hello\n\x00.\r\n")
+	command, _, err := c.ReadCommand(23)
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, command, "QUIT")
+
+	netconn.Reset()
+	netconn.WriteString("Hello")
+	if _, err := io.ReadAll(c.ChunkReader(23, 10)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, but got %#v", err)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	netconn := newFakeConnection()
+	c := NewConnection(netconn)
+
+	c.Interrupt()
+	if netconn.ReadDeadline.After(time.Now()) {
+		t.Error("Expected Interrupt() to end the current read")
+	}
+	_, _, err := c.ReadCommand(23)
+	if err != ErrInterrupted {
+		t.Errorf("Expected ErrInterrupted, but got %#v", err)
+	}
+	if netconn.ReadDeadline.After(time.Now()) {
+		t.Error("Expected ReadCommand() not to wait after Interrupt()")
+	}
+	_, _, err = c.Tarpit()
+	if err != ErrInterrupted {
+		t.Errorf("Expected ErrInterrupted from Tarpit(), but got %#v", err)
+	}
+
+	// Message data is still read
+	netconn.WriteString("Hello\r\n.\r\n")
+	body, err := io.ReadAll(c.DotReader(23, 1024, NormalizeLineEnds))
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, string(body), "Hello\n")
+	timeout := netconn.ReadDeadline.Sub(time.Now()).Seconds()
+	if math.Abs(timeout-23.0) > 0.01 {
+		t.Errorf("Expected DotReader to set read timeout 23s, but set %#v",
+			timeout)
+	}
+	c.Interrupt()
+	if netconn.ReadDeadline.Before(time.Now()) {
+		t.Error("Did not expect Interrupt() to end reading message data")
+	}
+
+	// So are commands in the middle of a message
+	netconn.WriteString("BDAT 5 LAST\r\n")
+	command, args, err := c.ReadMessageCommand(23)
+	if err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	expectStringEqual(t, command+" "+args, "BDAT 5 LAST")
+	c.Interrupt()
+	if netconn.ReadDeadline.Before(time.Now()) {
+		t.Error("Did not expect Interrupt() to end reading a command in a message")
+	}
 }
 
 func TestClose(t *testing.T) {
@@ -1,78 +1,118 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/jorgenschaefer/smtpproxy/argerror"
 	"github.com/jorgenschaefer/smtpproxy/config"
-	"github.com/jorgenschaefer/smtpproxy/proxy"
-	"github.com/jorgenschaefer/smtpproxy/smtpd"
+	"github.com/jorgenschaefer/smtpproxy/greylist"
+	"github.com/jorgenschaefer/smtpproxy/server"
 )
 
 func main() {
-	config.Check()
-	ln, err := listen()
+	configFile := flag.String("config", os.Getenv("SMTPPROXY_CONFIG"),
+		"path to the configuration file")
+	flag.Parse()
+	cfg, err := config.Load(*configFile)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("SMTP proxy started; address=\"%s\"\n", ln.Addr())
-	defer fmt.Printf("SMTP proxy stopped; address=\"%s\"\n", ln.Addr())
-
-	for {
-		conn, err := ln.Accept()
+	opts := []server.Option{server.WithConfig(cfg)}
+	if cfg.GreylistFile != "" {
+		g, err := greylist.Open(cfg.GreylistFile)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintf(os.Stderr, "Error opening greylist: %v\n", err)
 			os.Exit(1)
 		}
-		go handleConnection(smtpd.NewConnection(conn))
+		defer g.Close()
+		opts = append(opts, server.WithGreylist(g))
+	}
+	srv := server.New(opts...)
+	go learnRelaySize(srv)
+	go reloadOnHangup(*configFile, srv)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	err = srv.ListenAndServe(ctx)
+	// A second signal ends the process without waiting for the
+	// sessions.
+	stop()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	fmt.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), srv.Config().ShutdownTimeout)
+	defer cancel()
+	srv.Shutdown(ctx)
 }
 
-func listen() (net.Listener, error) {
-	if config.ListenMode() == "address" {
-		return net.Listen("tcp", config.ListenAddress())
-	} else {
-		f := os.NewFile(config.ListenFD(), "LISTEN_FD")
-		defer f.Close()
-		return net.FileListener(f)
+func reloadOnHangup(path string, srv *server.Server) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		reload(path, srv)
 	}
 }
 
-func handleConnection(conn smtpd.Connection) {
-	defer conn.Close()
-	fmt.Println(argerror.New("New connection",
-		map[string]string{"client": conn.RemoteAddr().String()}))
-	defer fmt.Println(argerror.New("Connection finished",
-		map[string]string{"client": conn.RemoteAddr().String()}))
-	state, err := proxy.Greet(conn)
+// reload reads and validates the configuration again. If that fails,
+// the old configuration is kept. New sessions use the new
+// configuration, running sessions keep theirs.
+func reload(path string, srv *server.Server) error {
+	args := map[string]string{"file": path}
+	cfg, err := config.Load(path)
+	if err == nil && !sameListeners(cfg.Listeners(), srv.Config().Listeners()) {
+		err = errors.New("Listeners can not be changed without a restart")
+	}
+	if err == nil && cfg.GreylistFile != srv.Config().GreylistFile {
+		err = errors.New("The greylist file can not be changed without a restart")
+	}
 	if err != nil {
-		fmt.Println(err.Error())
-		maybeTarpit(err, conn)
+		args["error"] = err.Error()
+		fmt.Println(argerror.New("Error reloading configuration, keeping the old one", args))
+		return err
+	}
+	srv.SetConfig(cfg)
+	fmt.Println(argerror.New("Configuration reloaded", args))
+	go learnRelaySize(srv)
+	return nil
+}
+
+// learnRelaySize lowers the maximum message size to the relay host's
+// limit, if configured. It runs in the background, and the configured
+// size is used until the relay host answers, or if it does not.
+func learnRelaySize(srv *server.Server) {
+	if !srv.Config().LearnRelaySize {
 		return
 	}
-	for {
-		if err := state.HandleCommand(); err != nil {
-			fmt.Println(err.Error())
-			maybeTarpit(err, conn)
-			return
-		}
+	args := map[string]string{"relay": srv.Config().RelayHost}
+	size, err := srv.LearnRelaySize()
+	if err != nil {
+		args["error"] = err.Error()
+		fmt.Println(argerror.New("Error querying the size limit of the relay host", args))
+		return
 	}
+	args["size"] = strconv.FormatInt(size, 10)
+	fmt.Println(argerror.New("Maximum message size", args))
 }
 
-func maybeTarpit(err error, conn smtpd.Connection) {
-	_, ok := err.(proxy.TarpitError)
-	if ok {
-		args := map[string]string{
-			"client": conn.RemoteAddr().String(),
+func sameListeners(a, b []config.Listener) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
-		bytesread, duration, err := conn.Tarpit()
-		args["bytesread"] = fmt.Sprintf("%d", bytesread)
-		args["duration"] = duration.String()
-		args["error"] = err.Error()
-		fmt.Println(argerror.New("Client escaped tarpit", args))
 	}
+	return true
 }
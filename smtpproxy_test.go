@@ -1,65 +1,55 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"net"
-	"net/smtp"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jorgenschaefer/smtpproxy/config"
-	"github.com/jorgenschaefer/smtpproxy/smtpd"
+	"github.com/jorgenschaefer/smtpproxy/server"
 )
 
-func TestSMTPProxy(t *testing.T) {
-	// Start relay
-	smtpln, err := net.Listen("tcp", "")
-	if err != nil {
-		t.Error(err)
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtpproxy.toml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
 	}
-	var buf bytes.Buffer
-	go readMail(smtpln, &buf)
-	os.Setenv("RELAY_HOST", smtpln.Addr().String())
-	config.Check()
-	proxyln, err := net.Listen("tcp", "")
+	t.Setenv("RELAY_HOST", "")
+	writeConfig("relay_host = \"old.tld:25\"\n")
+	cfg, err := config.Load(path)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	// Start proxy server
-	go func() {
-		conn, err := proxyln.Accept()
-		if err != nil {
-			panic(err)
-		}
-		handleConnection(smtpd.NewConnection(conn))
-	}()
-	// Send mail to the proxy server
-	err = smtp.SendMail(proxyln.Addr().String(), nil, "me@test.tld",
-		[]string{"you@test.tld"}, []byte("Hello"))
-	if err != nil {
-		t.Error(err)
+	srv := server.New(server.WithConfig(cfg))
+
+	writeConfig("relay_host = \"new.tld:25\"\n")
+	if err := reload(path, srv); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
 	}
-	data := buf.String()
-	expected := "EHLO localhost\r\nMAIL FROM:<me@test.tld>\r\nRCPT TO:<you@test.tld>\r\nDATA\r\nHello\r\n.\r\nQUIT\r\n"
-	if data != expected {
-		t.Errorf("Expected a mail, got %#v", data)
+	if srv.Config().RelayHost != "new.tld:25" {
+		t.Errorf("Expected the new configuration, got %#v", srv.Config().RelayHost)
+	}
+	if cfg.RelayHost != "old.tld:25" {
+		t.Error("Expected the old configuration to be unchanged")
 	}
-}
 
-func readMail(ln net.Listener, buf *bytes.Buffer) {
-	conn, err := ln.Accept()
-	if err != nil {
-		panic(err)
+	// Invalid configurations are not used
+	writeConfig("relay_host = \"\"\n")
+	if err := reload(path, srv); err == nil {
+		t.Error("Expected an error for an invalid configuration")
 	}
-	defer conn.Close()
-	fmt.Fprintf(conn, "220 Hi\r\n250 Ok\r\n250 Ok\r\n250 Ok\r\n354 Ok\r\n250 Ok\r\n221 Ok\r\n")
-	b := make([]byte, 4096)
-	for {
-		n, err := conn.Read(b)
-		buf.Write(b[:n])
-		if err != nil {
-			return
-		}
+	writeConfig("relay_host = \"newer.tld:25\"\nlisten = [\":2525\"]\n")
+	if err := reload(path, srv); err == nil {
+		t.Error("Expected an error for changed listeners")
+	}
+	writeConfig("relay_host = \"newer.tld:25\"\ngreylist_file = \"/tmp/greylist\"\n")
+	if err := reload(path, srv); err == nil {
+		t.Error("Expected an error for a changed greylist file")
+	}
+	if srv.Config().RelayHost != "new.tld:25" {
+		t.Errorf("Expected the configuration to be kept, got %#v",
+			srv.Config().RelayHost)
 	}
 }
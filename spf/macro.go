@@ -0,0 +1,200 @@
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RFC 7208, section 7
+
+type macro struct {
+	letter  byte
+	upper   bool
+	digits  int
+	reverse bool
+	delims  string
+}
+
+// walkMacro splits a macro-string into literal text and macros.
+func walkMacro(s string, literal func(string), expand func(m macro) error) error {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			literal(s[i : i+1])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return errors.New("incomplete macro")
+		}
+		switch s[i] {
+		case '%':
+			literal("%")
+		case '_':
+			literal(" ")
+		case '-':
+			literal("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return errors.New("unterminated macro")
+			}
+			m, err := parseMacro(s[i+1 : i+end])
+			if err != nil {
+				return err
+			}
+			if err := expand(m); err != nil {
+				return err
+			}
+			i += end
+		default:
+			return fmt.Errorf("invalid macro %%%c", s[i])
+		}
+	}
+	return nil
+}
+
+func parseMacro(text string) (macro, error) {
+	m := macro{}
+	if text == "" {
+		return m, errors.New("empty macro")
+	}
+	m.letter = text[0]
+	if m.letter >= 'A' && m.letter <= 'Z' {
+		m.upper = true
+		m.letter += 'a' - 'A'
+	}
+	if !strings.ContainsRune("slodiphv", rune(m.letter)) {
+		return m, fmt.Errorf("invalid macro letter %c", text[0])
+	}
+	rest := text[1:]
+	n := 0
+	for n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+		n++
+	}
+	if n > 0 {
+		digits, err := strconv.Atoi(rest[:n])
+		if err != nil || digits == 0 {
+			return m, fmt.Errorf("invalid macro transformer %s", rest[:n])
+		}
+		m.digits = digits
+		rest = rest[n:]
+	}
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		m.reverse = true
+		rest = rest[1:]
+	}
+	for _, c := range rest {
+		if !strings.ContainsRune(".-+,/_=", c) {
+			return m, fmt.Errorf("invalid macro delimiter %c", c)
+		}
+	}
+	m.delims = rest
+	return m, nil
+}
+
+func checkMacro(s string) error {
+	return walkMacro(s, func(string) {}, func(macro) error { return nil })
+}
+
+// expand replaces the macros in s for the current domain.
+func (c *check) expand(s, domain string) (string, error) {
+	var b strings.Builder
+	err := walkMacro(s, func(text string) {
+		b.WriteString(text)
+	}, func(m macro) error {
+		value, err := c.macroValue(m.letter, domain)
+		if err != nil {
+			return err
+		}
+		b.WriteString(m.apply(value))
+		return nil
+	})
+	return b.String(), err
+}
+
+func (c *check) macroValue(letter byte, domain string) (string, error) {
+	switch letter {
+	case 's':
+		return c.sender, nil
+	case 'l':
+		return c.local, nil
+	case 'o':
+		return c.domain, nil
+	case 'd':
+		return domain, nil
+	case 'i':
+		if c.ip.To4() != nil {
+			return c.ip.String(), nil
+		}
+		nibbles := make([]string, 0, 32)
+		for _, b := range c.ip.To16() {
+			nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0x0F))
+		}
+		return strings.Join(nibbles, "."), nil
+	case 'p':
+		names, err := c.validatedNames()
+		if err != nil {
+			return "", err
+		}
+		for _, name := range names {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return name, nil
+			}
+		}
+		if len(names) > 0 {
+			return names[0], nil
+		}
+		return "unknown", nil
+	case 'v':
+		if c.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'h':
+		return c.helo, nil
+	}
+	panic("unknown macro letter")
+}
+
+func (m macro) apply(value string) string {
+	if m.digits > 0 || m.reverse || m.delims != "" {
+		delims := m.delims
+		if delims == "" {
+			delims = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delims, r)
+		})
+		if m.reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if m.digits > 0 && m.digits < len(parts) {
+			parts = parts[len(parts)-m.digits:]
+		}
+		value = strings.Join(parts, ".")
+	}
+	if m.upper {
+		value = urlEscape(value)
+	}
+	return value
+}
+
+// urlEscape escapes everything but the unreserved characters of RFC
+// 3986.
+func urlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
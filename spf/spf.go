@@ -0,0 +1,641 @@
+// Package spf checks whether a host is allowed to send mail for a
+// domain, using the Sender Policy Framework described in RFC 7208.
+//
+// The exp modifier is not supported. Rejections use the proxy's own
+// reply text, so explanations are never looked up.
+
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Results lists all possible results.
+var Results = []Result{None, Neutral, Pass, Fail, SoftFail, TempError, PermError}
+
+// Resolver does the DNS lookups for the checks. Names not found
+// should be reported as a *net.DNSError with IsNotFound set, every
+// other error is a temporary error.
+type Resolver struct {
+	TXT  func(name string) ([]string, error)
+	IP   func(host string) ([]net.IP, error)
+	MX   func(name string) ([]*net.MX, error)
+	Addr func(addr string) ([]string, error)
+}
+
+var DefaultResolver = Resolver{
+	TXT:  net.LookupTXT,
+	IP:   net.LookupIP,
+	MX:   net.LookupMX,
+	Addr: net.LookupAddr,
+}
+
+// RFC 7208, section 4.6.4
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxNames       = 10
+)
+
+type Checker struct {
+	resolver Resolver
+}
+
+func New(resolver Resolver) *Checker {
+	return &Checker{resolver: resolver}
+}
+
+// Check evaluates the SPF record of the sender's domain for a client
+// at ip. For the null sender, the HELO name is checked instead. The
+// returned string describes how the result came about.
+func (c *Checker) Check(ip net.IP, helo, sender string) (Result, string) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	local, domain := "postmaster", sender
+	if i := strings.LastIndexByte(sender, '@'); i >= 0 {
+		domain = sender[i+1:]
+		if i > 0 {
+			local = sender[:i]
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	chk := &check{
+		resolver: c.resolver,
+		ip:       ip,
+		sender:   local + "@" + domain,
+		local:    local,
+		domain:   domain,
+		helo:     helo,
+	}
+	return chk.checkHost(domain)
+}
+
+// check holds the state of a single evaluation, which can span
+// several records through include and redirect.
+type check struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	local    string
+	domain   string
+	helo     string
+	lookups  int
+	voids    int
+	names    []string
+	resolved bool
+}
+
+// failure ends an evaluation with an error result.
+type failure struct {
+	result Result
+	reason string
+}
+
+func (f *failure) Error() string {
+	return f.reason
+}
+
+func permError(format string, args ...interface{}) error {
+	return &failure{PermError, fmt.Sprintf(format, args...)}
+}
+
+func tempError(format string, args ...interface{}) error {
+	return &failure{TempError, fmt.Sprintf(format, args...)}
+}
+
+func (c *check) checkHost(domain string) (Result, string) {
+	if !validDomain(domain) {
+		return None, fmt.Sprintf("%s is not a valid domain", domain)
+	}
+	rec, err := c.record(domain)
+	if err != nil {
+		f := err.(*failure)
+		return f.result, f.reason
+	}
+	if rec == nil {
+		return None, fmt.Sprintf("%s has no SPF record", domain)
+	}
+	for _, m := range rec.mechanisms {
+		matched, err := c.match(m, domain)
+		if err != nil {
+			f := err.(*failure)
+			return f.result, f.reason
+		}
+		if matched {
+			return m.qualifier, fmt.Sprintf("%s: %s matched", domain, m.text)
+		}
+	}
+	if rec.redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return PermError, err.Error()
+		}
+		target, err := c.target(rec.redirect, domain)
+		if err != nil {
+			return PermError, err.Error()
+		}
+		result, reason := c.checkHost(target)
+		if result == None {
+			return PermError, fmt.Sprintf("%s: redirect to %s without SPF record", domain, target)
+		}
+		return result, reason
+	}
+	return Neutral, fmt.Sprintf("%s: no mechanism matched", domain)
+}
+
+// record looks up and parses the SPF record of domain. It returns
+// nil if there is none.
+func (c *check) record(domain string) (*record, error) {
+	txts, err := c.resolver.TXT(domain)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, tempError("%s: %v", domain, err)
+	}
+	found := []string{}
+	for _, txt := range txts {
+		if len(txt) >= 6 && strings.EqualFold(txt[:6], "v=spf1") &&
+			(len(txt) == 6 || txt[6] == ' ') {
+			found = append(found, txt)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		rec, err := parseRecord(found[0])
+		if err != nil {
+			return nil, permError("%s: %v", domain, err)
+		}
+		return rec, nil
+	default:
+		return nil, permError("%s has %d SPF records", domain, len(found))
+	}
+}
+
+func (c *check) match(m *mechanism, domain string) (bool, error) {
+	switch m.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return inNetwork(c.ip, m.ip, m.cidr4, m.cidr6), nil
+	}
+
+	if err := c.countLookup(); err != nil {
+		return false, err
+	}
+	target, err := c.target(m.domain, domain)
+	if err != nil {
+		return false, err
+	}
+	switch m.name {
+	case "include":
+		result, reason := c.checkHost(target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, &failure{TempError, reason}
+		default:
+			return false, permError("%s: include of %s: %s", domain, target, reason)
+		}
+	case "a":
+		ips, err := c.lookupIP(target)
+		if err != nil {
+			return false, err
+		}
+		return c.matchIPs(ips, m), nil
+	case "mx":
+		mxs, err := c.resolver.MX(target)
+		if err == nil && len(mxs) == 0 || isNotFound(err) {
+			return false, c.void(target)
+		} else if err != nil {
+			return false, tempError("%s: %v", target, err)
+		}
+		if len(mxs) > maxNames {
+			return false, permError("%s has more than %d MX records", target, maxNames)
+		}
+		for _, mx := range mxs {
+			if mx.Host == "." {
+				continue
+			}
+			ips, err := c.resolver.IP(mx.Host)
+			if isNotFound(err) {
+				continue
+			} else if err != nil {
+				return false, tempError("%s: %v", mx.Host, err)
+			}
+			if c.matchIPs(ips, m) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "ptr":
+		names, err := c.validatedNames()
+		if err != nil {
+			return false, err
+		}
+		for _, name := range names {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "exists":
+		ips, err := c.lookupIP(target)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	panic("unknown mechanism " + m.name)
+}
+
+func (c *check) matchIPs(ips []net.IP, m *mechanism) bool {
+	for _, ip := range ips {
+		if inNetwork(c.ip, ip, m.cidr4, m.cidr6) {
+			return true
+		}
+	}
+	return false
+}
+
+// inNetwork returns true if client is in the network of addr, using
+// the prefix length for its address family.
+func inNetwork(client, addr net.IP, cidr4, cidr6 int) bool {
+	if client4 := client.To4(); client4 != nil {
+		addr4 := addr.To4()
+		if addr4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(cidr4, 8*net.IPv4len)
+		return client4.Mask(mask).Equal(addr4.Mask(mask))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(cidr6, 8*net.IPv6len)
+	return client.Mask(mask).Equal(addr.Mask(mask))
+}
+
+func (c *check) countLookup() error {
+	c.lookups++
+	if c.lookups > maxLookups {
+		return permError("more than %d DNS lookups", maxLookups)
+	}
+	return nil
+}
+
+// void counts a lookup without an answer.
+func (c *check) void(name string) error {
+	c.voids++
+	if c.voids > maxVoidLookups {
+		return permError("more than %d void lookups, last was %s", maxVoidLookups, name)
+	}
+	return nil
+}
+
+func (c *check) lookupIP(host string) ([]net.IP, error) {
+	ips, err := c.resolver.IP(host)
+	if err == nil && len(ips) == 0 || isNotFound(err) {
+		return nil, c.void(host)
+	} else if err != nil {
+		return nil, tempError("%s: %v", host, err)
+	}
+	return ips, nil
+}
+
+// validatedNames returns the names of the client's address that
+// resolve back to it. The PTR lookup belongs to the term that needs
+// the names, but each address lookup counts toward the DNS lookup
+// limit, and all of them toward the void lookup limit. Other lookup
+// errors just mean fewer names.
+func (c *check) validatedNames() ([]string, error) {
+	if c.resolved {
+		return c.names, nil
+	}
+	c.resolved = true
+	addr := c.ip.String()
+	names, err := c.resolver.Addr(addr)
+	if err == nil && len(names) == 0 || isNotFound(err) {
+		return nil, c.void(addr)
+	}
+	if len(names) > maxNames {
+		names = names[:maxNames]
+	}
+	for _, name := range names {
+		if err := c.countLookup(); err != nil {
+			return nil, err
+		}
+		ips, err := c.resolver.IP(name)
+		if err == nil && len(ips) == 0 || isNotFound(err) {
+			if err := c.void(name); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(c.ip) {
+				name = strings.ToLower(strings.TrimSuffix(name, "."))
+				c.names = append(c.names, name)
+				break
+			}
+		}
+	}
+	return c.names, nil
+}
+
+// target expands the domain-spec of a mechanism or modifier. An
+// empty domain-spec means the current domain.
+func (c *check) target(spec, domain string) (string, error) {
+	if spec == "" {
+		return strings.ToLower(domain), nil
+	}
+	target, err := c.expand(spec, domain)
+	if err != nil {
+		return "", permError("%s: %v", spec, err)
+	}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	// RFC 7208, section 7.3: Long names are shortened from the
+	// left.
+	for len(target) > 253 {
+		i := strings.IndexByte(target, '.')
+		if i < 0 {
+			break
+		}
+		target = target[i+1:]
+	}
+	return target, nil
+}
+
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+type record struct {
+	mechanisms []*mechanism
+	redirect   string
+}
+
+type mechanism struct {
+	text      string
+	qualifier Result
+	name      string
+	domain    string
+	ip        net.IP
+	cidr4     int
+	cidr6     int
+}
+
+var modifierName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]*=`)
+
+// parseRecord parses a whole record, so that syntax errors are found
+// before anything is evaluated (RFC 7208, section 4.6).
+func parseRecord(txt string) (*record, error) {
+	rec := &record{}
+	for _, term := range strings.Fields(txt)[1:] {
+		if name := modifierName.FindString(term); name != "" {
+			value := term[len(name):]
+			if err := checkMacro(value); err != nil {
+				return nil, fmt.Errorf("%s: %v", term, err)
+			}
+			if strings.ToLower(name) == "redirect=" {
+				if rec.redirect != "" {
+					return nil, errors.New("more than one redirect modifier")
+				}
+				rec.redirect = value
+			}
+			// Unknown modifiers are ignored, and so is exp.
+			continue
+		}
+		m, err := parseMechanism(term)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", term, err)
+		}
+		rec.mechanisms = append(rec.mechanisms, m)
+	}
+	return rec, nil
+}
+
+func parseMechanism(term string) (*mechanism, error) {
+	m := &mechanism{text: term, qualifier: Pass, cidr4: 32, cidr6: 128}
+	switch term[0] {
+	case '+':
+		term = term[1:]
+	case '-':
+		m.qualifier = Fail
+		term = term[1:]
+	case '~':
+		m.qualifier = SoftFail
+		term = term[1:]
+	case '?':
+		m.qualifier = Neutral
+		term = term[1:]
+	}
+	name, rest := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, rest = term[:i], term[i:]
+	}
+	m.name = strings.ToLower(name)
+	var err error
+	switch m.name {
+	case "all":
+		if rest != "" {
+			return nil, errors.New("unexpected argument")
+		}
+	case "include", "exists":
+		if !strings.HasPrefix(rest, ":") || len(rest) == 1 {
+			return nil, errors.New("missing domain")
+		}
+		m.domain = rest[1:]
+	case "a", "mx":
+		m.domain, rest = splitDomain(rest)
+		m.cidr4, m.cidr6, err = parseDualCIDR(rest)
+	case "ptr":
+		m.domain, rest = splitDomain(rest)
+		if rest != "" {
+			return nil, errors.New("unexpected prefix length")
+		}
+	case "ip4", "ip6":
+		if !strings.HasPrefix(rest, ":") {
+			return nil, errors.New("missing address")
+		}
+		err = m.parseNetwork(rest[1:])
+	default:
+		return nil, errors.New("unknown mechanism")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.domain != "" {
+		if err := checkMacro(m.domain); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// splitDomain splits an optional ":domain" from a prefix length.
+func splitDomain(rest string) (string, string) {
+	if !strings.HasPrefix(rest, ":") {
+		return "", rest
+	}
+	rest = rest[1:]
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return rest[:i], rest[i:]
+	}
+	return rest, ""
+}
+
+// parseDualCIDR parses "/24", "//64" or "/24//64".
+func parseDualCIDR(text string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+	var err error
+	if i := strings.Index(text, "//"); i >= 0 {
+		if cidr6, err = parsePrefixLength(text[i+2:], 128); err != nil {
+			return 0, 0, err
+		}
+		text = text[:i]
+	}
+	if text != "" {
+		if text[0] != '/' {
+			return 0, 0, errors.New("invalid prefix length")
+		}
+		if cidr4, err = parsePrefixLength(text[1:], 32); err != nil {
+			return 0, 0, err
+		}
+	}
+	return cidr4, cidr6, nil
+}
+
+func parsePrefixLength(text string, max int) (int, error) {
+	n, err := strconv.Atoi(text)
+	if err != nil || n < 0 || n > max || strconv.Itoa(n) != text {
+		return 0, fmt.Errorf("invalid prefix length %#v", text)
+	}
+	return n, nil
+}
+
+func (m *mechanism) parseNetwork(text string) error {
+	addr, length := text, ""
+	hasLength := false
+	if i := strings.IndexByte(text, '/'); i >= 0 {
+		addr, length, hasLength = text[:i], text[i+1:], true
+	}
+	ip := net.ParseIP(addr)
+	isIP6 := strings.Contains(addr, ":")
+	if ip == nil || (m.name == "ip6") != isIP6 {
+		return fmt.Errorf("invalid address %#v", addr)
+	}
+	max := 32
+	if isIP6 {
+		max = 128
+	} else {
+		ip = ip.To4()
+	}
+	n := max
+	if hasLength {
+		var err error
+		if n, err = parsePrefixLength(length, max); err != nil {
+			return err
+		}
+	}
+	m.ip = ip
+	if isIP6 {
+		m.cidr6 = n
+	} else {
+		m.cidr4 = n
+	}
+	return nil
+}
+
+// Header returns a Received-SPF header field for a result, as
+// described in RFC 7208, section 9.1.
+func Header(result Result, reason string, ip net.IP, helo, sender string) string {
+	return fmt.Sprintf("Received-SPF: %s (%s) client-ip=%s; envelope-from=%s; helo=%s;",
+		result, comment(reason), ip, quote(sender), quote(helo))
+}
+
+// comment makes text safe to use in a header comment.
+func comment(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			return '_'
+		case r < 0x20 || r > 0x7e:
+			return '?'
+		}
+		return r
+	}, text)
+}
+
+var dotAtom = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+/=?^_`{|}~-]+(\\.[A-Za-z0-9!#$%&'*+/=?^_`{|}~-]+)*$")
+
+// quote returns value as a dot-atom if possible, or as a quoted
+// string.
+func quote(value string) string {
+	if dotAtom.MatchString(value) {
+		return value
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
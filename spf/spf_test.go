@@ -0,0 +1,217 @@
+package spf
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// zone is a fake DNS zone for tests. Keys are names prefixed with the
+// record type, like "TXT example.tld".
+type zone map[string][]string
+
+func (z zone) resolver() Resolver {
+	lookup := func(key string) ([]string, error) {
+		if values, ok := z[key]; ok {
+			if len(values) == 1 && values[0] == "SERVFAIL" {
+				return nil, errors.New("server failure")
+			}
+			return values, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: key, IsNotFound: true}
+	}
+	return Resolver{
+		TXT: func(name string) ([]string, error) {
+			return lookup("TXT " + name)
+		},
+		IP: func(host string) ([]net.IP, error) {
+			values, err := lookup("IP " + strings.TrimSuffix(host, "."))
+			ips := []net.IP{}
+			for _, value := range values {
+				ips = append(ips, net.ParseIP(value))
+			}
+			return ips, err
+		},
+		MX: func(name string) ([]*net.MX, error) {
+			values, err := lookup("MX " + name)
+			mxs := []*net.MX{}
+			for _, value := range values {
+				mxs = append(mxs, &net.MX{Host: value + "."})
+			}
+			return mxs, err
+		},
+		Addr: func(addr string) ([]string, error) {
+			return lookup("PTR " + addr)
+		},
+	}
+}
+
+var testZone = zone{
+	"TXT ip.tld":                      {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"},
+	"TXT soft.tld":                    {"v=spf1 ~all"},
+	"TXT neutral.tld":                 {"v=spf1 ?all", "some other text"},
+	"TXT empty.tld":                   {"v=spf1"},
+	"TXT a.tld":                       {"v=spf1 a a:other.a.tld/24 -all"},
+	"IP a.tld":                        {"192.0.2.1", "2001:db8::1"},
+	"IP other.a.tld":                  {"198.51.100.1"},
+	"TXT mx.tld":                      {"v=spf1 mx//64 -all"},
+	"MX mx.tld":                       {"mail.mx.tld"},
+	"IP mail.mx.tld":                  {"192.0.2.25", "2001:db8::25"},
+	"TXT include.tld":                 {"v=spf1 include:ip.tld include:soft.tld -all"},
+	"TXT redirect.tld":                {"v=spf1 redirect=ip.tld"},
+	"TXT noredir.tld":                 {"v=spf1 redirect=none.tld"},
+	"TXT ptr.tld":                     {"v=spf1 ptr -all"},
+	"PTR 192.0.2.7":                   {"host.ptr.tld.", "forged.ptr.tld."},
+	"IP host.ptr.tld":                 {"192.0.2.7"},
+	"IP forged.ptr.tld":               {"192.0.2.8"},
+	"TXT exists.tld":                  {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+	"IP 7.2.0.192.me._spf.exists.tld": {"127.0.0.2"},
+	"TXT two.tld":                     {"v=spf1 -all", "v=spf1 +all"},
+	"TXT syntax.tld":                  {"v=spf1 ip4:192.0.2.300 -all"},
+	"TXT unknown.tld":                 {"v=spf1 foo:bar -all"},
+	"TXT modifier.tld":                {"v=spf1 foo=bar -all"},
+	"TXT temp.tld":                    {"SERVFAIL"},
+	"TXT tempinc.tld":                 {"v=spf1 include:temp.tld -all"},
+	"TXT noneinc.tld":                 {"v=spf1 include:none.tld -all"},
+	"TXT loop.tld":                    {"v=spf1 include:loop.tld -all"},
+	"TXT void.tld":                    {"v=spf1 a:v1.tld a:v2.tld a:v3.tld -all"},
+	"TXT ptrvoid.tld":                 {"v=spf1 a:v1.tld a:v2.tld ptr -all"},
+	"TXT ptrlimit.tld":                {"v=spf1 a:a.tld a:a.tld a:a.tld a:a.tld a:a.tld a:a.tld a:a.tld a:a.tld ptr -all"},
+	"TXT ptrmacro.tld":                {"v=spf1 a:v1.tld exists:%{p}.ptr.tld -all"},
+	"TXT helo.tld":                    {"v=spf1 ip4:192.0.2.7 -all"},
+	"TXT mapped.tld":                  {"v=spf1 ip4:192.0.2.7 -all"},
+	"TXT case.tld":                    {"V=SPF1 -ALL"},
+	"TXT prefix.tld":                  {"v=spf10 -all"},
+	"TXT badcidr.tld":                 {"v=spf1 a/33 -all"},
+	"TXT macrosyntax.tld":             {"v=spf1 exists:%{x} -all"},
+}
+
+func TestCheck(t *testing.T) {
+	checker := New(testZone.resolver())
+	tests := []struct {
+		ip     string
+		helo   string
+		sender string
+		result Result
+	}{
+		{"192.0.2.7", "", "me@ip.tld", Pass},
+		{"2001:db8::7", "", "me@ip.tld", Pass},
+		{"198.51.100.7", "", "me@ip.tld", Fail},
+		{"192.0.2.7", "", "me@soft.tld", SoftFail},
+		{"192.0.2.7", "", "me@neutral.tld", Neutral},
+		{"192.0.2.7", "", "me@empty.tld", Neutral},
+		{"192.0.2.7", "", "me@none.tld", None},
+		{"192.0.2.7", "", "me@localhost", None},
+		{"192.0.2.1", "", "me@a.tld", Pass},
+		{"2001:db8::1", "", "me@a.tld", Pass},
+		{"2001:db8::2", "", "me@a.tld", Fail},
+		{"198.51.100.200", "", "me@a.tld", Pass},
+		{"198.51.101.1", "", "me@a.tld", Fail},
+		{"192.0.2.25", "", "me@mx.tld", Pass},
+		{"192.0.2.26", "", "me@mx.tld", Fail},
+		{"2001:db8::ffff", "", "me@mx.tld", Pass},
+		{"192.0.2.7", "", "me@include.tld", Pass},
+		{"198.51.100.7", "", "me@include.tld", Fail},
+		{"192.0.2.7", "", "me@redirect.tld", Pass},
+		{"198.51.100.7", "", "me@redirect.tld", Fail},
+		{"192.0.2.7", "", "me@noredir.tld", PermError},
+		{"192.0.2.7", "", "me@ptr.tld", Pass},
+		{"192.0.2.8", "", "me@ptr.tld", Fail},
+		{"192.0.2.7", "", "me@exists.tld", Pass},
+		{"192.0.2.7", "", "you@exists.tld", Fail},
+		{"192.0.2.7", "", "me@two.tld", PermError},
+		{"192.0.2.7", "", "me@syntax.tld", PermError},
+		{"192.0.2.7", "", "me@unknown.tld", PermError},
+		{"192.0.2.7", "", "me@modifier.tld", Fail},
+		{"192.0.2.7", "", "me@temp.tld", TempError},
+		{"192.0.2.7", "", "me@tempinc.tld", TempError},
+		{"192.0.2.7", "", "me@noneinc.tld", PermError},
+		{"192.0.2.7", "", "me@loop.tld", PermError},
+		{"192.0.2.7", "", "me@void.tld", PermError},
+		{"192.0.2.9", "", "me@ptrvoid.tld", PermError},
+		{"192.0.2.7", "", "me@ptrlimit.tld", PermError},
+		{"192.0.2.9", "", "me@ptrmacro.tld", PermError},
+		{"192.0.2.7", "helo.tld", "", Pass},
+		{"198.51.100.7", "helo.tld", "", Fail},
+		{"::ffff:192.0.2.7", "", "me@mapped.tld", Pass},
+		{"192.0.2.7", "", "me@case.tld", Fail},
+		{"192.0.2.7", "", "me@prefix.tld", None},
+		{"192.0.2.7", "", "me@badcidr.tld", PermError},
+		{"192.0.2.7", "", "me@macrosyntax.tld", PermError},
+	}
+	for _, test := range tests {
+		result, reason := checker.Check(net.ParseIP(test.ip), test.helo, test.sender)
+		if result != test.result {
+			t.Errorf("Expected %s for %s from %s, got %s (%s)",
+				test.result, test.sender, test.ip, result, reason)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	// Examples from RFC 7208, section 7.4
+	c := &check{
+		resolver: zone{}.resolver(),
+		ip:       net.ParseIP("192.0.2.3").To4(),
+		sender:   "strong-bad@email.example.com",
+		local:    "strong-bad",
+		domain:   "email.example.com",
+	}
+	tests := map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}":  "3.2.0.192.in-addr.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%{p}":                              "unknown",
+		"%{S}":                              "strong-bad%40email.example.com",
+		"%%%_%-":                            "% %20",
+	}
+	for macro, expected := range tests {
+		actual, err := c.expand(macro, "email.example.com")
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", macro, err)
+		} else if actual != expected {
+			t.Errorf("Expected %s to expand to %#v, got %#v", macro, expected, actual)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	actual, _ := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	expected := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if actual != expected {
+		t.Errorf("Expected %#v, got %#v", expected, actual)
+	}
+
+	for _, invalid := range []string{"%", "%{", "%{}", "%{x}", "%{d0}", "%{d!}", "%x"} {
+		if _, err := c.expand(invalid, "email.example.com"); err == nil {
+			t.Errorf("Expected an error for %#v", invalid)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	header := Header(Pass, "ip.tld: ip4:192.0.2.0/24 matched", net.ParseIP("192.0.2.7"),
+		"mail (by) me", "me@ip.tld")
+	expected := `Received-SPF: pass (ip.tld: ip4:192.0.2.0/24 matched) client-ip=192.0.2.7; envelope-from="me@ip.tld"; helo="mail (by) me";`
+	if header != expected {
+		t.Errorf("Expected %#v, got %#v", expected, header)
+	}
+	if comment("a (b) \\c\r\n") != "a _b_ _c??" {
+		t.Errorf("Unexpected comment %#v", comment("a (b) \\c\r\n"))
+	}
+}
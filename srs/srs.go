@@ -0,0 +1,199 @@
+// Package srs implements the Sender Rewriting Scheme, which rewrites
+// the envelope sender of forwarded mail to an address of the
+// forwarder, so that the forwarded mail passes SPF checks. Bounces to
+// the rewritten address can be reversed to the original sender.
+//
+// A sender local@domain is rewritten to
+//
+//	SRS0=HHHH=TT=domain=local@srsdomain
+//
+// where HHHH is a truncated HMAC of the rest, and TT a timestamp in
+// days. An address that already is an SRS0 address of another
+// forwarder is rewritten to an SRS1 address instead, which keeps the
+// first forwarder's domain:
+//
+//	SRS1=HHHH=forwarder==HHHH=TT=domain=local@srsdomain
+
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotSRS      = errors.New("not an SRS address")
+	ErrMalformed   = errors.New("malformed SRS address")
+	ErrInvalidHash = errors.New("invalid hash in SRS address")
+	ErrExpired     = errors.New("SRS address expired")
+)
+
+// DefaultMaxAge is how long rewritten addresses stay valid, in days.
+const DefaultMaxAge = 21
+
+const (
+	hashLength = 4
+	timeBase   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	// The timestamp is two base32 digits of days.
+	timeSlots = 32 * 32
+)
+
+type SRS struct {
+	domain string
+	secret []byte
+	maxAge int
+	now    func() time.Time
+}
+
+// New returns an SRS that rewrites addresses to domain. The secret
+// protects against forged addresses and has to stay the same as long
+// as bounces can come back.
+func New(domain string, secret []byte) *SRS {
+	return &SRS{
+		domain: strings.ToLower(domain),
+		secret: secret,
+		maxAge: DefaultMaxAge,
+		now:    time.Now,
+	}
+}
+
+// Forward rewrites a sender address. The null sender and addresses in
+// the SRS domain are not rewritten.
+func (s *SRS) Forward(sender string) (string, error) {
+	local, domain, ok := split(sender)
+	if sender == "" || strings.EqualFold(domain, s.domain) {
+		return sender, nil
+	}
+	if !ok || local == "" || domain == "" {
+		return "", errors.New("can not rewrite an address without a domain")
+	}
+	switch prefix(local) {
+	case "SRS0":
+		// Keep the first forwarder's domain, so that only it
+		// has to verify the hash.
+		rest := local[5:]
+		return s.srs1(domain, rest), nil
+	case "SRS1":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) == 3 && parts[2] != "" && parts[2][0] == '=' {
+			return s.srs1(parts[1], parts[2][1:]), nil
+		}
+	}
+	stamp := s.timestamp()
+	return "SRS0=" + s.hash(stamp, domain, local) + "=" + stamp + "=" +
+		domain + "=" + local + "@" + s.domain, nil
+}
+
+func (s *SRS) srs1(host, rest string) string {
+	return "SRS1=" + s.hash(host, rest) + "=" + host + "==" + rest + "@" + s.domain
+}
+
+// Reverse returns the address that was rewritten to address. For SRS1
+// addresses, this is the SRS0 address of the first forwarder.
+func (s *SRS) Reverse(address string) (string, error) {
+	local, domain, _ := split(address)
+	if !strings.EqualFold(domain, s.domain) {
+		return "", ErrNotSRS
+	}
+	switch prefix(local) {
+	case "SRS0":
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", ErrMalformed
+		}
+		hash, stamp, domain, local := parts[0], parts[1], parts[2], parts[3]
+		if !s.validHash(hash, stamp, domain, local) {
+			return "", ErrInvalidHash
+		}
+		if err := s.checkTimestamp(stamp); err != nil {
+			return "", err
+		}
+		return local + "@" + domain, nil
+	case "SRS1":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || len(parts[2]) < 2 || parts[2][0] != '=' {
+			return "", ErrMalformed
+		}
+		hash, host, rest := parts[0], parts[1], parts[2][1:]
+		if !s.validHash(hash, host, rest) {
+			return "", ErrInvalidHash
+		}
+		return "SRS0=" + rest + "@" + host, nil
+	}
+	return "", ErrNotSRS
+}
+
+// IsSRS returns true if address looks like an SRS address of any
+// forwarder.
+func IsSRS(address string) bool {
+	local, _, _ := split(address)
+	return prefix(local) != ""
+}
+
+// prefix returns SRS0 or SRS1 if local starts with it and a
+// separator, and an empty string otherwise.
+func prefix(local string) string {
+	if len(local) < 5 || !strings.ContainsRune("=+-", rune(local[4])) {
+		return ""
+	}
+	switch p := strings.ToUpper(local[:4]); p {
+	case "SRS0", "SRS1":
+		return p
+	}
+	return ""
+}
+
+func split(address string) (string, string, bool) {
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return address, "", false
+	}
+	return address[:i], address[i+1:], true
+}
+
+// hash returns the truncated HMAC of parts. Some mail servers change
+// the case of local parts, so everything is hashed in lower case.
+func (s *SRS) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	for _, part := range parts {
+		// Separate the parts, so they can not be shifted
+		// into each other.
+		mac.Write([]byte(strings.ToLower(part)))
+		mac.Write([]byte{0})
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+func (s *SRS) validHash(hash string, parts ...string) bool {
+	return hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(s.hash(parts...))))
+}
+
+func (s *SRS) days() int {
+	return int(s.now().Unix()/(24*60*60)) % timeSlots
+}
+
+func (s *SRS) timestamp() string {
+	days := s.days()
+	return string([]byte{timeBase[days/32], timeBase[days%32]})
+}
+
+func (s *SRS) checkTimestamp(stamp string) error {
+	if len(stamp) != 2 {
+		return ErrMalformed
+	}
+	stamp = strings.ToUpper(stamp)
+	high := strings.IndexByte(timeBase, stamp[0])
+	low := strings.IndexByte(timeBase, stamp[1])
+	if high < 0 || low < 0 {
+		return ErrMalformed
+	}
+	age := (s.days() - (high*32 + low) + timeSlots) % timeSlots
+	if age > s.maxAge {
+		return ErrExpired
+	}
+	return nil
+}
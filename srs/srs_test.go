@@ -0,0 +1,100 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSRS(domain string, now time.Time) *SRS {
+	s := New(domain, []byte("secret"))
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestForwardAndReverse(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := newTestSRS("fwd.tld", now)
+
+	rewritten, err := s.Forward("me@test.tld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "=test.tld=me@fwd.tld") {
+		t.Errorf("Unexpected SRS0 address %#v", rewritten)
+	}
+	if !IsSRS(rewritten) {
+		t.Errorf("Expected %#v to be an SRS address", rewritten)
+	}
+	original, err := s.Reverse(rewritten)
+	if err != nil || original != "me@test.tld" {
+		t.Errorf("Expected to get the original address back, got %#v, %v", original, err)
+	}
+	// Some servers change the case of addresses
+	original, err = s.Reverse(strings.ToLower(rewritten))
+	if err != nil || original != "me@test.tld" {
+		t.Errorf("Expected the address to be case-insensitive, got %#v, %v", original, err)
+	}
+
+	// Forwarded again by another forwarder
+	other := newTestSRS("other.tld", now)
+	srs1, err := other.Forward(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=fwd.tld==") {
+		t.Errorf("Unexpected SRS1 address %#v", srs1)
+	}
+	back, err := other.Reverse(srs1)
+	if err != nil || back != rewritten {
+		t.Errorf("Expected %#v, got %#v, %v", rewritten, back, err)
+	}
+	// And once more, which keeps the first forwarder
+	third := newTestSRS("third.tld", now)
+	again, err := third.Forward(srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err = third.Reverse(again)
+	if err != nil || back != rewritten {
+		t.Errorf("Expected %#v, got %#v, %v", rewritten, back, err)
+	}
+
+	for _, unchanged := range []string{"", "me@fwd.tld", "me@FWD.tld"} {
+		if address, err := s.Forward(unchanged); err != nil || address != unchanged {
+			t.Errorf("Expected %#v to be unchanged, got %#v, %v", unchanged, address, err)
+		}
+	}
+	if _, err := s.Forward("me"); err == nil {
+		t.Error("Expected an error for an address without a domain")
+	}
+}
+
+func TestReverseErrors(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := newTestSRS("fwd.tld", now)
+	rewritten, _ := s.Forward("me@test.tld")
+
+	tests := map[string]error{
+		"me@fwd.tld": ErrNotSRS,
+		strings.Replace(rewritten, "@fwd.tld", "@other.tld", 1):   ErrNotSRS,
+		"SRS0=abcd=AA=test.tld@fwd.tld":                           ErrMalformed,
+		"SRS1=abcd=fwd.tld=rest@fwd.tld":                          ErrMalformed,
+		strings.Replace(rewritten, "=me@", "=you@", 1):            ErrInvalidHash,
+		strings.Replace(rewritten, "=test.tld=", "=evil.tld=", 1): ErrInvalidHash,
+	}
+	for address, expected := range tests {
+		if _, err := s.Reverse(address); err != expected {
+			t.Errorf("Expected %v for %#v, got %v", expected, address, err)
+		}
+	}
+
+	s.now = func() time.Time { return now.Add(DefaultMaxAge * 24 * time.Hour) }
+	if _, err := s.Reverse(rewritten); err != nil {
+		t.Errorf("Expected the address to be valid for %d days, got %v", DefaultMaxAge, err)
+	}
+	s.now = func() time.Time { return now.Add((DefaultMaxAge + 1) * 24 * time.Hour) }
+	if _, err := s.Reverse(rewritten); err != ErrExpired {
+		t.Errorf("Expected the address to expire, got %v", err)
+	}
+}
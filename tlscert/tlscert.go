@@ -0,0 +1,181 @@
+// Package tlscert implements a certificate manager that reloads a
+// certificate and key pair from disk when the files change. This
+// allows certificates to be rotated without restarting the proxy.
+
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/argerror"
+)
+
+// How often the files are checked for modifications at most.
+const DefaultInterval = time.Minute
+
+// Logger gets the messages about reloading.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+var defaultLogger = log.New(os.Stdout, "", 0)
+
+type Manager struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu          sync.Mutex
+	logger      Logger
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+// New loads the certificate and key pair. It returns an error when
+// the pair can not be loaded or the certificate is not valid now.
+func New(certFile, keyFile string) (*Manager, error) {
+	m := &Manager{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: DefaultInterval,
+		logger:   defaultLogger,
+	}
+	certModTime, keyModTime, err := m.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := load(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	m.cert = cert
+	m.certModTime = certModTime
+	m.keyModTime = keyModTime
+	m.lastCheck = time.Now()
+	return m, nil
+}
+
+// SetLogger logs to logger instead of standard output.
+func (m *Manager) SetLogger(logger Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logger = logger
+}
+
+// GetCertificate returns the current certificate. It is meant to be
+// used as tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	check := time.Since(m.lastCheck) >= m.interval
+	if check {
+		m.lastCheck = time.Now()
+	}
+	m.mu.Unlock()
+	// The files are checked without holding the lock, so other
+	// handshakes go on with the current certificate meanwhile.
+	if check {
+		m.reloadIfModified()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert, nil
+}
+
+// Reload unconditionally reloads the certificate and key pair. When
+// loading fails, the old pair is kept and the error is returned.
+func (m *Manager) Reload() error {
+	return m.reload()
+}
+
+func (m *Manager) reloadIfModified() {
+	certModTime, keyModTime, err := m.modTimes()
+	if err != nil {
+		m.logError(err)
+		return
+	}
+	m.mu.Lock()
+	modified := !certModTime.Equal(m.certModTime) || !keyModTime.Equal(m.keyModTime)
+	// Remember the modification times even if loading fails, so
+	// a broken pair is only reported once.
+	m.certModTime = certModTime
+	m.keyModTime = keyModTime
+	m.mu.Unlock()
+	if modified {
+		m.reload()
+	}
+}
+
+// reload loads the pair and only takes the lock to swap it in.
+func (m *Manager) reload() error {
+	cert, err := load(m.certFile, m.keyFile)
+	if err != nil {
+		m.logError(err)
+		return err
+	}
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	m.log(argerror.New("Certificate reloaded", map[string]string{
+		"cert":     m.certFile,
+		"key":      m.keyFile,
+		"subject":  cert.Leaf.Subject.String(),
+		"notafter": cert.Leaf.NotAfter.String(),
+	}))
+	return nil
+}
+
+func (m *Manager) logError(err error) {
+	m.log(argerror.New("Error reloading certificate, keeping the old one",
+		map[string]string{
+			"cert":  m.certFile,
+			"key":   m.keyFile,
+			"error": err.Error(),
+		}))
+}
+
+func (m *Manager) log(err error) {
+	m.mu.Lock()
+	logger := m.logger
+	m.mu.Unlock()
+	logger.Println(err)
+}
+
+func (m *Manager) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(m.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(m.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func load(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid before %s", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
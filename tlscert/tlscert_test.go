@@ -0,0 +1,154 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jorgenschaefer/smtpproxy/internal/testcert"
+)
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _, err := testcert.WriteFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(certFile, keyFile); err != nil {
+		t.Errorf("Expected no error, but got %#v", err)
+	}
+	if _, err := New(keyFile, certFile); err == nil {
+		t.Error("Expected an error for swapped certificate and key")
+	}
+	if _, err := New(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("Expected an error for a missing certificate file")
+	}
+
+	writePair(t, certFile, keyFile, -time.Hour)
+	if _, err := New(certFile, keyFile); err == nil {
+		t.Error("Expected an error for an expired certificate")
+	}
+}
+
+func TestReload(t *testing.T) {
+	certFile, keyFile, _, err := testcert.WriteFiles(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.interval = 0
+	old := getCertificate(t, m)
+
+	// Unchanged files keep the certificate
+	if cert := getCertificate(t, m); cert != old {
+		t.Error("Expected the certificate to stay the same")
+	}
+
+	// Changed files swap in the new certificate
+	writePair(t, certFile, keyFile, time.Hour)
+	touch(t, certFile, keyFile, time.Now().Add(time.Minute))
+	renewed := getCertificate(t, m)
+	if renewed == old {
+		t.Error("Expected the certificate to be reloaded")
+	}
+
+	// Broken files keep the old certificate
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	touch(t, certFile, keyFile, time.Now().Add(2*time.Minute))
+	if cert := getCertificate(t, m); cert != renewed {
+		t.Error("Expected the old certificate to be kept for a broken key")
+	}
+	if err := m.Reload(); err == nil {
+		t.Error("Expected Reload() to fail for a broken key")
+	}
+
+	// Deleted files keep the old certificate
+	os.Remove(certFile)
+	if cert := getCertificate(t, m); cert != renewed {
+		t.Error("Expected the old certificate to be kept for a missing file")
+	}
+}
+
+func TestReloadInterval(t *testing.T) {
+	certFile, keyFile, _, err := testcert.WriteFiles(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := getCertificate(t, m)
+	writePair(t, certFile, keyFile, time.Hour)
+	touch(t, certFile, keyFile, time.Now().Add(time.Minute))
+	if cert := getCertificate(t, m); cert != old {
+		t.Error("Did not expect a reload before the interval passed")
+	}
+}
+
+type logLines []string
+
+func (l *logLines) Println(v ...interface{}) {
+	*l = append(*l, fmt.Sprint(v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	certFile, keyFile, _, err := testcert.WriteFiles(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines logLines
+	m.SetLogger(&lines)
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	m.Reload()
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "Certificate reloaded") ||
+		!strings.HasPrefix(lines[1], "Error reloading certificate") {
+		t.Errorf("Expected the reloads to be logged, got %#v", lines)
+	}
+}
+
+func getCertificate(t *testing.T, m *Manager) *tls.Certificate {
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %#v", err)
+	}
+	return cert
+}
+
+func writePair(t *testing.T, certFile, keyFile string, validFor time.Duration) {
+	certPEM, keyPEM, err := testcert.Generate(validFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touch sets explicit modification times, as the file system
+// resolution might not notice a quick rewrite.
+func touch(t *testing.T, certFile, keyFile string, mtime time.Time) {
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}